@@ -0,0 +1,642 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	systemdCgroupManager  = "systemd"
+	cgroupfsCgroupManager = "cgroupfs"
+)
+
+// cgroupfsParent is where the cgroupfs manager creates container cgroups, relative to the cgroup
+// v2 root.
+const cgroupfsParent = "/box"
+
+// freezeTimeout is how long to wait for the processes in a cgroup to be frozen or thawed.
+const freezeTimeout = 10 * time.Second
+
+// CgroupManager creates the cgroup of a container and applies its resource limits.
+type CgroupManager interface {
+	// Apply creates the cgroup with `resources` and moves process `pid` into it
+	Apply(ctx context.Context, pid int, resources *specs.LinuxResources) error
+	// Set changes the resource limits of the cgroup to `resources` after Apply
+	Set(ctx context.Context, resources *specs.LinuxResources) error
+	// Freeze stops every process in the cgroup if `frozen` is set, otherwise it lets them run
+	// again. It returns once the kernel reports the cgroup has been frozen or thawed.
+	Freeze(ctx context.Context, frozen bool) error
+	// Path is the directory of the cgroup in the cgroup v2 hierarchy, empty before Apply or if
+	// the container has no cgroup
+	Path() string
+	// Destroy removes the cgroup once every process in it has exited
+	Destroy() error
+}
+
+// NewCgroupManager returns the cgroup manager called `name` for `container`, which is systemd or
+// cgroupfs. When `name` is empty systemd is used if it can be reached, otherwise cgroupfs.
+func NewCgroupManager(name string, container *Container, config *specs.Spec) (CgroupManager, error) {
+	if name == "" {
+		name = detectCgroupManager()
+	}
+	switch name {
+	case systemdCgroupManager:
+		return &systemdManager{rootless: Rootless()}, nil
+	case cgroupfsCgroupManager:
+		path := config.Linux.CgroupsPath
+		if path == "" {
+			path = container.ID
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cgroupfsParent, path)
+		}
+		return &cgroupfsManager{path: filepath.Join(cgroupRoot, path)}, nil
+	default:
+		return nil, fmt.Errorf("unknown cgroup manager %s, must be systemd or cgroupfs", name)
+	}
+}
+
+// LoadCgroupManager returns the cgroup manager of `container` from its state, to change the
+// cgroup of a container which is already running.
+func LoadCgroupManager(container *Container) (CgroupManager, error) {
+	switch {
+	case container.CgroupUnit != "":
+		return &systemdManager{rootless: Rootless(), unit: container.CgroupUnit, path: container.CgroupPath}, nil
+	case container.CgroupPath != "":
+		return &cgroupfsManager{path: container.CgroupPath}, nil
+	}
+	return nil, fmt.Errorf("container %s has no cgroup", container.ID)
+}
+
+// detectCgroupManager returns systemd if it is the init system and the bus box would use is
+// there, otherwise cgroupfs.
+func detectCgroupManager() string {
+	// the same check as sd_booted(3)
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return cgroupfsCgroupManager
+	}
+	if Rootless() && os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		if _, err := os.Stat(filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "bus")); err != nil {
+			return cgroupfsCgroupManager
+		}
+	}
+	return systemdCgroupManager
+}
+
+// systemdManager puts the container in a transient scope unit, which systemd applies the
+// resource limits to. When rootless the scope is created by the user's systemd instance, which
+// delegates the controllers it has been given to the container.
+type systemdManager struct {
+	rootless bool
+	unit     string
+	path     string
+}
+
+func (m *systemdManager) Apply(ctx context.Context, pid int, resources *specs.LinuxResources) error {
+	conn, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	m.unit = fmt.Sprintf("box-container-%d.scope", pid)
+	properties := []systemd.Property{
+		{Name: "PIDs", Value: dbus.MakeVariant([]uint32{uint32(pid)})},
+		{Name: "Description", Value: dbus.MakeVariant("Box container scope")},
+	}
+	if m.rootless {
+		properties = append(properties, systemd.Property{Name: "Delegate", Value: dbus.MakeVariant(true)})
+	}
+	properties = append(properties, systemdProperties(resources)...)
+	doneChan := make(chan string, 1)
+	if _, err := conn.StartTransientUnitContext(ctx, m.unit, "replace", properties, doneChan); err != nil {
+		return fmt.Errorf("failed to start transient unit for container: %w", err)
+	}
+	select {
+	case result := <-doneChan:
+		if result != "done" {
+			return fmt.Errorf("failed to start transient unit %s: job %s", m.unit, result)
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("timeout waiting for start transient unit: %w", ctx.Err())
+	}
+
+	m.path, err = CgroupPathFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find container cgroup: %w", err)
+	}
+	return setCgroupResources(m.path, slices.DeleteFunc(cgroupFiles(resources), handledBySystemd))
+}
+
+func (m *systemdManager) Set(ctx context.Context, resources *specs.LinuxResources) error {
+	conn, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetUnitPropertiesContext(ctx, m.unit, true, systemdProperties(resources)...); err != nil {
+		return fmt.Errorf("failed to set properties of unit %s: %w", m.unit, err)
+	}
+	return setCgroupResources(m.path, slices.DeleteFunc(cgroupFiles(resources), handledBySystemd))
+}
+
+func (m *systemdManager) Freeze(ctx context.Context, frozen bool) error {
+	conn, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if frozen {
+		err = conn.FreezeUnit(ctx, m.unit)
+	} else {
+		err = conn.ThawUnit(ctx, m.unit)
+	}
+	if err != nil {
+		// systemd before v246 has no freezer, which leaves the cgroup to be frozen directly
+		Logger(ctx).Debug("failed to freeze unit with systemd", "unit", m.unit, "err", err)
+		return freezeCgroup(ctx, m.path, frozen)
+	}
+	return waitForFreeze(ctx, m.path, frozen)
+}
+
+func (m *systemdManager) Path() string {
+	return m.path
+}
+
+// Destroy does nothing as systemd removes a transient scope once it is empty.
+func (m *systemdManager) Destroy() error {
+	return nil
+}
+
+// connect connects to the system instance of systemd, or the user's instance when rootless.
+func (m *systemdManager) connect(ctx context.Context) (*systemd.Conn, error) {
+	var conn *systemd.Conn
+	var err error
+	if m.rootless {
+		conn, err = systemd.NewUserConnectionContext(ctx)
+	} else {
+		conn, err = systemd.NewWithContext(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to systemd dbus (use --cgroup-manager cgroupfs without systemd): %w", err)
+	}
+	return conn, nil
+}
+
+// systemdProperties returns the unit properties which apply `resources`. The limits systemd has
+// no property for are written to the cgroup directly, see handledBySystemd.
+func systemdProperties(resources *specs.LinuxResources) []systemd.Property {
+	var properties []systemd.Property
+	if resources == nil {
+		return properties
+	}
+	if cpu := resources.CPU; cpu != nil {
+		// both are always set, as cpu.max is written as a whole
+		if cpu.Quota != nil || cpu.Period != nil {
+			period := uint64(100000)
+			if cpu.Period != nil {
+				period = *cpu.Period
+			}
+			// systemd takes the quota as the CPU time per second
+			quota := uint64(math.MaxUint64)
+			if cpu.Quota != nil && *cpu.Quota > 0 {
+				quota = uint64(*cpu.Quota) * 1000000 / period
+			}
+			properties = append(properties,
+				systemd.Property{Name: "CPUQuotaPerSecUSec", Value: dbus.MakeVariant(quota)},
+				systemd.Property{Name: "CPUQuotaPeriodUSec", Value: dbus.MakeVariant(period)},
+			)
+		}
+		if cpu.Shares != nil {
+			properties = append(properties, systemd.Property{Name: "CPUWeight", Value: dbus.MakeVariant(cpuSharesToWeight(*cpu.Shares))})
+		}
+		if cpu.Cpus != "" {
+			properties = append(properties, systemd.Property{Name: "AllowedCPUs", Value: dbus.MakeVariant(systemdCPUSet(cpu.Cpus))})
+		}
+		if cpu.Mems != "" {
+			properties = append(properties, systemd.Property{Name: "AllowedMemoryNodes", Value: dbus.MakeVariant(systemdCPUSet(cpu.Mems))})
+		}
+	}
+	if memory := resources.Memory; memory != nil {
+		if memory.Limit != nil {
+			properties = append(properties, systemd.Property{Name: "MemoryMax", Value: dbus.MakeVariant(systemdLimit(*memory.Limit))})
+		}
+		if memory.Reservation != nil {
+			properties = append(properties, systemd.Property{Name: "MemoryLow", Value: dbus.MakeVariant(systemdAmount(*memory.Reservation))})
+		}
+		if swap, ok := swapLimit(memory); ok {
+			properties = append(properties, systemd.Property{Name: "MemorySwapMax", Value: dbus.MakeVariant(systemdAmount(swap))})
+		}
+	}
+	if pids := resources.Pids; pids != nil && pids.Limit != nil {
+		properties = append(properties, systemd.Property{Name: "TasksMax", Value: dbus.MakeVariant(systemdLimit(*pids.Limit))})
+	}
+	if blockIO := resources.BlockIO; blockIO != nil {
+		if blockIO.Weight != nil {
+			properties = append(properties, systemd.Property{Name: "IOWeight", Value: dbus.MakeVariant(blkioWeightToIOWeight(*blockIO.Weight))})
+		}
+		throttles := []struct {
+			name    string
+			devices []specs.LinuxThrottleDevice
+		}{
+			{"IOReadBandwidthMax", blockIO.ThrottleReadBpsDevice},
+			{"IOWriteBandwidthMax", blockIO.ThrottleWriteBpsDevice},
+			{"IOReadIOPSMax", blockIO.ThrottleReadIOPSDevice},
+			{"IOWriteIOPSMax", blockIO.ThrottleWriteIOPSDevice},
+		}
+		for _, throttle := range throttles {
+			if len(throttle.devices) == 0 {
+				continue
+			}
+			var devices []systemdIODevice
+			for _, device := range throttle.devices {
+				// a rate of 0 removes the limit
+				limit := uint64(math.MaxUint64)
+				if device.Rate > 0 {
+					limit = device.Rate
+				}
+				devices = append(devices, systemdIODevice{Path: fmt.Sprintf("/dev/block/%d:%d", device.Major, device.Minor), Limit: limit})
+			}
+			properties = append(properties, systemd.Property{Name: throttle.name, Value: dbus.MakeVariant(devices)})
+		}
+	}
+	return properties
+}
+
+// systemdIODevice is an entry of the IO limit properties such as IOReadBandwidthMax, a device and
+// its limit.
+type systemdIODevice struct {
+	Path  string
+	Limit uint64
+}
+
+// systemdCPUSet converts a cpuset list such as 0-3,6, which validateResources has checked, to the
+// bitmask systemd takes for AllowedCPUs and AllowedMemoryNodes.
+func systemdCPUSet(list string) []byte {
+	var mask []byte
+	for _, part := range strings.Split(list, ",") {
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			last = first
+		}
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.Atoi(last)
+		if err != nil {
+			continue
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			for len(mask) <= cpu/8 {
+				mask = append(mask, 0)
+			}
+			mask[cpu/8] |= 1 << (cpu % 8)
+		}
+	}
+	return mask
+}
+
+// handledBySystemd returns whether systemdProperties has a property for `file`.
+func handledBySystemd(file cgroupFile) bool {
+	switch file.name {
+	case "cpu.max", "cpu.weight", "cpuset.cpus", "cpuset.mems", "memory.max", "memory.low", "memory.swap.max", "pids.max", "io.max":
+		return true
+	case "io.weight":
+		return strings.HasPrefix(file.value, "default ")
+	}
+	return false
+}
+
+// systemdLimit converts `limit` to a unit property, where a limit which isn't positive means no
+// limit.
+func systemdLimit(limit int64) uint64 {
+	if limit <= 0 {
+		return math.MaxUint64
+	}
+	return uint64(limit)
+}
+
+// systemdAmount converts `amount` to a unit property like systemdLimit, for the properties where
+// 0 is an amount of its own, such as no swap at all. Only a negative amount means no limit.
+func systemdAmount(amount int64) uint64 {
+	if amount < 0 {
+		return math.MaxUint64
+	}
+	return uint64(amount)
+}
+
+// cgroupfsManager writes to the cgroup v2 filesystem directly, for hosts without systemd.
+type cgroupfsManager struct {
+	path string
+}
+
+func (m *cgroupfsManager) Apply(ctx context.Context, pid int, resources *specs.LinuxResources) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &stat); err != nil {
+		return fmt.Errorf("failed to statfs %s: %w", cgroupRoot, err)
+	}
+	err := errors.New("the cgroupfs cgroup manager needs cgroup v2")
+	if stat.Type == unix.CGROUP2_SUPER_MAGIC {
+		err = os.MkdirAll(m.path, 0755)
+	}
+	if err != nil {
+		// without systemd nothing delegates a cgroup to the user, or on cgroup v1 there is no
+		// cgroup the user could be delegated
+		if Rootless() {
+			Logger(ctx).Warn("rootless containers can't create a cgroup without systemd on cgroup v2, resource limits are ignored", "err", err)
+			m.path = ""
+			return nil
+		}
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	enableControllers(ctx, m.path)
+	if err := m.Set(ctx, resources); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("failed to move container into cgroup: %w", err)
+	}
+	return nil
+}
+
+func (m *cgroupfsManager) Set(ctx context.Context, resources *specs.LinuxResources) error {
+	return setCgroupResources(m.path, cgroupFiles(resources))
+}
+
+func (m *cgroupfsManager) Freeze(ctx context.Context, frozen bool) error {
+	return freezeCgroup(ctx, m.path, frozen)
+}
+
+func (m *cgroupfsManager) Path() string {
+	return m.path
+}
+
+// Destroy removes the cgroup, waiting a short while for the kernel to finish removing exited
+// processes from it.
+func (m *cgroupfsManager) Destroy() error {
+	if m.path == "" {
+		return nil
+	}
+	var err error
+	for range 10 {
+		err = os.Remove(m.path)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup: %w", err)
+}
+
+// enableControllers enables every controller available to the cgroup at `path` in its parents,
+// so that its interface files exist. A controller which can't be enabled only matters if a
+// resource limit uses it, which then fails to be set.
+func enableControllers(ctx context.Context, path string) {
+	relative, err := filepath.Rel(cgroupRoot, path)
+	if err != nil {
+		return
+	}
+	parent := cgroupRoot
+	for _, part := range strings.Split(relative, "/") {
+		data, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+		if err != nil {
+			return
+		}
+		for _, controller := range strings.Fields(string(data)) {
+			if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+				Logger(ctx).Debug("failed to enable cgroup controller", "cgroup", parent, "controller", controller, "err", err)
+			}
+		}
+		parent = filepath.Join(parent, part)
+	}
+}
+
+// cgroupFile is a value to write to a cgroup interface file.
+type cgroupFile struct {
+	name  string
+	value string
+}
+
+// cgroupFiles returns the cgroup v2 interface files and values which apply `resources`, in the
+// order to write them. The unified values are written last so that they take precedence.
+func cgroupFiles(resources *specs.LinuxResources) []cgroupFile {
+	var files []cgroupFile
+	if resources == nil {
+		return files
+	}
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Quota != nil || cpu.Period != nil {
+			quota, period := "max", uint64(100000)
+			if cpu.Quota != nil && *cpu.Quota > 0 {
+				quota = strconv.FormatInt(*cpu.Quota, 10)
+			}
+			if cpu.Period != nil {
+				period = *cpu.Period
+			}
+			files = append(files, cgroupFile{"cpu.max", fmt.Sprintf("%s %d", quota, period)})
+		}
+		if cpu.Burst != nil {
+			files = append(files, cgroupFile{"cpu.max.burst", strconv.FormatUint(*cpu.Burst, 10)})
+		}
+		if cpu.Shares != nil {
+			files = append(files, cgroupFile{"cpu.weight", strconv.FormatUint(cpuSharesToWeight(*cpu.Shares), 10)})
+		}
+		if cpu.Idle != nil {
+			files = append(files, cgroupFile{"cpu.idle", strconv.FormatInt(*cpu.Idle, 10)})
+		}
+		if cpu.Cpus != "" {
+			files = append(files, cgroupFile{"cpuset.cpus", cpu.Cpus})
+		}
+		if cpu.Mems != "" {
+			files = append(files, cgroupFile{"cpuset.mems", cpu.Mems})
+		}
+	}
+
+	if memory := resources.Memory; memory != nil {
+		if memory.Limit != nil {
+			files = append(files, cgroupFile{"memory.max", cgroupLimit(*memory.Limit)})
+		}
+		if memory.Reservation != nil {
+			files = append(files, cgroupFile{"memory.low", cgroupAmount(*memory.Reservation)})
+		}
+		if swap, ok := swapLimit(memory); ok {
+			files = append(files, cgroupFile{"memory.swap.max", cgroupAmount(swap)})
+		}
+	}
+
+	if pids := resources.Pids; pids != nil && pids.Limit != nil {
+		files = append(files, cgroupFile{"pids.max", cgroupLimit(*pids.Limit)})
+	}
+
+	if blockIO := resources.BlockIO; blockIO != nil {
+		if blockIO.Weight != nil {
+			files = append(files, cgroupFile{"io.weight", fmt.Sprintf("default %d", blkioWeightToIOWeight(*blockIO.Weight))})
+		}
+		for _, device := range blockIO.WeightDevice {
+			if device.Weight != nil {
+				files = append(files, cgroupFile{"io.weight", fmt.Sprintf("%d:%d %d", device.Major, device.Minor, blkioWeightToIOWeight(*device.Weight))})
+			}
+		}
+		throttles := []struct {
+			key     string
+			devices []specs.LinuxThrottleDevice
+		}{
+			{"rbps", blockIO.ThrottleReadBpsDevice},
+			{"wbps", blockIO.ThrottleWriteBpsDevice},
+			{"riops", blockIO.ThrottleReadIOPSDevice},
+			{"wiops", blockIO.ThrottleWriteIOPSDevice},
+		}
+		for _, throttle := range throttles {
+			for _, device := range throttle.devices {
+				// a rate of 0 removes the limit
+				rate := "max"
+				if device.Rate > 0 {
+					rate = strconv.FormatUint(device.Rate, 10)
+				}
+				files = append(files, cgroupFile{"io.max", fmt.Sprintf("%d:%d %s=%s", device.Major, device.Minor, throttle.key, rate)})
+			}
+		}
+	}
+
+	for _, limit := range resources.HugepageLimits {
+		files = append(files, cgroupFile{"hugetlb." + limit.Pagesize + ".max", strconv.FormatUint(limit.Limit, 10)})
+	}
+
+	for _, device := range slices.Sorted(maps.Keys(resources.Rdma)) {
+		rdma := resources.Rdma[device]
+		value := device
+		if rdma.HcaHandles != nil {
+			value += fmt.Sprintf(" hca_handle=%d", *rdma.HcaHandles)
+		}
+		if rdma.HcaObjects != nil {
+			value += fmt.Sprintf(" hca_object=%d", *rdma.HcaObjects)
+		}
+		files = append(files, cgroupFile{"rdma.max", value})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(resources.Unified)) {
+		files = append(files, cgroupFile{name, resources.Unified[name]})
+	}
+	return files
+}
+
+// setCgroupResources writes `files` to the cgroup at `path`.
+func setCgroupResources(path string, files []cgroupFile) error {
+	for _, file := range files {
+		if strings.Contains(file.name, "/") {
+			return fmt.Errorf("invalid cgroup file %s", file.name)
+		}
+		// the interface files of a controller only exist when it is enabled
+		if _, err := os.Stat(filepath.Join(path, file.name)); errors.Is(err, os.ErrNotExist) {
+			controller, _, _ := strings.Cut(file.name, ".")
+			return fmt.Errorf("failed to set %s, the %s cgroup controller is not available", file.name, controller)
+		}
+		if err := os.WriteFile(filepath.Join(path, file.name), []byte(file.value), 0644); err != nil {
+			return fmt.Errorf("failed to set %s to %s: %w", file.name, file.value, err)
+		}
+	}
+	return nil
+}
+
+// swapLimit returns the cgroup v2 swap limit for `memory`, whose swap limit is of memory and
+// swap together.
+func swapLimit(memory *specs.LinuxMemory) (int64, bool) {
+	if memory.Swap == nil {
+		return 0, false
+	}
+	if *memory.Swap == -1 || memory.Limit == nil {
+		return -1, true
+	}
+	return *memory.Swap - *memory.Limit, true
+}
+
+// cpuSharesToWeight converts cgroup v1 CPU shares from 2 to 262144 to a cgroup v2 CPU weight
+// from 1 to 10000, in the same way as runc.
+func cpuSharesToWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// blkioWeightToIOWeight converts a cgroup v1 blkio weight from 10 to 1000 to a cgroup v2 IO
+// weight from 1 to 10000.
+func blkioWeightToIOWeight(weight uint16) uint64 {
+	return 1 + (uint64(weight)-10)*9999/990
+}
+
+// freezeCgroup freezes or thaws the cgroup at `path` with cgroup.freeze.
+func freezeCgroup(ctx context.Context, path string, frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	if err := os.WriteFile(filepath.Join(path, "cgroup.freeze"), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write cgroup.freeze (the freezer needs cgroup v2): %w", err)
+	}
+	return waitForFreeze(ctx, path, frozen)
+}
+
+// waitForFreeze blocks until cgroup.events of the cgroup at `path` reports it as `frozen`. A
+// cgroup is only frozen once every process in it has stopped.
+func waitForFreeze(ctx context.Context, path string, frozen bool) error {
+	want := uint64(0)
+	if frozen {
+		want = 1
+	}
+	ctx, cancel := context.WithTimeout(ctx, freezeTimeout)
+	defer cancel()
+	for {
+		events, err := readCgroupKeyValues(path, "cgroup.events")
+		if err != nil {
+			return fmt.Errorf("failed to read cgroup.events: %w", err)
+		}
+		if events["frozen"] == want {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for cgroup %s to be frozen=%d: %w", path, want, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// cgroupLimit formats `limit` for a cgroup interface file, where a limit which isn't positive
+// means no limit.
+func cgroupLimit(limit int64) string {
+	if limit <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// cgroupAmount formats `amount` like cgroupLimit, for the interface files where 0 is an amount of
+// its own, such as no swap at all. Only a negative amount means no limit.
+func cgroupAmount(amount int64) string {
+	if amount < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(amount, 10)
+}
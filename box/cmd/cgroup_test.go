@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCgroupResources(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources specs.LinuxResources
+		files     []cgroupFile
+		// properties are the systemd unit properties, by name
+		properties map[string]any
+	}{
+		{
+			name:       "cpu quota",
+			resources:  specs.LinuxResources{CPU: &specs.LinuxCPU{Quota: ptr(int64(50000))}},
+			files:      []cgroupFile{{"cpu.max", "50000 100000"}},
+			properties: map[string]any{"CPUQuotaPerSecUSec": uint64(500000), "CPUQuotaPeriodUSec": uint64(100000)},
+		},
+		{
+			name:       "cpu period only",
+			resources:  specs.LinuxResources{CPU: &specs.LinuxCPU{Period: ptr(uint64(50000))}},
+			files:      []cgroupFile{{"cpu.max", "max 50000"}},
+			properties: map[string]any{"CPUQuotaPerSecUSec": uint64(math.MaxUint64), "CPUQuotaPeriodUSec": uint64(50000)},
+		},
+		{
+			name:       "unlimited cpu quota",
+			resources:  specs.LinuxResources{CPU: &specs.LinuxCPU{Quota: ptr(int64(-1)), Period: ptr(uint64(200000))}},
+			files:      []cgroupFile{{"cpu.max", "max 200000"}},
+			properties: map[string]any{"CPUQuotaPerSecUSec": uint64(math.MaxUint64), "CPUQuotaPeriodUSec": uint64(200000)},
+		},
+		{
+			name:       "memory limit without swap",
+			resources:  specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: ptr(int64(100)), Swap: ptr(int64(100))}},
+			files:      []cgroupFile{{"memory.max", "100"}, {"memory.swap.max", "0"}},
+			properties: map[string]any{"MemoryMax": uint64(100), "MemorySwapMax": uint64(0)},
+		},
+		{
+			name:       "memory limit with swap",
+			resources:  specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: ptr(int64(100)), Swap: ptr(int64(300))}},
+			files:      []cgroupFile{{"memory.max", "100"}, {"memory.swap.max", "200"}},
+			properties: map[string]any{"MemoryMax": uint64(100), "MemorySwapMax": uint64(200)},
+		},
+		{
+			name:       "unlimited memory and swap",
+			resources:  specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: ptr(int64(-1)), Swap: ptr(int64(-1))}},
+			files:      []cgroupFile{{"memory.max", "max"}, {"memory.swap.max", "max"}},
+			properties: map[string]any{"MemoryMax": uint64(math.MaxUint64), "MemorySwapMax": uint64(math.MaxUint64)},
+		},
+		{
+			name:       "no memory reservation",
+			resources:  specs.LinuxResources{Memory: &specs.LinuxMemory{Reservation: ptr(int64(0))}},
+			files:      []cgroupFile{{"memory.low", "0"}},
+			properties: map[string]any{"MemoryLow": uint64(0)},
+		},
+		{
+			name:       "memory reservation",
+			resources:  specs.LinuxResources{Memory: &specs.LinuxMemory{Reservation: ptr(int64(50))}},
+			files:      []cgroupFile{{"memory.low", "50"}},
+			properties: map[string]any{"MemoryLow": uint64(50)},
+		},
+		{
+			name:       "cpuset",
+			resources:  specs.LinuxResources{CPU: &specs.LinuxCPU{Cpus: "0-2,9", Mems: "1"}},
+			files:      []cgroupFile{{"cpuset.cpus", "0-2,9"}, {"cpuset.mems", "1"}},
+			properties: map[string]any{"AllowedCPUs": []byte{0b111, 0b10}, "AllowedMemoryNodes": []byte{0b10}},
+		},
+		{
+			name: "io throttles",
+			resources: specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{
+				ThrottleReadBpsDevice:   []specs.LinuxThrottleDevice{{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 8, Minor: 0}, Rate: 1048576}},
+				ThrottleWriteIOPSDevice: []specs.LinuxThrottleDevice{{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 8, Minor: 16}, Rate: 0}},
+			}},
+			files: []cgroupFile{{"io.max", "8:0 rbps=1048576"}, {"io.max", "8:16 wiops=max"}},
+			properties: map[string]any{
+				"IOReadBandwidthMax": []systemdIODevice{{"/dev/block/8:0", 1048576}},
+				"IOWriteIOPSMax":     []systemdIODevice{{"/dev/block/8:16", math.MaxUint64}},
+			},
+		},
+		{
+			name:       "unlimited pids",
+			resources:  specs.LinuxResources{Pids: &specs.LinuxPids{Limit: ptr(int64(0))}},
+			files:      []cgroupFile{{"pids.max", "max"}},
+			properties: map[string]any{"TasksMax": uint64(math.MaxUint64)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := cgroupFiles(&test.resources)
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("got files %v, want %v", files, test.files)
+			}
+
+			properties := map[string]any{}
+			for _, property := range systemdProperties(&test.resources) {
+				properties[property.Name] = property.Value.Value()
+			}
+			if !reflect.DeepEqual(properties, test.properties) {
+				t.Errorf("got properties %v, want %v", properties, test.properties)
+			}
+
+			// every file is left to systemd, none are written to the cgroup directly
+			if len(slices.DeleteFunc(files, handledBySystemd)) != 0 {
+				t.Errorf("files %v are not set under systemd", files)
+			}
+		})
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
@@ -6,13 +6,11 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"slices"
-	"strings"
 	"syscall"
 
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/spf13/cobra"
 	"github.com/vishvananda/netlink"
-	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
 const (
@@ -20,6 +18,26 @@ const (
 	resolvConf   = "/etc/resolv.conf"
 )
 
+var (
+	overlayLower string
+	overlayUpper string
+	overlayWork  string
+	containerIP  string
+	gatewayIP    string
+	configPath   string
+	childInit    bool
+)
+
+func init() {
+	childCmd.Flags().StringVar(&overlayLower, "lowerdir", "", "overlay lower dirs for the rootfs")
+	childCmd.Flags().StringVar(&overlayUpper, "upperdir", "", "overlay upper dir for the rootfs")
+	childCmd.Flags().StringVar(&overlayWork, "workdir", "", "overlay work dir for the rootfs")
+	childCmd.Flags().StringVar(&containerIP, "ip", "", "address of the container veth in CIDR notation")
+	childCmd.Flags().StringVar(&gatewayIP, "gateway", "", "address of the bridge")
+	childCmd.Flags().StringVar(&configPath, "config", "", "runtime config to use instead of the bundle config")
+	childCmd.Flags().BoolVar(&childInit, "init", false, "stay as PID 1 of the container, running the container process as a child")
+}
+
 var childCmd = &cobra.Command{
 	Use:    "child runtime-bundle-path",
 	Hidden: true,
@@ -34,6 +52,11 @@ var childCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		if configPath != "" {
+			if config, err = ReadConfig(configPath); err != nil {
+				return err
+			}
+		}
 
 		// avoid incorrect permissions
 		syscall.Umask(0)
@@ -44,10 +67,19 @@ var childCmd = &cobra.Command{
 			return fmt.Errorf("failed to make mount tree private: %w", err)
 		}
 
-		// 2. bind mount the rootfs to itself as we need a mount for pivot_root
-		log.Info("creating bind mount for rootfs", "rootfsPath", rootfsPath)
-		if err := syscall.Mount(rootfsPath, rootfsPath, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
-			return fmt.Errorf("failed to create bind mount for rootfs: %w", err)
+		// 2. bind mount the rootfs to itself as we need a mount for pivot_root, or mount an overlay
+		//    of the image layers on top of it when the container has its own writable layer
+		if overlayLower != "" {
+			log.Info("creating overlay mount for rootfs", "rootfsPath", rootfsPath, "upperdir", overlayUpper)
+			data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", overlayLower, overlayUpper, overlayWork)
+			if err := syscall.Mount("overlay", rootfsPath, "overlay", 0, data); err != nil {
+				return fmt.Errorf("failed to create overlay mount for rootfs: %w", err)
+			}
+		} else {
+			log.Info("creating bind mount for rootfs", "rootfsPath", rootfsPath)
+			if err := syscall.Mount(rootfsPath, rootfsPath, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+				return fmt.Errorf("failed to create bind mount for rootfs: %w", err)
+			}
 		}
 
 		// 3. bind mount host /etc/resolv.conf as readonly for DNS before pivot_root
@@ -61,31 +93,30 @@ var childCmd = &cobra.Command{
 		if err := syscall.Mount(resolvConf, containerResolvPath, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 			return err
 		}
-		if err := syscall.Mount(resolvConf, containerResolvPath, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
-			return fmt.Errorf("failed to bind mount path as readonly %s: %w", resolvConf, err)
-		}
-
-		// 3. pivot_root, we use this trick from the man page to pivot without a needing temporary
-		//    directory to hold the old root
-		log.Info("applying pivot root to rootfs")
-		if err := syscall.Chdir(rootfsPath); err != nil {
-			return err
-		}
-		if err := syscall.PivotRoot(".", "."); err != nil {
-			return fmt.Errorf("failed to pivot root: %w", err)
-		}
-		if err := syscall.Chdir("/"); err != nil {
+		if err := RemountReadonly(containerResolvPath); err != nil {
 			return err
 		}
-		if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
-			return fmt.Errorf("failed to unmount old rootfs: %w", err)
-		}
 
-		// 4. create mounts from the OCI config
+		// 4. create mounts from the OCI config inside the rootfs, while bind mount sources on the
+		//    host can still be seen
 		log.Info("creating mounts from OCI config")
 		for _, m := range config.Mounts {
-			// ensure mount directory exists
-			if err := os.MkdirAll(m.Destination, 0755); err != nil {
+			destination, err := SecureJoin(rootfsPath, m.Destination)
+			if err != nil {
+				return fmt.Errorf("failed to resolve mount destination %s: %w", m.Destination, err)
+			}
+
+			// ensure mount point exists, a file is bind mounted onto a file
+			if info, err := os.Stat(m.Source); err == nil && !info.IsDir() && m.Type == "bind" {
+				if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+					return fmt.Errorf("failed to create mount directory at %s: %w", m.Destination, err)
+				}
+				f, err := os.OpenFile(destination, os.O_RDONLY|os.O_CREATE, 0644)
+				if err != nil {
+					return fmt.Errorf("failed to create mount point at %s: %w", m.Destination, err)
+				}
+				f.Close()
+			} else if err := os.MkdirAll(destination, 0755); err != nil {
 				return fmt.Errorf("failed to create mount directory at %s: %w", m.Destination, err)
 			}
 
@@ -94,42 +125,59 @@ var childCmd = &cobra.Command{
 				m.Type = "cgroup2"
 			}
 
-			// mount
-			flags, data, err := ParseMountFlagsAndDataFromOptions(m.Options)
-			if err != nil {
-				return fmt.Errorf("failed to parse mount options for %s: %w", m.Destination, err)
-			}
-			if err := syscall.Mount(m.Source, m.Destination, m.Type, flags, data); err != nil {
+			// mount, propagation changes and readonly bind mounts need more than one mount call
+			if err := MountWithOptions(m.Source, destination, m.Type, m.Options); err != nil {
 				return fmt.Errorf("failed to mount %s: %w", m.Destination, err)
 			}
 		}
 
-		// 5. create default devices
-		log.Info("creating default devices (null, zero, random, etc)")
-		if err := CreateSpecialDevice("/dev/null", Null); err != nil {
-			return err
+		// 5. create the default devices and those from the OCI config, a user namespace can't
+		//    create device nodes so the host devices are bind mounted instead
+		log.Info("creating devices (null, zero, random, etc)")
+		userNamespace := HasNamespace(config.Linux.Namespaces, specs.UserNamespace)
+		for _, device := range containerDevices(config) {
+			if err := CreateDevice(rootfsPath, device, userNamespace); err != nil {
+				return err
+			}
 		}
-		if err := CreateSpecialDevice("/dev/zero", Zero); err != nil {
+		ptmxPath := filepath.Join(rootfsPath, "/dev/ptmx")
+		if userNamespace {
+			// the host ptmx would open ptys on the host devpts
+			if err := os.Symlink("pts/ptmx", ptmxPath); err != nil {
+				return fmt.Errorf("failed to create /dev/ptmx: %w", err)
+			}
+		} else if err := CreateDevice(rootfsPath, charDevice("/dev/ptmx", 5, 2), false); err != nil {
 			return err
 		}
-		if err := CreateSpecialDevice("/dev/full", Full); err != nil {
-			return err
+		// the pty from the parent is our stdio, bind it over /dev/console
+		if config.Process.Terminal {
+			log.Info("setting up /dev/console")
+			consolePath := filepath.Join(rootfsPath, "/dev/console")
+			if err := os.WriteFile(consolePath, []byte{}, 0666); err != nil {
+				return fmt.Errorf("failed to create /dev/console: %w", err)
+			}
+			if err := syscall.Mount("/proc/self/fd/0", consolePath, "", syscall.MS_BIND, ""); err != nil {
+				return fmt.Errorf("failed to bind mount pty to /dev/console: %w", err)
+			}
 		}
-		if err := CreateSpecialDevice("/dev/random", Random); err != nil {
+
+		// 6. pivot_root, we use this trick from the man page to pivot without a needing temporary
+		//    directory to hold the old root
+		log.Info("applying pivot root to rootfs")
+		if err := syscall.Chdir(rootfsPath); err != nil {
 			return err
 		}
-		if err := CreateSpecialDevice("/dev/urandom", URandom); err != nil {
-			return err
+		if err := syscall.PivotRoot(".", "."); err != nil {
+			return fmt.Errorf("failed to pivot root: %w", err)
 		}
-		if err := CreateSpecialDevice("/dev/tty", TTY); err != nil {
+		if err := syscall.Chdir("/"); err != nil {
 			return err
 		}
-		if err := CreateSpecialDevice("/dev/ptmx", Ptmx); err != nil {
-			return err
+		if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount old rootfs: %w", err)
 		}
-		// TODO: /dev/console if `terminal: true` in OCI config
 
-		// 6. enforce ownership and mode of some important paths
+		// 7. enforce ownership and mode of some important paths
 		syscall.Chown("/", 0, 0)
 		syscall.Chmod("/", 0755)
 		syscall.Chown("/tmp", 0, 0)
@@ -141,7 +189,7 @@ var childCmd = &cobra.Command{
 		syscall.Chown("/dev", 0, 0)
 		syscall.Chmod("/dev", 0755)
 
-		// 7. masked paths
+		// 8. masked paths
 		// This probably isn't very secure as the empty directory exists inside the rootfs of the container.
 		// Normally we would do this _before_ pivot root and use some working directory on the host for each
 		// container but I didn't want to do that.
@@ -157,116 +205,77 @@ var childCmd = &cobra.Command{
 			return fmt.Errorf("failed to mask paths from config: %w", err)
 		}
 
-		// 8. read only paths
+		// 9. read only paths
 		for _, roPath := range config.Linux.ReadonlyPaths {
 			if err := syscall.Mount(roPath, roPath, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 				return err
 			}
-			if err := syscall.Mount(roPath, roPath, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
-				return fmt.Errorf("failed to bind mount path as readonly %s: %w", roPath, err)
+			if err := RemountReadonly(roPath); err != nil {
+				return err
 			}
 		}
 
-		// 9. hostname
+		// 10. hostname
 		if config.Hostname != "" {
 			log.Info("setting hostname", "hostname", config.Hostname)
 			syscall.Sethostname([]byte(config.Hostname))
 		}
 
-		// 10. wait for parent to setup networking + cgroups (block on pipe)
+		// 11. wait for parent to setup networking + cgroups (block on pipe)
 		pipe := os.NewFile(parentPipeFD, "pipe")
 		buf := make([]byte, 1)
 		pipe.Read(buf)
 
-		// 11. configure container veth interface now that it has been placed
-		//     inside the container namespace by the parent
-		// find it
-		containerVethLink, err := netlink.LinkByName(ContainerVethName)
-		if err != nil {
-			return fmt.Errorf("failed to find container veth interface: %w", err)
-		}
-		// give IP
-		addr := &netlink.Addr{
-			IPNet: &net.IPNet{
-				IP:   net.ParseIP(ContainerIP),
-				Mask: net.CIDRMask(BridgePrefix, 32),
-			},
-		}
-		if err := netlink.AddrAdd(containerVethLink, addr); err != nil {
-			return fmt.Errorf("failed to add IP address to container veth %s: %w", ContainerIP, err)
-		}
-		// bring UP
-		if err := netlink.LinkSetUp(containerVethLink); err != nil {
-			return fmt.Errorf("failed to set container veth UP: %w", err)
-		}
-		// add default route to bridge
-		route := &netlink.Route{
-			LinkIndex: containerVethLink.Attrs().Index,
-			Gw:        net.ParseIP(BridgeIP),
-			Dst:       nil, // default route (0.0.0.0/0)
-		}
-		if err := netlink.RouteAdd(route); err != nil {
-			return fmt.Errorf("failed to add default route to bridge: %w", err)
-		}
-
-		// 12. drop privileges
-		// https://sites.google.com/site/fullycapable/Home?authuser=0
-		// the capabilities APIs are strange:
-		//  - ambient and bounding controlled through prctl
-		//  - bounding can only be dropped
-		//  - effective, permitted, inheritable controlled through capset
-		log.Info("dropping privileges / capabilities")
-
-		// 12.1 ambient
-		ambientValues, err := ParseCapabilities(config.Process.Capabilities.Ambient)
-		if err != nil {
-			return fmt.Errorf("failed to parse ambient capabilities from config: %w", err)
-		}
-		cap.ResetAmbient()
-		for _, capability := range ambientValues {
-			cap.SetAmbient(true, capability)
-		}
-
-		// 12.2 bounding
-		boundingValues, err := ParseCapabilities(config.Process.Capabilities.Bounding)
-		for c := cap.Value(0); c < cap.NamedCount; c++ {
-			v, err := cap.GetBound(c)
+		// 12. configure container veth interface now that it has been placed
+		//     inside the container namespace by the parent. Rootless containers have no veth, only
+		//     the loopback interface and the tap device of slirp4netns if it is installed
+		if containerIP == "" {
+			lo, err := netlink.LinkByName("lo")
+			if err != nil {
+				return fmt.Errorf("failed to find loopback interface: %w", err)
+			}
+			if err := netlink.LinkSetUp(lo); err != nil {
+				return fmt.Errorf("failed to set loopback interface UP: %w", err)
+			}
+		} else {
+			// find it
+			containerVethLink, err := netlink.LinkByName(ContainerVethName)
+			if err != nil {
+				return fmt.Errorf("failed to find container veth interface: %w", err)
+			}
+			// give IP
+			addr, err := netlink.ParseAddr(containerIP)
 			if err != nil {
-				return fmt.Errorf("failed to get bounding capabiliy %s: %w", c.String(), err)
+				return fmt.Errorf("invalid container IP address %s: %w", containerIP, err)
+			}
+			if err := netlink.AddrAdd(containerVethLink, addr); err != nil {
+				return fmt.Errorf("failed to add IP address to container veth %s: %w", containerIP, err)
+			}
+			// bring UP
+			if err := netlink.LinkSetUp(containerVethLink); err != nil {
+				return fmt.Errorf("failed to set container veth UP: %w", err)
+			}
+			// add default route to bridge
+			route := &netlink.Route{
+				LinkIndex: containerVethLink.Attrs().Index,
+				Gw:        net.ParseIP(gatewayIP),
+				Dst:       nil, // default route (0.0.0.0/0)
 			}
-			if v && !slices.Contains(boundingValues, c) {
-				cap.DropBound(c)
+			if err := netlink.RouteAdd(route); err != nil {
+				return fmt.Errorf("failed to add default route to bridge: %w", err)
 			}
 		}
 
-		// 12.3 effective, permitted, inheritable
-		set := cap.NewSet()
-		effectiveValues, err := ParseCapabilities(config.Process.Capabilities.Effective)
-		if err != nil {
-			return fmt.Errorf("failed to parse effective capabilities from config: %w", err)
-		}
-		for _, capability := range effectiveValues {
-			set.SetFlag(cap.Effective, true, capability)
-		}
-		permittedValues, err := ParseCapabilities(config.Process.Capabilities.Permitted)
-		if err != nil {
-			return fmt.Errorf("failed to parse permitted capabilities from config: %w", err)
-		}
-		for _, capability := range permittedValues {
-			set.SetFlag(cap.Permitted, true, capability)
-		}
-		inheritableValues, err := ParseCapabilities(config.Process.Capabilities.Inheritable)
-		if err != nil {
-			return fmt.Errorf("failed to parse inheritable capabilities from config: %w", err)
-		}
-		for _, capability := range inheritableValues {
-			set.SetFlag(cap.Inheritable, true, capability)
+		// 13. drop privileges, rlimits first as raising them needs CAP_SYS_RESOURCE
+		log.Info("dropping privileges / capabilities")
+		if err := SetRlimits(config.Process.Rlimits); err != nil {
+			return err
 		}
-		if err := set.SetProc(); err != nil {
-			return fmt.Errorf("failed to set effective/permitted/inheritable capabilities of the process: %w", err)
+		if err := ApplySecurity(ctx, config.Process, config.Linux.Seccomp); err != nil {
+			return err
 		}
 
-		// 13. execve the container process
+		// 14. execve the container process, or with --init run it as a child of this process
 		log.Info("executing container process")
 		if config.Process.Cwd != "" {
 			if err := syscall.Chdir(config.Process.Cwd); err != nil {
@@ -276,16 +285,12 @@ var childCmd = &cobra.Command{
 		if len(config.Process.Args) <= 0 {
 			return errors.New("no process provided by OCI config")
 		}
-		// if env provides PATH try to resolve the executable, otherwise pass it directly
-		executable := config.Process.Args[0]
-		for _, envVar := range config.Process.Env {
-			split := strings.Split(envVar, "=")
-			if split[0] == "PATH" {
-				executable, err = FindExecutable(executable, split[1])
-				if err != nil {
-					return fmt.Errorf("failed to find executable from config in rootfs: %w", err)
-				}
-			}
+		executable, err := ResolveExecutable(config.Process.Args[0], config.Process.Env)
+		if err != nil {
+			return fmt.Errorf("failed to find executable from config in rootfs: %w", err)
+		}
+		if childInit {
+			return runInit(executable, config.Process)
 		}
 		if err := syscall.Exec(executable, config.Process.Args, config.Process.Env); err != nil {
 			return fmt.Errorf("failed to execute container process: %w", err)
@@ -0,0 +1,351 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// The runtime config a container is started with is the bundle config with the `box run` options
+// applied on top. It is written to <root>/containers/<id>/config.json for the child and exec to
+// read, leaving the bundle untouched.
+
+// buildConfig returns the runtime config for `container`.
+func buildConfig(ctx context.Context, container *Container) (*specs.Spec, error) {
+	config, rootfsPath, err := GetConfigAndRootFromRuntimePath(container.Bundle)
+	if err != nil {
+		return nil, err
+	}
+	opts := container.Options
+	// a bundle whose image is no longer in the store can still run without overrides
+	var imageConfig *v1.ConfigFile
+	var imageConfigErr error
+	if _, ok := config.Annotations[imageDigestAnnotation]; ok {
+		imageConfig, imageConfigErr = bundleImageConfig(config)
+	}
+
+	// process args
+	if opts.Entrypoint != nil || len(opts.Command) > 0 {
+		// without an image the bundle args are treated as the command
+		entrypoint, command := []string(nil), config.Process.Args
+		if imageConfigErr != nil {
+			return nil, imageConfigErr
+		}
+		if imageConfig != nil {
+			entrypoint, command = imageConfig.Config.Entrypoint, imageConfig.Config.Cmd
+		}
+		config.Process.Args = MergeArgs(entrypoint, command, opts.Entrypoint, opts.Command)
+	}
+	if len(config.Process.Args) == 0 {
+		return nil, errors.New("no command to run, the image has no entrypoint or command and none was given")
+	}
+
+	// mounts, replacing any at the same destination. The image volumes which nothing else is
+	// mounted at get an anonymous volume
+	requests := slices.Clone(opts.Mounts)
+	if imageConfig != nil {
+		for _, destination := range slices.Sorted(maps.Keys(imageConfig.Config.Volumes)) {
+			if !slices.ContainsFunc(requests, func(r MountRequest) bool {
+				return filepath.Clean(r.Destination) == filepath.Clean(destination)
+			}) {
+				requests = append(requests, MountRequest{Type: "volume", Destination: destination, Options: []string{"rbind"}})
+			}
+		}
+	}
+	// parents are mounted before the mounts inside them
+	slices.SortStableFunc(requests, func(a, b MountRequest) int {
+		return strings.Count(filepath.Clean(a.Destination), "/") - strings.Count(filepath.Clean(b.Destination), "/")
+	})
+	for _, request := range requests {
+		m, err := resolveMount(ctx, request, container.ID, rootfsPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Mounts = slices.DeleteFunc(config.Mounts, func(existing specs.Mount) bool {
+			return filepath.Clean(existing.Destination) == filepath.Clean(m.Destination)
+		})
+		config.Mounts = append(config.Mounts, m)
+	}
+
+	// rlimits, replacing any of the same type
+	for _, ulimit := range opts.Ulimits {
+		rlimit, err := ParseUlimit(ulimit)
+		if err != nil {
+			return nil, err
+		}
+		config.Process.Rlimits = slices.DeleteFunc(config.Process.Rlimits, func(r specs.POSIXRlimit) bool {
+			return r.Type == rlimit.Type
+		})
+		config.Process.Rlimits = append(config.Process.Rlimits, rlimit)
+	}
+
+	// capabilities, keeping the default seccomp profile in line with them as Docker does
+	if config.Process.Capabilities == nil {
+		config.Process.Capabilities = &specs.LinuxCapabilities{}
+	}
+	capabilities := config.Process.Capabilities
+	defaultSeccomp := isDefaultSeccompProfile(config.Linux.Seccomp, capabilities.Bounding)
+	if opts.Privileged {
+		all := AllCapabilities()
+		capabilities.Bounding, capabilities.Effective, capabilities.Permitted = all, all, all
+		config.Linux.Seccomp = nil
+		config.Linux.MaskedPaths = nil
+		config.Linux.ReadonlyPaths = nil
+	} else if len(opts.CapAdd) > 0 || len(opts.CapDrop) > 0 {
+		capabilities.Bounding = applyCapabilityChanges(capabilities.Bounding, opts.CapAdd, opts.CapDrop)
+		capabilities.Effective = applyCapabilityChanges(capabilities.Effective, opts.CapAdd, opts.CapDrop)
+		capabilities.Permitted = applyCapabilityChanges(capabilities.Permitted, opts.CapAdd, opts.CapDrop)
+		capabilities.Inheritable = applyCapabilityChanges(capabilities.Inheritable, nil, opts.CapDrop)
+		capabilities.Ambient = applyCapabilityChanges(capabilities.Ambient, nil, opts.CapDrop)
+		if defaultSeccomp {
+			config.Linux.Seccomp = DefaultSeccompProfile(capabilities.Bounding)
+		}
+	}
+
+	// the signal which stops the container, which pull copies from the image config
+	if signal, ok := config.Annotations[stopSignalAnnotation]; ok {
+		if _, err := ParseSignal(signal); err != nil {
+			return nil, fmt.Errorf("invalid stop signal: %w", err)
+		}
+	}
+
+	// resource limits, the `box run` flags replacing those in the bundle config
+	if config.Linux.Resources == nil {
+		config.Linux.Resources = &specs.LinuxResources{}
+	}
+	resources := config.Linux.Resources
+	if err := opts.ApplyTo(resources); err != nil {
+		return nil, err
+	}
+	manager := opts.CgroupManager
+	if manager == "" {
+		manager = detectCgroupManager()
+	}
+	if err := validateResources(resources, manager); err != nil {
+		return nil, err
+	}
+
+	// devices, the default devices are always allowed after the device cgroup rules of the
+	// bundle, then the devices of the bundle and the `--device` devices. A privileged container
+	// may use any device
+	resources.Devices = append(resources.Devices, defaultDeviceRules...)
+	var flagDevices []specs.LinuxDevice
+	var flagRules []specs.LinuxDeviceCgroup
+	for _, flag := range opts.Devices {
+		device, rule, err := ParseDevice(flag)
+		if err != nil {
+			return nil, err
+		}
+		flagDevices = append(flagDevices, device)
+		flagRules = append(flagRules, rule)
+		// a user namespace can't create device nodes, so a rootless container bind mounts it
+		if Rootless() {
+			hostPath, _, _ := strings.Cut(flag, ":")
+			config.Mounts = append(config.Mounts, specs.Mount{Destination: device.Path, Type: "bind", Source: hostPath, Options: []string{"bind"}})
+			continue
+		}
+		config.Linux.Devices = slices.DeleteFunc(config.Linux.Devices, func(d specs.LinuxDevice) bool {
+			return filepath.Clean(d.Path) == filepath.Clean(device.Path)
+		})
+		config.Linux.Devices = append(config.Linux.Devices, device)
+	}
+	for _, d := range config.Linux.Devices {
+		// a `--device` for the same path has its own permissions
+		replaced := slices.ContainsFunc(flagDevices, func(device specs.LinuxDevice) bool {
+			return filepath.Clean(d.Path) == filepath.Clean(device.Path)
+		})
+		if replaced || d.Type == "p" {
+			continue
+		}
+		deviceType := d.Type
+		if deviceType == "u" {
+			deviceType = "c"
+		}
+		resources.Devices = append(resources.Devices, deviceRule(deviceType, d.Major, d.Minor, "rwm"))
+	}
+	resources.Devices = append(resources.Devices, flagRules...)
+	if opts.Privileged {
+		resources.Devices = append(resources.Devices, specs.LinuxDeviceCgroup{Allow: true, Access: "rwm"})
+	}
+
+	// rootless containers run in a user namespace
+	if Rootless() {
+		if err := rootlessConfig(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+
+	// security options
+	for _, opt := range opts.SecurityOpts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "seccomp":
+			seccomp, err := readSeccompProfile(value)
+			if err != nil {
+				return nil, err
+			}
+			config.Linux.Seccomp = seccomp
+		default:
+			return nil, fmt.Errorf("unsupported security option %s", opt)
+		}
+	}
+	if config.Linux.Seccomp != nil {
+		if _, err := CompileSeccomp(config.Linux.Seccomp); err != nil {
+			return nil, fmt.Errorf("invalid seccomp profile: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// MergeArgs returns the process args for an image `entrypoint` and `command` in the same way as
+// Docker. Overriding the entrypoint discards the image command, and an empty entrypoint override
+// removes the entrypoint. A `commandOverride` replaces the image command.
+func MergeArgs(entrypoint []string, command []string, entrypointOverride *string, commandOverride []string) []string {
+	if entrypointOverride != nil {
+		entrypoint = nil
+		if *entrypointOverride != "" {
+			entrypoint = []string{*entrypointOverride}
+		}
+		command = nil
+	}
+	if len(commandOverride) > 0 {
+		command = commandOverride
+	}
+	return append(append([]string{}, entrypoint...), command...)
+}
+
+// applyCapabilityChanges returns `capabilities` with the `--cap-drop` and `--cap-add` flags
+// applied. Names may leave out the `CAP_` prefix and be in any case. Dropping ALL starts from no
+// capabilities and adding ALL starts from every capability, before the other changes.
+func applyCapabilityChanges(capabilities []string, add []string, drop []string) []string {
+	add, drop = normalizeCapabilities(add), normalizeCapabilities(drop)
+	result := slices.Clone(capabilities)
+	if slices.Contains(drop, "ALL") {
+		result = nil
+	}
+	if slices.Contains(add, "ALL") {
+		result = AllCapabilities()
+	}
+	result = slices.DeleteFunc(result, func(c string) bool {
+		return slices.Contains(drop, c)
+	})
+	for _, c := range add {
+		if c != "ALL" && !slices.Contains(result, c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func normalizeCapabilities(capabilities []string) []string {
+	var normalized []string
+	for _, c := range capabilities {
+		c = strings.ToUpper(c)
+		if c != "ALL" && !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		normalized = append(normalized, c)
+	}
+	return normalized
+}
+
+// isDefaultSeccompProfile returns whether `seccomp` is the default profile for a container with
+// the bounding set `capabilities`, as written by `box pull`.
+func isDefaultSeccompProfile(seccomp *specs.LinuxSeccomp, capabilities []string) bool {
+	if seccomp == nil {
+		return false
+	}
+	a, errA := json.Marshal(seccomp)
+	b, errB := json.Marshal(DefaultSeccompProfile(capabilities))
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// readSeccompProfile reads the profile for `--security-opt seccomp=<profile>`, which is either
+// `unconfined` for no profile or the path to a JSON file in the format of linux.seccomp.
+func readSeccompProfile(profile string) (*specs.LinuxSeccomp, error) {
+	if profile == "unconfined" {
+		return nil, nil
+	}
+	if profile == "" {
+		return nil, errors.New("seccomp security option needs a profile, e.g. seccomp=unconfined")
+	}
+	data, err := os.ReadFile(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %w", err)
+	}
+	seccomp := &specs.LinuxSeccomp{}
+	if err := json.Unmarshal(data, seccomp); err != nil {
+		return nil, fmt.Errorf("failed to decode seccomp profile %s: %w", profile, err)
+	}
+	return seccomp, nil
+}
+
+// bundleImage returns the image in the store that the bundle with `config` was created from.
+func bundleImage(config *specs.Spec) (v1.Image, error) {
+	imageDigest, ok := config.Annotations[imageDigestAnnotation]
+	if !ok {
+		return nil, errors.New("bundle was not created from the image store")
+	}
+	store, err := OpenStore(stateRoot)
+	if err != nil {
+		return nil, err
+	}
+	return store.Image(imageDigest)
+}
+
+func bundleImageConfig(config *specs.Spec) (*v1.ConfigFile, error) {
+	image, err := bundleImage(config)
+	if err != nil {
+		return nil, err
+	}
+	imageConfig, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image config: %w", err)
+	}
+	return imageConfig, nil
+}
+
+// stopSignal returns the signal which asks the container with `config` to stop, SIGTERM unless
+// its image has a different one.
+func stopSignal(config *specs.Spec) syscall.Signal {
+	if signal, err := ParseSignal(config.Annotations[stopSignalAnnotation]); err == nil {
+		return signal
+	}
+	return syscall.SIGTERM
+}
+
+// writeConfig saves the runtime config of `container`, returning its path.
+func writeConfig(container *Container, config *specs.Spec) (string, error) {
+	path := filepath.Join(containerPath(container.ID), configFile)
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write container config: %w", err)
+	}
+	return path, nil
+}
+
+// Config returns the runtime config the container was last started with, or the bundle config if
+// it has never been started.
+func (c *Container) Config() (*specs.Spec, error) {
+	path := filepath.Join(containerPath(c.ID), configFile)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		config, _, err := GetConfigAndRootFromRuntimePath(c.Bundle)
+		return config, err
+	}
+	return ReadConfig(path)
+}
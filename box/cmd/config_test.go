@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestBuildConfigDevices(t *testing.T) {
+	if Rootless() {
+		t.Skip("rootless containers have no device cgroup")
+	}
+
+	bundle := t.TempDir()
+	config := &specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{Args: []string{"/bin/sh"}, Cwd: "/"},
+		Root:    &specs.Root{Path: rootfsFolder},
+		Linux: &specs.Linux{
+			Devices: []specs.LinuxDevice{
+				{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229},
+				{Path: "/dev/sda", Type: "b", Major: 8, Minor: 0},
+				{Path: "/dev/kmsg", Type: "c", Major: 1, Minor: 11},
+				{Path: "/dev/pipe", Type: "p"},
+			},
+			Resources: &specs.LinuxResources{
+				Devices: []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}},
+			},
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bundle, configFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options RunOptions
+		want    []specs.LinuxDeviceCgroup
+	}{
+		{
+			name: "bundle devices",
+			want: []specs.LinuxDeviceCgroup{
+				deviceRule("c", 10, 229, "rwm"),
+				deviceRule("b", 8, 0, "rwm"),
+				deviceRule("c", 1, 11, "rwm"),
+			},
+		},
+		{
+			name:    "bundle device replaced by a flag",
+			options: RunOptions{Devices: []string{"/dev/null:/dev/kmsg:r"}},
+			want: []specs.LinuxDeviceCgroup{
+				deviceRule("c", 10, 229, "rwm"),
+				deviceRule("b", 8, 0, "rwm"),
+				deviceRule("c", 1, 3, "r"),
+			},
+		},
+		{
+			name:    "privileged",
+			options: RunOptions{Privileged: true},
+			want: []specs.LinuxDeviceCgroup{
+				deviceRule("c", 10, 229, "rwm"),
+				deviceRule("b", 8, 0, "rwm"),
+				deviceRule("c", 1, 11, "rwm"),
+				{Allow: true, Access: "rwm"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the flag defaults which leave the bundle limits in place
+			test.options.CPUs, test.options.MemoryMiB = -1, -1
+			spec, err := buildConfig(t.Context(), &Container{State: specs.State{Bundle: bundle}, Options: test.options})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}}, defaultDeviceRules...)
+			want = append(want, test.want...)
+			if got := spec.Linux.Resources.Devices; !reflect.DeepEqual(got, want) {
+				t.Errorf("got device rules %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeArgs(t *testing.T) {
+	tests := []struct {
+		name               string
+		entrypoint         []string
+		command            []string
+		entrypointOverride *string
+		commandOverride    []string
+		want               []string
+	}{
+		{name: "entrypoint and command", entrypoint: []string{"/bin/sh", "-c"}, command: []string{"echo hi"}, want: []string{"/bin/sh", "-c", "echo hi"}},
+		{name: "entrypoint only", entrypoint: []string{"/entrypoint.sh"}, want: []string{"/entrypoint.sh"}},
+		{name: "command only", command: []string{"/bin/sh"}, want: []string{"/bin/sh"}},
+		{name: "neither", want: []string{}},
+		{
+			name:            "command override",
+			entrypoint:      []string{"/bin/sh", "-c"},
+			command:         []string{"echo hi"},
+			commandOverride: []string{"echo bye"},
+			want:            []string{"/bin/sh", "-c", "echo bye"},
+		},
+		{
+			name:               "entrypoint override discards the command",
+			entrypoint:         []string{"/bin/sh", "-c"},
+			command:            []string{"echo hi"},
+			entrypointOverride: ptr("/bin/bash"),
+			want:               []string{"/bin/bash"},
+		},
+		{
+			name:               "entrypoint and command overrides",
+			entrypoint:         []string{"/bin/sh", "-c"},
+			command:            []string{"echo hi"},
+			entrypointOverride: ptr("/bin/bash"),
+			commandOverride:    []string{"-c", "echo bye"},
+			want:               []string{"/bin/bash", "-c", "echo bye"},
+		},
+		{
+			name:               "empty entrypoint override",
+			entrypoint:         []string{"/bin/sh", "-c"},
+			command:            []string{"echo hi"},
+			entrypointOverride: ptr(""),
+			want:               []string{},
+		},
+		{
+			name:               "empty entrypoint override with a command",
+			entrypoint:         []string{"/bin/sh", "-c"},
+			command:            []string{"echo hi"},
+			entrypointOverride: ptr(""),
+			commandOverride:    []string{"/bin/true"},
+			want:               []string{"/bin/true"},
+		},
+		{
+			name:            "empty command override keeps the image command",
+			entrypoint:      []string{"/bin/sh", "-c"},
+			command:         []string{"echo hi"},
+			commandOverride: []string{},
+			want:            []string{"/bin/sh", "-c", "echo hi"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MergeArgs(test.entrypoint, test.command, test.entrypointOverride, test.commandOverride)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
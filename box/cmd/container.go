@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	stateFile     = "state.json"
+	stateLockFile = "state.lock"
+)
+
+// StatePaused is the status of a container whose processes are frozen by `box pause`, which the
+// OCI runtime spec leaves to runtimes to add.
+const StatePaused specs.ContainerState = "paused"
+
+var containerIdPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Container is the state of a container, persisted at <root>/containers/<id>/state.json. It extends
+// the OCI runtime state with the details box needs to find the container's resources again.
+// See: https://github.com/opencontainers/runtime-spec/blob/main/runtime.md#state
+type Container struct {
+	specs.State
+	Created    time.Time         `json:"created"`
+	Network    *ContainerNetwork `json:"network,omitempty"`
+	CgroupUnit string            `json:"cgroupUnit,omitempty"`
+	CgroupPath string            `json:"cgroupPath,omitempty"`
+	Options    RunOptions        `json:"options"`
+	Detached   bool              `json:"detached,omitempty"`
+	// MonitorPid is the box process which owns the container and tears it down once it exits
+	MonitorPid int `json:"monitorPid,omitempty"`
+	// PidStartTime and MonitorStartTime are the start times of the processes, from
+	// /proc/<pid>/stat, which tell them apart from a later process reusing their pid
+	PidStartTime     uint64 `json:"pidStartTime,omitempty"`
+	MonitorStartTime uint64 `json:"monitorStartTime,omitempty"`
+	ExitCode         *int   `json:"exitCode,omitempty"`
+	// OOMKilled is whether the container process was killed for exceeding its memory limit
+	OOMKilled bool `json:"oomKilled,omitempty"`
+}
+
+// NewContainer returns the initial state for a container being created from the bundle at
+// `bundlePath`.
+func NewContainer(containerId string, bundlePath string, config *specs.Spec) (*Container, error) {
+	if !containerIdPattern.MatchString(containerId) {
+		return nil, fmt.Errorf("invalid container id %s, must match %s", containerId, containerIdPattern)
+	}
+	absBundlePath, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Container{
+		State: specs.State{
+			Version:     specs.Version,
+			ID:          containerId,
+			Status:      specs.StateCreating,
+			Bundle:      absBundlePath,
+			Annotations: config.Annotations,
+		},
+		Created: time.Now(),
+	}, nil
+}
+
+// LoadContainer reads the state of container `containerId` from disk.
+func LoadContainer(containerId string) (*Container, error) {
+	data, err := os.ReadFile(filepath.Join(containerPath(containerId), stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("container %s does not exist", containerId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	container := &Container{}
+	if err := json.Unmarshal(data, container); err != nil {
+		return nil, fmt.Errorf("failed to decode state of container %s: %w", containerId, err)
+	}
+	container.refreshStatus()
+	return container, nil
+}
+
+// ListContainers reads the state of every container on disk, ordered by creation time.
+func ListContainers() ([]*Container, error) {
+	entries, err := os.ReadDir(filepath.Join(stateRoot, containersFolder))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var containers []*Container
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(containerPath(entry.Name()), stateFile)); err != nil {
+			// e.g. only a kept writable layer is left
+			continue
+		}
+		container, err := LoadContainer(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created.Before(containers[j].Created)
+	})
+	return containers, nil
+}
+
+// Save writes the container state to disk.
+func (c *Container) Save() error {
+	path := containerPath(c.ID)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so readers never see a partial state file
+	tmp := filepath.Join(path, stateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(path, stateFile))
+}
+
+// Update applies `fn` to the stored state of the container and saves it, holding a lock on the
+// container so that changes other box processes made in the meantime are kept rather than
+// overwritten. The container is then refreshed from the saved state.
+func (c *Container) Update(fn func(stored *Container) error) error {
+	lock, err := os.OpenFile(filepath.Join(containerPath(c.ID), stateLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("container %s does not exist", c.ID)
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock container %s: %w", c.ID, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	stored, err := LoadContainer(c.ID)
+	if err != nil {
+		return err
+	}
+	if err := fn(stored); err != nil {
+		return err
+	}
+	if err := stored.Save(); err != nil {
+		return fmt.Errorf("failed to save container state: %w", err)
+	}
+	*c = *stored
+	return nil
+}
+
+// Remove deletes the container state and anonymous volumes from disk. The container directory
+// itself is only removed once it is empty, so a kept writable layer survives, and the anonymous
+// volumes are kept along with it.
+func (c *Container) Remove() error {
+	if !c.Options.Keep {
+		if err := RemoveAnonymousVolumes(c.ID); err != nil {
+			return err
+		}
+	}
+	path := containerPath(c.ID)
+	for _, file := range []string{stateFile, stateLockFile, configFile} {
+		if err := os.Remove(filepath.Join(path, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	os.Remove(path)
+	return nil
+}
+
+// refreshStatus marks the container as stopped if its process has gone away without the state
+// being updated, e.g. because box was killed.
+func (c *Container) refreshStatus() {
+	if c.Status == specs.StateStopped {
+		return
+	}
+	// before the container process exists only the monitor can be checked
+	pid, startTime := c.Pid, c.PidStartTime
+	if pid == 0 {
+		pid, startTime = c.MonitorPid, c.MonitorStartTime
+	}
+	if pid != 0 && !processAlive(pid, startTime) {
+		c.Status = specs.StateStopped
+	}
+}
+
+// Signal sends `signal` to the container process.
+func (c *Container) Signal(signal syscall.Signal) error {
+	if c.Pid == 0 {
+		return fmt.Errorf("container %s has no process", c.ID)
+	}
+	// the pid may belong to another process once the container process has exited
+	if !processAlive(c.Pid, c.PidStartTime) {
+		return fmt.Errorf("failed to signal container %s: %w", c.ID, syscall.ESRCH)
+	}
+	if err := syscall.Kill(c.Pid, signal); err != nil {
+		return fmt.Errorf("failed to signal container %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+// WaitForTeardown blocks until the monitor process has torn down the container or `timeout`
+// has passed.
+func (c *Container) WaitForTeardown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for c.MonitorPid != 0 && processAlive(c.MonitorPid, c.MonitorStartTime) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for container %s to be torn down", c.ID)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// WaitForExit blocks until the container process has exited or `timeout` has passed, returning
+// whether it exited.
+func (c *Container) WaitForExit(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for c.Pid != 0 && processAlive(c.Pid, c.PidStartTime) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// processAlive returns whether process `pid` is still running. A pid can be reused once its
+// process has exited, so if `startTime` is known it must also match the start time of the process.
+func processAlive(pid int, startTime uint64) bool {
+	if startTime != 0 {
+		return processStartTime(pid) == startTime
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// processStartTime returns the time process `pid` started after boot in clock ticks, or 0 if
+// there is no such process.
+// See: https://man7.org/linux/man-pages/man5/proc_pid_stat.5.html
+func processStartTime(pid int) uint64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// the command name in the second field may contain spaces and parentheses
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	// the fields after the command name start from the third, and the start time is the 22nd
+	if len(fields) < 20 {
+		return 0
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return startTime
+}
+
+func containerPath(containerId string) string {
+	return filepath.Join(stateRoot, containersFolder, containerId)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestProcessAlive(t *testing.T) {
+	pid := os.Getpid()
+	startTime := processStartTime(pid)
+	if startTime == 0 {
+		t.Fatal("no start time for the current process")
+	}
+
+	// a process which has exited, whose pid is free to be reused
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		pid       int
+		startTime uint64
+		want      bool
+	}{
+		{"running", pid, startTime, true},
+		{"running without a start time", pid, 0, true},
+		{"pid reused", pid, startTime - 1, false},
+		{"exited", exited.Process.Pid, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := processAlive(test.pid, test.startTime); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContainerUpdate(t *testing.T) {
+	oldRoot := stateRoot
+	t.Cleanup(func() { stateRoot = oldRoot })
+	stateRoot = t.TempDir()
+
+	container, err := NewContainer("test", t.TempDir(), &specs.Spec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent updates of different fields from their own copies of the state are all kept
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			other, err := LoadContainer("test")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := other.Update(func(stored *Container) error {
+				stored.Options.StopTimeout++
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Go(func() {
+		if err := container.Update(func(stored *Container) error {
+			stored.Status = specs.StateRunning
+			return nil
+		}); err != nil {
+			t.Error(err)
+		}
+	})
+	wg.Wait()
+
+	stored, err := LoadContainer("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Options.StopTimeout != 20 || stored.Status != specs.StateRunning {
+		t.Errorf("got stop timeout %d and status %s, want 20 and running", stored.Options.StopTimeout, stored.Status)
+	}
+
+	if err := (&Container{State: specs.State{ID: "missing"}}).Update(func(*Container) error { return nil }); err == nil {
+		t.Error("expected an error updating a container which does not exist")
+	}
+
+	// the lock file doesn't keep the container directory around
+	if err := stored.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(containerPath("test")); !os.IsNotExist(err) {
+		t.Errorf("container directory is left after removing it: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+)
+
+var forceDelete bool
+
+func init() {
+	deleteCmd.Flags().BoolVarP(&forceDelete, "force", "f", false, "Kill the container first if it is running")
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete [flags] <container-id>",
+	Short: "delete a stopped container along with its writable layer and logs",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		if container.Status != specs.StateStopped {
+			if !forceDelete {
+				return fmt.Errorf("container %s is %s, stop it first or use --force", container.ID, container.Status)
+			}
+			if container.Pid != 0 {
+				if err := container.Signal(syscall.SIGKILL); err != nil {
+					return err
+				}
+				container.WaitForExit(teardownTimeout)
+			}
+		}
+		if err := container.WaitForTeardown(teardownTimeout); err != nil {
+			return err
+		}
+
+		// release anything a monitor which died early left behind
+		if container.Network != nil {
+			DisconnectContainer(container.Network)
+			CleanupNAT(container.Network.IP, container.Options.Port)
+		}
+		if err := ReleaseNetwork(cmd.Context(), container.ID); err != nil {
+			return fmt.Errorf("failed to release container network: %w", err)
+		}
+
+		if err := RemoveAnonymousVolumes(container.ID); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(containerPath(container.ID)); err != nil {
+			return err
+		}
+		EmitEvent(cmd.Context(), container, EventDeleted)
+		return nil
+	},
+}
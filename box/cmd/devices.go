@@ -0,0 +1,376 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// defaultDevices are created in every container, along with /dev/ptmx and /dev/console.
+var defaultDevices = []specs.LinuxDevice{
+	charDevice("/dev/null", 1, 3),
+	charDevice("/dev/zero", 1, 5),
+	charDevice("/dev/full", 1, 7),
+	charDevice("/dev/random", 1, 8),
+	charDevice("/dev/urandom", 1, 9),
+	charDevice("/dev/tty", 5, 0),
+}
+
+// defaultDeviceRules allow the default devices, ptys and creating any device node, as a container
+// doesn't work without them.
+var defaultDeviceRules = []specs.LinuxDeviceCgroup{
+	deviceRule("c", -1, -1, "m"),
+	deviceRule("b", -1, -1, "m"),
+	deviceRule("c", 1, 3, "rwm"),
+	deviceRule("c", 1, 5, "rwm"),
+	deviceRule("c", 1, 7, "rwm"),
+	deviceRule("c", 1, 8, "rwm"),
+	deviceRule("c", 1, 9, "rwm"),
+	deviceRule("c", 5, 0, "rwm"),
+	deviceRule("c", 5, 1, "rwm"),
+	deviceRule("c", 5, 2, "rwm"),
+	deviceRule("c", 136, -1, "rwm"),
+}
+
+func charDevice(path string, major int64, minor int64) specs.LinuxDevice {
+	mode := os.FileMode(0666)
+	return specs.LinuxDevice{Path: path, Type: "c", Major: major, Minor: minor, FileMode: &mode}
+}
+
+// deviceRule returns a rule allowing `access` to the devices of type `deviceType` with `major` and
+// `minor`, where -1 matches any number.
+func deviceRule(deviceType string, major int64, minor int64, access string) specs.LinuxDeviceCgroup {
+	rule := specs.LinuxDeviceCgroup{Allow: true, Type: deviceType, Access: access}
+	if major != -1 {
+		rule.Major = &major
+	}
+	if minor != -1 {
+		rule.Minor = &minor
+	}
+	return rule
+}
+
+var deviceTypeMap = map[string]uint32{
+	"c": syscall.S_IFCHR,
+	"u": syscall.S_IFCHR,
+	"b": syscall.S_IFBLK,
+	"p": syscall.S_IFIFO,
+}
+
+// containerDevices returns the devices to create in a container with `config`, the devices in
+// the config replacing any default device at the same path.
+func containerDevices(config *specs.Spec) []specs.LinuxDevice {
+	devices := slices.DeleteFunc(slices.Clone(defaultDevices), func(d specs.LinuxDevice) bool {
+		return slices.ContainsFunc(config.Linux.Devices, func(c specs.LinuxDevice) bool {
+			return filepath.Clean(c.Path) == d.Path
+		})
+	})
+	return append(devices, config.Linux.Devices...)
+}
+
+// CreateDevice creates `device` inside `rootfs` with its type, numbers, mode and owner. A user
+// namespace can't create device nodes, so when `userNamespace` is set the host device is bind
+// mounted instead.
+func CreateDevice(rootfs string, device specs.LinuxDevice, userNamespace bool) error {
+	fileType, ok := deviceTypeMap[device.Type]
+	if !ok {
+		return fmt.Errorf("unknown type %s of device %s", device.Type, device.Path)
+	}
+	path, err := SecureJoin(rootfs, device.Path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device path %s: %w", device.Path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for device %s: %w", device.Path, err)
+	}
+	if userNamespace && fileType != syscall.S_IFIFO {
+		return BindDevice(hostDevicePath(device), path)
+	}
+
+	mode := os.FileMode(0666)
+	if device.FileMode != nil {
+		mode = device.FileMode.Perm()
+	}
+	dev := unix.Mkdev(uint32(device.Major), uint32(device.Minor))
+	if err := unix.Mknod(path, fileType|uint32(mode), int(dev)); err != nil {
+		return fmt.Errorf("failed to create device at %s: %w", device.Path, err)
+	}
+	// mknod applies the umask
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to set mode of device %s: %w", device.Path, err)
+	}
+	if device.UID != nil || device.GID != nil {
+		uid, gid := -1, -1
+		if device.UID != nil {
+			uid = int(*device.UID)
+		}
+		if device.GID != nil {
+			gid = int(*device.GID)
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to set owner of device %s: %w", device.Path, err)
+		}
+	}
+	return nil
+}
+
+// hostDevicePath returns where the host has `device`, which is the same path when it is the
+// same device or otherwise its link under /dev/char or /dev/block.
+func hostDevicePath(device specs.LinuxDevice) string {
+	var stat unix.Stat_t
+	if err := unix.Stat(device.Path, &stat); err == nil &&
+		int64(unix.Major(stat.Rdev)) == device.Major && int64(unix.Minor(stat.Rdev)) == device.Minor {
+		return device.Path
+	}
+	kind := "char"
+	if device.Type == "b" {
+		kind = "block"
+	}
+	return fmt.Sprintf("/dev/%s/%d:%d", kind, device.Major, device.Minor)
+}
+
+// BindDevice bind mounts the host device at `hostPath` to `path`, for when device nodes can't be
+// created such as in a user namespace.
+func BindDevice(hostPath string, path string) error {
+	if err := os.WriteFile(path, []byte{}, 0666); err != nil {
+		return fmt.Errorf("failed to create mount point for device at %s: %w", path, err)
+	}
+	if err := syscall.Mount(hostPath, path, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount device %s: %w", hostPath, err)
+	}
+	return nil
+}
+
+// ParseDevice parses a `--device` flag, which is <host-path>[:<container-path>][:<permissions>]
+// in the same format as Docker. It returns the device to create, with the type, numbers, mode
+// and owner of the host device, and the rule allowing the container to use it.
+func ParseDevice(flag string) (specs.LinuxDevice, specs.LinuxDeviceCgroup, error) {
+	parts := strings.Split(flag, ":")
+	hostPath, containerPath, access := parts[0], parts[0], "rwm"
+	switch {
+	case len(parts) == 2 && strings.HasPrefix(parts[1], "/"):
+		containerPath = parts[1]
+	case len(parts) == 2:
+		access = parts[1]
+	case len(parts) == 3:
+		containerPath, access = parts[1], parts[2]
+	case len(parts) > 3:
+		return specs.LinuxDevice{}, specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid device %s, must be <host-path>[:<container-path>][:<permissions>]", flag)
+	}
+	if access == "" || strings.Trim(access, "rwm") != "" {
+		return specs.LinuxDevice{}, specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid device permissions %s, must be a combination of r, w and m", access)
+	}
+	if !filepath.IsAbs(containerPath) {
+		return specs.LinuxDevice{}, specs.LinuxDeviceCgroup{}, fmt.Errorf("invalid device %s, the container path must be absolute", flag)
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Stat(hostPath, &stat); err != nil {
+		return specs.LinuxDevice{}, specs.LinuxDeviceCgroup{}, fmt.Errorf("failed to stat device %s: %w", hostPath, err)
+	}
+	var deviceType string
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		deviceType = "c"
+	case syscall.S_IFBLK:
+		deviceType = "b"
+	default:
+		return specs.LinuxDevice{}, specs.LinuxDeviceCgroup{}, fmt.Errorf("%s is not a device", hostPath)
+	}
+	mode := os.FileMode(stat.Mode).Perm()
+	device := specs.LinuxDevice{
+		Path:     containerPath,
+		Type:     deviceType,
+		Major:    int64(unix.Major(stat.Rdev)),
+		Minor:    int64(unix.Minor(stat.Rdev)),
+		FileMode: &mode,
+		UID:      &stat.Uid,
+		GID:      &stat.Gid,
+	}
+	return device, deviceRule(deviceType, device.Major, device.Minor, access), nil
+}
+
+// bpfInsn is an eBPF instruction, struct bpf_insn.
+type bpfInsn struct {
+	Code uint8
+	// Regs holds the destination register in the low 4 bits and the source in the high 4 bits
+	Regs uint8
+	Off  int16
+	Imm  int32
+}
+
+// bpfProgLoadAttr is the start of union bpf_attr for BPF_PROG_LOAD.
+type bpfProgLoadAttr struct {
+	ProgType    uint32
+	InsnCnt     uint32
+	Insns       uint64
+	License     uint64
+	LogLevel    uint32
+	LogSize     uint32
+	LogBuf      uint64
+	KernVersion uint32
+	ProgFlags   uint32
+}
+
+// bpfProgAttachAttr is the start of union bpf_attr for BPF_PROG_ATTACH.
+type bpfProgAttachAttr struct {
+	TargetFd    uint32
+	AttachBpfFd uint32
+	AttachType  uint32
+	AttachFlags uint32
+}
+
+var deviceCgroupTypeMap = map[string]int32{
+	"c": unix.BPF_DEVCG_DEV_CHAR,
+	"b": unix.BPF_DEVCG_DEV_BLOCK,
+}
+
+var deviceCgroupAccessMap = map[rune]int32{
+	'r': unix.BPF_DEVCG_ACC_READ,
+	'w': unix.BPF_DEVCG_ACC_WRITE,
+	'm': unix.BPF_DEVCG_ACC_MKNOD,
+}
+
+// CompileDeviceFilter compiles the device cgroup `rules` into an eBPF program for the cgroup v2
+// device controller. As with the cgroup v1 device lists, later rules take precedence over earlier
+// ones and a device which no rule matches is denied.
+func CompileDeviceFilter(rules []specs.LinuxDeviceCgroup) ([]bpfInsn, error) {
+	// the program is given struct bpf_cgroup_dev_ctx in r1, load the device type into r2, the
+	// access into r3, the major into r4 and the minor into r5
+	program := []bpfInsn{
+		bpfLoadCtx(2, 0),
+		bpfAlu(unix.BPF_AND, 2, 0xffff),
+		bpfLoadCtx(3, 0),
+		bpfAlu(unix.BPF_RSH, 3, 16),
+		bpfLoadCtx(4, 4),
+		bpfLoadCtx(5, 8),
+	}
+
+	// the first rule to match decides, so the rules are checked last to first
+	for _, rule := range slices.Backward(rules) {
+		// jumps to the end of the block, which is the next rule, are fixed up afterwards
+		var block []bpfInsn
+		switch rule.Type {
+		case "", "a":
+		case "c", "b":
+			block = append(block, bpfJumpImm(unix.BPF_JNE, 2, deviceCgroupTypeMap[rule.Type]))
+		default:
+			return nil, fmt.Errorf("unknown device cgroup rule type %s", rule.Type)
+		}
+
+		var access int32
+		for _, a := range rule.Access {
+			flag, ok := deviceCgroupAccessMap[a]
+			if !ok {
+				return nil, fmt.Errorf("unknown device cgroup rule access %s", rule.Access)
+			}
+			access |= flag
+		}
+		all := int32(unix.BPF_DEVCG_ACC_READ | unix.BPF_DEVCG_ACC_WRITE | unix.BPF_DEVCG_ACC_MKNOD)
+		if rule.Access != "" && access != all {
+			// an allow rule must cover all the access asked for, a deny rule any of it
+			block = append(block, bpfInsn{Code: unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X, Regs: 3<<4 | 1})
+			if rule.Allow {
+				block = append(block, bpfAlu(unix.BPF_AND, 1, all&^access), bpfJumpImm(unix.BPF_JNE, 1, 0))
+			} else {
+				block = append(block, bpfAlu(unix.BPF_AND, 1, access), bpfJumpImm(unix.BPF_JEQ, 1, 0))
+			}
+		}
+		if rule.Major != nil && *rule.Major >= 0 {
+			block = append(block, bpfJumpImm(unix.BPF_JNE, 4, int32(*rule.Major)))
+		}
+		if rule.Minor != nil && *rule.Minor >= 0 {
+			block = append(block, bpfJumpImm(unix.BPF_JNE, 5, int32(*rule.Minor)))
+		}
+
+		result := int32(0)
+		if rule.Allow {
+			result = 1
+		}
+		// the verifier rejects the rules after one matching every device, which are unreachable
+		matchesAll := len(block) == 0
+		block = append(block, bpfAlu(unix.BPF_MOV, 0, result), bpfInsn{Code: unix.BPF_JMP | unix.BPF_EXIT})
+		for i := range block {
+			if block[i].Code&0x07 == unix.BPF_JMP && block[i].Code&0xf0 != unix.BPF_EXIT {
+				block[i].Off = int16(len(block) - i - 1)
+			}
+		}
+		program = append(program, block...)
+		if matchesAll {
+			return program, nil
+		}
+	}
+
+	return append(program, bpfAlu(unix.BPF_MOV, 0, 0), bpfInsn{Code: unix.BPF_JMP | unix.BPF_EXIT}), nil
+}
+
+// bpfLoadCtx loads the 32 bit field at `offset` in the program context into register `dst`.
+func bpfLoadCtx(dst uint8, offset int16) bpfInsn {
+	return bpfInsn{Code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, Regs: 1<<4 | dst, Off: offset}
+}
+
+func bpfAlu(op uint8, dst uint8, imm int32) bpfInsn {
+	return bpfInsn{Code: unix.BPF_ALU | op | unix.BPF_K, Regs: dst, Imm: imm}
+}
+
+func bpfJumpImm(op uint8, dst uint8, imm int32) bpfInsn {
+	return bpfInsn{Code: unix.BPF_JMP | op | unix.BPF_K, Regs: dst, Imm: imm}
+}
+
+// ApplyDeviceCgroup enforces the device cgroup `rules` on the cgroup at `cgroupPath` by attaching
+// a device program to it. The program stays attached until the cgroup is removed. Only cgroup v2
+// is supported.
+func ApplyDeviceCgroup(cgroupPath string, rules []specs.LinuxDeviceCgroup) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &stat); err != nil {
+		return fmt.Errorf("failed to statfs %s: %w", cgroupRoot, err)
+	}
+	if stat.Type != unix.CGROUP2_SUPER_MAGIC {
+		return errors.New("the device cgroup can only be enforced with cgroup v2")
+	}
+
+	program, err := CompileDeviceFilter(rules)
+	if err != nil {
+		return err
+	}
+	license := []byte("GPL\x00")
+	loadAttr := bpfProgLoadAttr{
+		ProgType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		InsnCnt:  uint32(len(program)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&program[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&loadAttr)), unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(program)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		return fmt.Errorf("failed to load device cgroup program: %w", errno)
+	}
+	defer unix.Close(int(progFd))
+
+	cgroup, err := os.Open(cgroupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	defer cgroup.Close()
+	// systemd may attach its own device program to the same cgroup
+	attachAttr := bpfProgAttachAttr{
+		TargetFd:    uint32(cgroup.Fd()),
+		AttachBpfFd: uint32(progFd),
+		AttachType:  unix.BPF_CGROUP_DEVICE,
+		AttachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attachAttr)), unsafe.Sizeof(attachAttr)); errno != 0 {
+		return fmt.Errorf("failed to attach device cgroup program: %w", errno)
+	}
+	return nil
+}
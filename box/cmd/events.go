@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	eventsFile     = "events.jsonl"
+	eventsLockFile = "events.lock"
+)
+
+// maxEventsSize is the size at which the events file is rotated, keeping only the previous file
+// as events.jsonl.1 so that the events don't grow forever.
+var maxEventsSize int64 = 1 << 20
+
+const (
+	EventCreated = "created"
+	EventStarted = "started"
+	EventOOM     = "oom"
+	EventPaused  = "paused"
+	EventResumed = "resumed"
+	EventExited  = "exited"
+	EventStopped = "stopped"
+	EventDeleted = "deleted"
+)
+
+// Event is a change in the lifecycle of a container. Every event is appended as a JSON line to
+// <root>/events.jsonl, which `box events` follows across rotations.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	Pid  int       `json:"pid,omitempty"`
+	// ExitCode and OOMKilled are set on exited events
+	ExitCode  *int `json:"exitCode,omitempty"`
+	OOMKilled bool `json:"oomKilled,omitempty"`
+}
+
+// EmitEvent logs an event of type `eventType` for `container` and records it in the events file.
+func EmitEvent(ctx context.Context, container *Container, eventType string) {
+	log := Logger(ctx)
+	event := Event{
+		Time:      time.Now(),
+		Type:      eventType,
+		ID:        container.ID,
+		Pid:       container.Pid,
+		OOMKilled: container.OOMKilled && eventType == EventExited,
+	}
+	if eventType == EventExited {
+		event.ExitCode = container.ExitCode
+	}
+
+	attrs := []any{"type", event.Type, "container", event.ID}
+	if event.ExitCode != nil {
+		attrs = append(attrs, "exitCode", *event.ExitCode, "oomKilled", event.OOMKilled)
+	}
+	log.Info("container event", attrs...)
+
+	if err := appendEvent(event); err != nil {
+		log.Warn("failed to record container event", "err", err)
+	}
+}
+
+func appendEvent(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateRoot, 0755); err != nil {
+		return err
+	}
+
+	// the lock keeps events from being written to a file which has just been rotated away, and
+	// lines from concurrent box processes whole
+	lock, err := os.OpenFile(filepath.Join(stateRoot, eventsLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock events: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	path := filepath.Join(stateRoot, eventsFile)
+	if info, err := os.Stat(path); err == nil && info.Size() >= maxEventsSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate events: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// oomKillCount reads the number of processes in the cgroup at `cgroupPath` which have been killed
+// by the OOM killer.
+func oomKillCount(cgroupPath string) (uint64, error) {
+	events, err := readCgroupKeyValues(cgroupPath, "memory.events")
+	if err != nil {
+		return 0, err
+	}
+	return events["oom_kill"], nil
+}
+
+// WatchOOMKills calls `onOOMKill` each time the OOM killer kills a process in the cgroup at
+// `cgroupPath`, until the returned function is called. It watches memory.events with inotify, as
+// the kernel notifies a modification of the file when its counters change.
+func WatchOOMKills(cgroupPath string, onOOMKill func()) (func(), error) {
+	eventsPath := filepath.Join(cgroupPath, "memory.events")
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify instance: %w", err)
+	}
+	if _, err := unix.InotifyAddWatch(fd, eventsPath, unix.IN_MODIFY); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", eventsPath, err)
+	}
+	count, err := oomKillCount(cgroupPath)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// as a non-blocking os.File, closing it wakes up the read
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			if _, err := inotify.Read(buf); err != nil {
+				return
+			}
+			current, err := oomKillCount(cgroupPath)
+			if err != nil {
+				return
+			}
+			for ; count < current; count++ {
+				onOOMKill()
+			}
+		}
+	}()
+	return func() {
+		inotify.Close()
+		<-done
+	}, nil
+}
+
+var (
+	eventsAll    bool
+	eventsFollow bool
+)
+
+func init() {
+	eventsCmd.Flags().BoolVar(&eventsAll, "all", false, "Print the events recorded so far, since the last rotation but one, before following new ones")
+	eventsCmd.Flags().BoolVarP(&eventsFollow, "follow", "f", true, "Keep printing events as they happen")
+}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events [flags] [container-id...]",
+	Short: "follow container lifecycle events as JSON lines (default: all containers)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		if eventsAll {
+			if err := printRotatedEvents(args); err != nil {
+				return err
+			}
+		}
+		f, err := openEvents()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+		}()
+		if f != nil && !eventsAll {
+			if _, err := f.Seek(0, io.SeekEnd); err != nil {
+				return err
+			}
+		}
+
+		// the events file is only read once a full line has been written
+		var pending []byte
+		for {
+			if f == nil {
+				if f, err = openEvents(); err != nil {
+					return err
+				}
+			}
+			rotated := false
+			if f != nil {
+				// checked before reading, as every event written to the file before its rotation
+				// is then read
+				rotated = eventsRotated(f)
+				reader := bufio.NewReader(f)
+				for {
+					line, err := reader.ReadBytes('\n')
+					pending = append(pending, line...)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return fmt.Errorf("failed to read events: %w", err)
+					}
+					if err := printEvent(pending, args); err != nil {
+						return err
+					}
+					pending = nil
+				}
+			}
+			if rotated {
+				f.Close()
+				f, pending = nil, nil
+				continue
+			}
+
+			if !eventsFollow {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	},
+}
+
+// openEvents opens the events file, returning nil if no event has been recorded yet.
+func openEvents() (*os.File, error) {
+	f, err := os.Open(filepath.Join(stateRoot, eventsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events: %w", err)
+	}
+	return f, nil
+}
+
+// eventsRotated returns whether the events file has been rotated since `f` was opened.
+func eventsRotated(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(filepath.Join(stateRoot, eventsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	return err == nil && !os.SameFile(info, current)
+}
+
+// printRotatedEvents prints the events for `containerIds` in the file the events file was last
+// rotated to, if there is one.
+func printRotatedEvents(containerIds []string) error {
+	data, err := os.ReadFile(filepath.Join(stateRoot, eventsFile+".1"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read events: %w", err)
+	}
+	for line := range bytes.Lines(data) {
+		if err := printEvent(line, containerIds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printEvent prints the event in `line` if it is for one of `containerIds`, or there are none.
+func printEvent(line []byte, containerIds []string) error {
+	if len(containerIds) > 0 {
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return fmt.Errorf("failed to decode event %q: %w", bytes.TrimSpace(line), err)
+		}
+		if !slices.Contains(containerIds, event.ID) {
+			return nil
+		}
+	}
+	_, err := os.Stdout.Write(line)
+	return err
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// readEvents decodes the events in the events file `name` of the state root.
+func readEvents(t *testing.T, name string) []Event {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(stateRoot, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	for line := range bytes.Lines(data) {
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("failed to decode event %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEmitEvent(t *testing.T) {
+	oldRoot := stateRoot
+	t.Cleanup(func() { stateRoot = oldRoot })
+	stateRoot = t.TempDir()
+
+	container := &Container{State: specs.State{ID: "c1", Pid: 42}, ExitCode: ptr(137), OOMKilled: true}
+	EmitEvent(t.Context(), container, EventStarted)
+	EmitEvent(t.Context(), container, EventExited)
+
+	data, err := os.ReadFile(filepath.Join(stateRoot, eventsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), data)
+	}
+	// the exit code and oom kill are only recorded on exited events
+	if strings.Contains(lines[0], "exitCode") || strings.Contains(lines[0], "oomKilled") {
+		t.Errorf("got started event %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"exitCode":137`) || !strings.Contains(lines[1], `"oomKilled":true`) {
+		t.Errorf("got exited event %s", lines[1])
+	}
+
+	events := readEvents(t, eventsFile)
+	if events[0].Type != EventStarted || events[0].ID != "c1" || events[0].Pid != 42 || events[0].Time.IsZero() {
+		t.Errorf("got started event %+v", events[0])
+	}
+	if events[1].Type != EventExited || events[1].ExitCode == nil || *events[1].ExitCode != 137 || !events[1].OOMKilled {
+		t.Errorf("got exited event %+v", events[1])
+	}
+}
+
+func TestAppendEventRotation(t *testing.T) {
+	oldRoot, oldMax := stateRoot, maxEventsSize
+	t.Cleanup(func() { stateRoot, maxEventsSize = oldRoot, oldMax })
+	stateRoot = t.TempDir()
+
+	// every event has the same length, so that the file is rotated after three of them
+	line, err := json.Marshal(Event{Type: EventCreated, ID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxEventsSize = 3 * int64(len(line)+1)
+
+	ids := func(name string) string {
+		var ids string
+		for _, event := range readEvents(t, name) {
+			ids += event.ID
+		}
+		return ids
+	}
+	for _, id := range strings.Split("abcdefg", "") {
+		if err := appendEvent(Event{Type: EventCreated, ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if id == "f" {
+			if rotated, current := ids(eventsFile+".1"), ids(eventsFile); rotated != "abc" || current != "def" {
+				t.Fatalf("got events %q and %q, want abc and def", rotated, current)
+			}
+		}
+	}
+	// only the previous file is kept
+	if rotated, current := ids(eventsFile+".1"), ids(eventsFile); rotated != "def" || current != "g" {
+		t.Errorf("got events %q and %q, want def and g", rotated, current)
+	}
+}
+
+func TestEventsRotated(t *testing.T) {
+	oldRoot := stateRoot
+	t.Cleanup(func() { stateRoot = oldRoot })
+	stateRoot = t.TempDir()
+
+	if err := appendEvent(Event{Type: EventCreated, ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(stateRoot, eventsFile)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if eventsRotated(f) {
+		t.Error("expected the events file not to be rotated")
+	}
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if !eventsRotated(f) {
+		t.Error("expected a missing events file to be rotated")
+	}
+	if err := appendEvent(Event{Type: EventCreated, ID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if !eventsRotated(f) {
+		t.Error("expected a new events file to be rotated")
+	}
+}
+
+func TestOOMKillCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  *string
+		want    uint64
+		wantErr bool
+	}{
+		{name: "oom kills", events: ptr("low 0\nhigh 2\nmax 5\noom 3\noom_kill 3\noom_group_kill 0\n"), want: 3},
+		{name: "no oom kills", events: ptr("low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n"), want: 0},
+		{name: "no oom_kill key", events: ptr("low 0\nhigh 0\n"), want: 0},
+		{name: "unparsable lines", events: ptr("oom_kill\nbad line here\noom_kill 7\n"), want: 7},
+		{name: "missing file", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := t.TempDir()
+			if test.events != nil {
+				if err := os.WriteFile(filepath.Join(path, "memory.events"), []byte(*test.events), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := oomKillCount(path)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
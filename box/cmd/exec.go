@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	execTTY         bool
+	execInteractive bool
+	execEnv         []string
+	execCwd         string
+)
+
+func init() {
+	execCmd.Flags().BoolVarP(&execTTY, "tty", "t", false, "Allocate a pty for the process")
+	execCmd.Flags().BoolVarP(&execInteractive, "interactive", "i", false, "Keep stdin attached to the process")
+	execCmd.Flags().StringArrayVarP(&execEnv, "env", "e", nil, "Set an environment variable for the process as <name>=<value>")
+	execCmd.Flags().StringVarP(&execCwd, "workdir", "w", "", "Working directory for the process inside the container")
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] <container-id> -- <command> [args...]",
+	Short: "run an additional process inside a running container",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		containerId := args[0]
+
+		ctx := cmd.Context()
+		log := Logger(ctx)
+
+		container, err := LoadContainer(containerId)
+		if err != nil {
+			return err
+		}
+		if container.Status != specs.StateRunning {
+			return fmt.Errorf("container %s is %s", container.ID, container.Status)
+		}
+		config, err := container.Config()
+		if err != nil {
+			return err
+		}
+
+		// the process inherits everything from the container process except what it runs
+		process := *config.Process
+		process.Args = args[1:]
+		process.Env = append(process.Env, execEnv...)
+		process.Terminal = execTTY
+		if execCwd != "" {
+			process.Cwd = execCwd
+		}
+
+		// 1. open the namespaces and cgroup of the container before we can no longer see them
+		var namespaces []*os.File
+		var mountNamespace *os.File
+		for _, ns := range config.Linux.Namespaces {
+			// joining a user namespace requires a single threaded process
+			if ns.Type == specs.UserNamespace {
+				continue
+			}
+			f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", container.Pid, namespaceFileMap[ns.Type]))
+			if err != nil {
+				return fmt.Errorf("failed to open %s namespace of container: %w", ns.Type, err)
+			}
+			defer f.Close()
+			// the mount namespace changes our root so must be joined last
+			if ns.Type == specs.MountNamespace {
+				mountNamespace = f
+				continue
+			}
+			namespaces = append(namespaces, f)
+		}
+		if mountNamespace != nil {
+			namespaces = append(namespaces, mountNamespace)
+		}
+		cgroupPath, err := CgroupPathFromPid(container.Pid)
+		if err != nil {
+			return fmt.Errorf("failed to find cgroup of container: %w", err)
+		}
+		cgroup, err := os.Open(cgroupPath)
+		if err != nil {
+			return fmt.Errorf("failed to open cgroup of container: %w", err)
+		}
+		defer cgroup.Close()
+
+		// the pty must be allocated from the host's devpts, before joining the mount namespace
+		var console *Console
+		if execTTY {
+			if console, err = NewConsole(); err != nil {
+				return err
+			}
+			defer console.Close()
+		}
+
+		// 2. join the namespaces
+		// Namespaces are per thread, so this thread is locked and never unlocked which makes the Go
+		// runtime throw it away afterwards. Processes started from it inherit its namespaces, and
+		// the pid namespace only applies to them. Joining a mount namespace needs a thread which
+		// does not share filesystem attributes with the rest of the process. A user namespace can
+		// only be joined by a single threaded process, so nsenter joins them all instead.
+		userNamespace := HasNamespace(config.Linux.Namespaces, specs.UserNamespace)
+		if !userNamespace {
+			log.Info("joining container namespaces", "container", container.ID)
+			runtime.LockOSThread()
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				return fmt.Errorf("failed to unshare filesystem attributes: %w", err)
+			}
+			for _, ns := range namespaces {
+				if err := unix.Setns(int(ns.Fd()), 0); err != nil {
+					return fmt.Errorf("failed to join namespace %s: %w", ns.Name(), err)
+				}
+			}
+		}
+
+		// 3. start the exec child inside the container, it drops privileges and execs the process
+		r, w, err := os.Pipe() // create a pipe to send the process to the exec child
+		if err != nil {
+			return err
+		}
+		// on an error the exec child sees the pipe close and exits instead of waiting for the process
+		defer r.Close()
+		defer w.Close()
+		execChildArgs := append(rootFlagArgs(), "exec-child")
+		execChild := exec.Command("/proc/self/exe", execChildArgs...)
+		execChild.ExtraFiles = []*os.File{r}
+		if userNamespace {
+			// our executable can't be seen from inside the mount namespace, so nsenter runs it
+			// from an fd instead
+			self, err := os.Open("/proc/self/exe")
+			if err != nil {
+				return err
+			}
+			defer self.Close()
+			execChild = nsenterCommand(container.Pid, config.Linux.Namespaces, "/proc/self/fd/4", execChildArgs...)
+			execChild.ExtraFiles = []*os.File{r, self}
+		}
+		if execInteractive {
+			execChild.Stdin = os.Stdin
+		}
+		execChild.Stdout = os.Stdout
+		execChild.Stderr = os.Stderr
+		execChild.SysProcAttr = &syscall.SysProcAttr{
+			UseCgroupFD: true,
+			CgroupFD:    int(cgroup.Fd()),
+		}
+		if console != nil {
+			execChild.Stdin = console.Slave
+			execChild.Stdout = console.Slave
+			execChild.Stderr = console.Slave
+			execChild.SysProcAttr.Setsid = true
+			execChild.SysProcAttr.Setctty = true
+		}
+		if err := execChild.Start(); err != nil {
+			return fmt.Errorf("failed to start process in container: %w", err)
+		}
+		r.Close()
+		if console != nil {
+			var stdin io.Reader
+			if execInteractive {
+				stdin = os.Stdin
+			}
+			if err := console.Attach(stdin, os.Stdout); err != nil {
+				return err
+			}
+		}
+		// the seccomp filter of the container applies to the process too
+		spec := &specs.Spec{Process: &process, Linux: &specs.Linux{Seccomp: config.Linux.Seccomp}}
+		if err := json.NewEncoder(w).Encode(spec); err != nil {
+			return fmt.Errorf("failed to send process to container: %w", err)
+		}
+		w.Close()
+
+		// 4. wait for exit and pass the exit code back
+		if err := execChild.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return fmt.Errorf("error waiting for process: %w", err)
+			}
+		}
+		if exitCode := ExitCodeFromState(execChild.ProcessState); exitCode != 0 {
+			return &ExitCodeError{Code: exitCode}
+		}
+		return nil
+	},
+}
+
+// nsenterFlagMap maps namespace types to the nsenter flag which joins them.
+var nsenterFlagMap = map[specs.LinuxNamespaceType]string{
+	specs.PIDNamespace:     "--pid",
+	specs.NetworkNamespace: "--net",
+	specs.MountNamespace:   "--mount",
+	specs.IPCNamespace:     "--ipc",
+	specs.UTSNamespace:     "--uts",
+	specs.UserNamespace:    "--user",
+	specs.CgroupNamespace:  "--cgroup",
+	specs.TimeNamespace:    "--time",
+}
+
+// nsenterCommand returns a command which runs `path` with `args` inside the `namespaces` of
+// process `pid`. Credentials are preserved, which are root in the user namespace of a rootless
+// container.
+func nsenterCommand(pid int, namespaces []specs.LinuxNamespace, path string, args ...string) *exec.Cmd {
+	nsenterArgs := []string{"--target", strconv.Itoa(pid), "--preserve-credentials"}
+	for _, ns := range namespaces {
+		if flag, ok := nsenterFlagMap[ns.Type]; ok {
+			nsenterArgs = append(nsenterArgs, flag)
+		}
+	}
+	nsenterArgs = append(nsenterArgs, "--", path)
+	return exec.Command("nsenter", append(nsenterArgs, args...)...)
+}
+
+// execChildCmd runs inside the namespaces and cgroup of a container. It receives the process to run
+// and the container seccomp filter from `box exec` and applies the same restrictions as the
+// container process before executing it.
+var execChildCmd = &cobra.Command{
+	Use:    "exec-child",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pipe := os.NewFile(parentPipeFD, "pipe")
+		spec := &specs.Spec{}
+		if err := json.NewDecoder(pipe).Decode(spec); err != nil {
+			return fmt.Errorf("failed to receive process: %w", err)
+		}
+		process := spec.Process
+		pipe.Close()
+
+		if err := SetRlimits(process.Rlimits); err != nil {
+			return err
+		}
+		if err := ApplySecurity(cmd.Context(), process, spec.Linux.Seccomp); err != nil {
+			return err
+		}
+		if process.Cwd != "" {
+			if err := syscall.Chdir(process.Cwd); err != nil {
+				return err
+			}
+		}
+		executable, err := ResolveExecutable(process.Args[0], process.Env)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Exec(executable, process.Args, process.Env); err != nil {
+			return fmt.Errorf("failed to execute process: %w", err)
+		}
+		return nil
+	},
+}
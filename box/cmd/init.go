@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// runInit runs the container process `process` from `executable` as a child, staying as PID 1 of
+// the container. Every signal it receives is forwarded to the child, and the processes orphaned
+// inside the container are reaped. It returns the exit code of the child once it has exited as an
+// ExitCodeError, which leaves the rest of the container to be killed along with PID 1.
+func runInit(executable string, process *specs.Process) error {
+	// without a PID namespace the orphans would go to the host init instead
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to become a subreaper: %w", err)
+	}
+
+	// PID 1 only receives the signals it has a handler for, so every signal is caught before the
+	// child exists to forward them to
+	signals := make(chan os.Signal, 128)
+	signal.Notify(signals)
+
+	attr := &syscall.ProcAttr{
+		Env:   process.Env,
+		Files: []uintptr{0, 1, 2},
+		Sys:   &syscall.SysProcAttr{},
+	}
+	// the child is the foreground process group of the terminal, so that it receives ^C from it
+	if process.Terminal {
+		attr.Sys.Foreground = true
+		attr.Sys.Ctty = 0
+	}
+	pid, err := syscall.ForkExec(executable, process.Args, attr)
+	if err != nil {
+		return fmt.Errorf("failed to execute container process: %w", err)
+	}
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+			if exitCode, exited := reapChildren(pid); exited {
+				return &ExitCodeError{Code: exitCode}
+			}
+		case syscall.SIGURG:
+			// used by the Go runtime to preempt goroutines
+		default:
+			syscall.Kill(pid, sig.(syscall.Signal))
+		}
+	}
+	return nil
+}
+
+// reapChildren waits for every child process which has exited, returning the exit code of `pid`
+// if it was one of them.
+func reapChildren(pid int) (int, bool) {
+	exitCode, exited := 0, false
+	for {
+		var status syscall.WaitStatus
+		reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || reaped <= 0 {
+			return exitCode, exited
+		}
+		if reaped == pid {
+			exitCode, exited = ExitCodeFromWaitStatus(status), true
+		}
+	}
+}
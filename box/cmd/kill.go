@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+)
+
+var killCmd = &cobra.Command{
+	Use:   "kill <container-id> [signal]",
+	Short: "send a signal to a container (default: SIGTERM)",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		signal := syscall.SIGTERM
+		if len(args) > 1 {
+			if signal, err = ParseSignal(args[1]); err != nil {
+				return err
+			}
+		}
+		if container.Status != specs.StateRunning && container.Status != specs.StateCreated && container.Status != StatePaused {
+			return fmt.Errorf("container %s is %s", container.ID, container.Status)
+		}
+		return container.Signal(signal)
+	},
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+)
+
+// monitorCmd owns a detached container for its whole life. It runs the container exactly as a
+// foreground `box run` would, but with its output going to a log file, and tears everything down
+// once the container exits.
+var monitorCmd = &cobra.Command{
+	Use:    "monitor container-id",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		if err := container.Update(func(stored *Container) error {
+			stored.MonitorPid, stored.MonitorStartTime = os.Getpid(), processStartTime(os.Getpid())
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// tell `box run --detach` or `box start` once the container is running
+		ready := os.NewFile(parentPipeFD, "ready")
+		defer ready.Close()
+		_, err = runContainer(ctx, container, nil, os.Stdout, os.Stderr, func() {
+			ready.Write([]byte{1})
+			ready.Close()
+		})
+		return err
+	},
+}
+
+// startMonitor launches a monitor process in its own session for `container` and waits until the
+// container is running. The output of both is appended to a log file in the container directory.
+func startMonitor(container *Container) error {
+	logPath := filepath.Join(containerPath(container.ID), logFile)
+	logOutput, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open container log: %w", err)
+	}
+	defer logOutput.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	monitorArgs := append(rootFlagArgs(), "monitor", container.ID)
+	monitor := exec.Command("/proc/self/exe", monitorArgs...)
+	monitor.Stdout = logOutput
+	monitor.Stderr = logOutput
+	monitor.ExtraFiles = []*os.File{w}
+	monitor.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := monitor.Start(); err != nil {
+		w.Close()
+		container.Update(func(stored *Container) error {
+			stored.Status = specs.StateStopped
+			return nil
+		})
+		return fmt.Errorf("failed to start container monitor: %w", err)
+	}
+	w.Close()
+
+	// the monitor writes a byte once the container is running, EOF means it gave up
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil {
+		monitor.Wait()
+		return fmt.Errorf("container %s failed to start, see %s", container.ID, logPath)
+	}
+	return monitor.Process.Release()
+}
+
+// restartable checks that a stopped container has been fully torn down so it can be started again.
+func restartable(container *Container) error {
+	if container.Status != specs.StateStopped {
+		return fmt.Errorf("container %s is %s", container.ID, container.Status)
+	}
+	if container.MonitorPid != 0 && processAlive(container.MonitorPid, container.MonitorStartTime) {
+		return fmt.Errorf("container %s is still stopping", container.ID)
+	}
+	return nil
+}
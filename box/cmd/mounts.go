@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// MountRequest is a mount asked for with `--volume` or `--mount`. Volumes are only created for it
+// when the runtime config is built.
+type MountRequest struct {
+	// Type is bind, volume or tmpfs
+	Type string `json:"type"`
+	// Source is the host path of a bind mount or the name of a volume, empty for an anonymous one
+	Source      string   `json:"source,omitempty"`
+	Destination string   `json:"destination"`
+	Options     []string `json:"options,omitempty"`
+	// NoCopy stops a new volume being populated with what the image has at the destination
+	NoCopy bool `json:"noCopy,omitempty"`
+}
+
+// ParseVolume parses a `--volume` flag. It is <host-path>:<container-path>[:<options>] for a bind
+// mount, <name>:<container-path>[:<options>] for a named volume or just <container-path> for an
+// anonymous volume. Host paths are made absolute and created if they don't exist.
+func ParseVolume(volume string) (*MountRequest, error) {
+	request := &MountRequest{Type: "volume"}
+	parts := strings.Split(volume, ":")
+	var options []string
+	switch len(parts) {
+	case 1:
+		request.Destination = parts[0]
+	case 3:
+		options = strings.Split(parts[2], ",")
+		fallthrough
+	case 2:
+		request.Source, request.Destination = parts[0], parts[1]
+	default:
+		return nil, fmt.Errorf("invalid volume %s, must be [<host-path>|<name>:]<container-path>[:<options>]", volume)
+	}
+	if !filepath.IsAbs(request.Destination) {
+		return nil, fmt.Errorf("invalid volume %s, the container path must be absolute", volume)
+	}
+	// volume names can't contain a slash
+	if strings.Contains(request.Source, "/") || request.Source == "." || request.Source == ".." {
+		request.Type = "bind"
+	}
+
+	bindOption, readonly, propagation := "rbind", false, ""
+	for _, option := range options {
+		if _, ok := mountPropagationMap[option]; ok {
+			propagation = option
+			continue
+		}
+		switch option {
+		case "ro", "readonly":
+			readonly = true
+		case "rw":
+			readonly = false
+		case "bind", "rbind":
+			bindOption = option
+		case "nocopy":
+			request.NoCopy = true
+		case "z", "Z":
+			// relabelling is only needed with SELinux, which box doesn't use
+		default:
+			return nil, fmt.Errorf("unsupported volume option %s", option)
+		}
+	}
+	request.Options = []string{bindOption}
+	if readonly {
+		request.Options = append(request.Options, "ro")
+	}
+	if propagation != "" {
+		request.Options = append(request.Options, propagation)
+	}
+
+	if request.Type == "bind" {
+		source, err := filepath.Abs(request.Source)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(source, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create bind mount source %s: %w", source, err)
+		}
+		request.Source = source
+	}
+	return request, nil
+}
+
+// ParseMount parses a `--mount` flag, which is a comma separated list of <key>=<value> fields in
+// the same format as Docker. The type is volume unless it is given, and a bind mount source must
+// exist.
+func ParseMount(mount string) (*MountRequest, error) {
+	request := &MountRequest{Type: "volume"}
+	readonly, propagation := false, ""
+	var tmpfsOptions []string
+	for _, field := range strings.Split(mount, ",") {
+		key, value, hasValue := strings.Cut(field, "=")
+		var err error
+		switch strings.ToLower(key) {
+		case "type":
+			request.Type = value
+		case "source", "src":
+			request.Source = value
+		case "destination", "dst", "target":
+			request.Destination = value
+		case "readonly", "ro":
+			readonly, err = parseBoolField(value, hasValue)
+		case "bind-propagation":
+			if _, ok := mountPropagationMap[value]; !ok {
+				err = fmt.Errorf("unknown propagation %s", value)
+			}
+			propagation = value
+		case "volume-nocopy":
+			request.NoCopy, err = parseBoolField(value, hasValue)
+		case "tmpfs-size":
+			tmpfsOptions = append(tmpfsOptions, "size="+value)
+		case "tmpfs-mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			tmpfsOptions = append(tmpfsOptions, fmt.Sprintf("mode=%o", mode))
+		default:
+			return nil, fmt.Errorf("unsupported mount field %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount field %s: %w", field, err)
+		}
+	}
+	if !filepath.IsAbs(request.Destination) {
+		return nil, fmt.Errorf("invalid mount %s, the target must be an absolute path", mount)
+	}
+	if len(tmpfsOptions) > 0 && request.Type != "tmpfs" {
+		return nil, fmt.Errorf("invalid mount %s, tmpfs fields need type=tmpfs", mount)
+	}
+	if propagation != "" && request.Type != "bind" {
+		return nil, fmt.Errorf("invalid mount %s, bind-propagation needs type=bind", mount)
+	}
+	if request.NoCopy && request.Type != "volume" {
+		return nil, fmt.Errorf("invalid mount %s, volume-nocopy needs type=volume", mount)
+	}
+
+	switch request.Type {
+	case "bind":
+		if request.Source == "" {
+			return nil, fmt.Errorf("invalid mount %s, a bind mount needs a source", mount)
+		}
+		source, err := filepath.Abs(request.Source)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(source); err != nil {
+			return nil, fmt.Errorf("invalid bind mount source: %w", err)
+		}
+		request.Source = source
+		request.Options = []string{"rbind"}
+	case "volume":
+		request.Options = []string{"rbind"}
+	case "tmpfs":
+		if request.Source != "" {
+			return nil, fmt.Errorf("invalid mount %s, a tmpfs mount has no source", mount)
+		}
+		request.Options = append([]string{"nosuid", "nodev", "noexec"}, tmpfsOptions...)
+	default:
+		return nil, fmt.Errorf("unsupported mount type %s, must be bind, volume or tmpfs", request.Type)
+	}
+	if readonly {
+		request.Options = append(request.Options, "ro")
+	}
+	if propagation != "" {
+		request.Options = append(request.Options, propagation)
+	}
+	return request, nil
+}
+
+// parseBoolField parses the value of a `--mount` field which is true when it has no value.
+func parseBoolField(value string, hasValue bool) (bool, error) {
+	if !hasValue {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// resolveMount returns the mount in the runtime config of container `containerId` for `request`,
+// creating the volume it uses if it doesn't exist yet. A new volume is populated with what the
+// image in `rootfs` has at the destination, unless the request says not to.
+func resolveMount(ctx context.Context, request MountRequest, containerId string, rootfs string) (specs.Mount, error) {
+	m := specs.Mount{Destination: request.Destination, Type: request.Type, Source: request.Source, Options: request.Options}
+	switch request.Type {
+	case "tmpfs":
+		m.Source = "tmpfs"
+	case "volume":
+		name, owner := request.Source, ""
+		if name == "" {
+			name, owner = anonymousVolumeName(containerId, request.Destination), containerId
+		}
+		volume, created, err := CreateVolume(name, owner)
+		if err != nil {
+			return specs.Mount{}, err
+		}
+		if created && !request.NoCopy {
+			if err := populateVolume(ctx, volume, rootfs, request.Destination); err != nil {
+				os.RemoveAll(volumePath(volume.Name))
+				return specs.Mount{}, fmt.Errorf("failed to populate volume %s: %w", volume.Name, err)
+			}
+		}
+		m.Type, m.Source = "bind", volume.Mountpoint
+	}
+	return m, nil
+}
+
+// anonymousVolumeName is the same for every start of a container, so that its anonymous volumes
+// keep their contents like its writable layer does.
+func anonymousVolumeName(containerId string, destination string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(destination)))
+	return containerId + "-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// populateVolume copies the contents of `destination` in `rootfs` into a new volume, so that
+// mounting it doesn't hide what the image has there.
+func populateVolume(ctx context.Context, volume *Volume, rootfs string, destination string) error {
+	source, err := SecureJoin(rootfs, destination)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(source)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return applyLayer(ctx, source, volume.Mountpoint)
+}
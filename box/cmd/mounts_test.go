@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	host := t.TempDir()
+
+	tests := []struct {
+		volume  string
+		want    MountRequest
+		wantErr bool
+	}{
+		// anonymous volumes
+		{volume: "/data", want: MountRequest{Type: "volume", Destination: "/data", Options: []string{"rbind"}}},
+
+		// named volumes
+		{volume: "data:/data", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind"}}},
+		{volume: "data:/data:ro", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind", "ro"}}},
+		{volume: "data:/data:nocopy", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind"}, NoCopy: true}},
+		{volume: "data:/data:readonly,rw", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind"}}},
+
+		// bind mounts
+		{volume: host + ":/data", want: MountRequest{Type: "bind", Source: host, Destination: "/data", Options: []string{"rbind"}}},
+		{volume: host + ":/data:ro,bind", want: MountRequest{Type: "bind", Source: host, Destination: "/data", Options: []string{"bind", "ro"}}},
+		{volume: host + ":/data:z,rslave", want: MountRequest{Type: "bind", Source: host, Destination: "/data", Options: []string{"rbind", "rslave"}}},
+		{volume: host + ":/data:shared,private", want: MountRequest{Type: "bind", Source: host, Destination: "/data", Options: []string{"rbind", "private"}}},
+		{volume: host + "/new/dir:/data", want: MountRequest{Type: "bind", Source: host + "/new/dir", Destination: "/data", Options: []string{"rbind"}}},
+
+		{volume: "", wantErr: true},
+		{volume: "data", wantErr: true},
+		{volume: "data:data", wantErr: true},
+		{volume: "data:/data:exec", wantErr: true},
+		{volume: "data:/data:ro:extra", wantErr: true},
+		{volume: host + ":/data:", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.ReplaceAll(test.volume, host, "<host>"), func(t *testing.T) {
+			got, err := ParseVolume(test.volume)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v, want %+v", *got, test.want)
+			}
+			// bind mount sources are created
+			if got.Type == "bind" {
+				if info, err := os.Stat(got.Source); err != nil || !info.IsDir() {
+					t.Errorf("expected bind mount source %s to be a directory: %v", got.Source, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseVolumeRelativeSource(t *testing.T) {
+	t.Chdir(t.TempDir())
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{".", "..", "./data", "data/sub"} {
+		t.Run(source, func(t *testing.T) {
+			got, err := ParseVolume(source + ":/data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(cwd, source); got.Type != "bind" || got.Source != want {
+				t.Errorf("got %s source %s, want a bind source %s", got.Type, got.Source, want)
+			}
+		})
+	}
+}
+
+func TestParseMount(t *testing.T) {
+	host := t.TempDir()
+
+	tests := []struct {
+		mount   string
+		want    MountRequest
+		wantErr bool
+	}{
+		// volumes
+		{mount: "target=/data", want: MountRequest{Type: "volume", Destination: "/data", Options: []string{"rbind"}}},
+		{mount: "type=volume,src=data,dst=/data", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind"}}},
+		{mount: "source=data,destination=/data,readonly", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind", "ro"}}},
+		{mount: "source=data,target=/data,ro=false", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind"}}},
+		{mount: "src=data,target=/data,volume-nocopy", want: MountRequest{Type: "volume", Source: "data", Destination: "/data", Options: []string{"rbind"}, NoCopy: true}},
+		{mount: "Type=volume,Target=/data", want: MountRequest{Type: "volume", Destination: "/data", Options: []string{"rbind"}}},
+
+		// bind mounts
+		{mount: "type=bind,src=" + host + ",dst=/data", want: MountRequest{Type: "bind", Source: host, Destination: "/data", Options: []string{"rbind"}}},
+		{
+			mount: "type=bind,src=" + host + ",dst=/data,ro=true,bind-propagation=rshared",
+			want:  MountRequest{Type: "bind", Source: host, Destination: "/data", Options: []string{"rbind", "ro", "rshared"}},
+		},
+
+		// tmpfs mounts
+		{mount: "type=tmpfs,dst=/tmp", want: MountRequest{Type: "tmpfs", Destination: "/tmp", Options: []string{"nosuid", "nodev", "noexec"}}},
+		{
+			mount: "type=tmpfs,dst=/tmp,tmpfs-size=64m,tmpfs-mode=1777,ro",
+			want:  MountRequest{Type: "tmpfs", Destination: "/tmp", Options: []string{"nosuid", "nodev", "noexec", "size=64m", "mode=1777", "ro"}},
+		},
+
+		{mount: "", wantErr: true},
+		{mount: "src=data", wantErr: true},
+		{mount: "target=data", wantErr: true},
+		{mount: "target=/data,foo=bar", wantErr: true},
+		{mount: "type=overlay,target=/data", wantErr: true},
+		{mount: "target=/data,readonly=maybe", wantErr: true},
+		{mount: "type=bind,target=/data", wantErr: true},
+		{mount: "type=bind,src=" + host + "/missing,target=/data", wantErr: true},
+		{mount: "type=bind,src=" + host + ",target=/data,bind-propagation=sideways", wantErr: true},
+		{mount: "src=data,target=/data,bind-propagation=rshared", wantErr: true},
+		{mount: "type=bind,src=" + host + ",target=/data,volume-nocopy", wantErr: true},
+		{mount: "type=tmpfs,src=data,target=/tmp", wantErr: true},
+		{mount: "type=tmpfs,target=/tmp,tmpfs-mode=999", wantErr: true},
+		{mount: "target=/data,tmpfs-size=64m", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.ReplaceAll(test.mount, host, "<host>"), func(t *testing.T) {
+			got, err := ParseMount(test.mount)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	bridgeName        = "bridge-box"
+	ContainerVethName = "eth0"
+	defaultSubnet     = "10.0.0.0/24"
+	networkFolder     = "network"
+	ipamFile          = "ipam.json"
+	ipamLockFile      = "ipam.lock"
+)
+
+// the host side of the bridge network, which tests replace
+var (
+	setupBridge    = ensureBridge
+	teardownBridge = deleteBridge
+	ipForwardFile  = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// ContainerNetwork is the network configuration allocated to a single container.
+type ContainerNetwork struct {
+	IP       string `json:"ip"`
+	Gateway  string `json:"gateway"`
+	Prefix   int    `json:"prefix"`
+	HostVeth string `json:"hostVeth"`
+}
+
+// CIDR returns the container address in CIDR notation.
+func (n *ContainerNetwork) CIDR() string {
+	return fmt.Sprintf("%s/%d", n.IP, n.Prefix)
+}
+
+// ipamState is shared by every container on the host and persisted to disk. The bridge lives for
+// as long as there are allocations, so the allocations double as its reference count.
+type ipamState struct {
+	// Subnet is the subnet of the bridge, empty when there is no bridge
+	Subnet      string            `json:"subnet"`
+	Allocations map[string]string `json:"allocations"`
+	// IPForward is the value of ip_forward before the first container enabled it
+	IPForward int `json:"ipForward"`
+}
+
+// AllocateNetwork assigns container `containerId` an address from `subnet`. The first container
+// to allocate an address also creates the shared bridge and enables IP forwarding.
+func AllocateNetwork(ctx context.Context, containerId string, subnet string) (*ContainerNetwork, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %w", subnet, err)
+	}
+	prefix, bits := ipNet.Mask.Size()
+	if bits != 32 || prefix > 30 {
+		return nil, fmt.Errorf("subnet must be an IPv4 network of at least 4 addresses: %s", subnet)
+	}
+	gateway := nthAddress(ipNet, 1)
+
+	var network *ContainerNetwork
+	err = withIPAM(func(state *ipamState) error {
+		if _, ok := state.Allocations[containerId]; ok {
+			return fmt.Errorf("container %s already has an address allocated", containerId)
+		}
+		if err := pruneNetwork(state); err != nil {
+			Logger(ctx).Warn("failed to remove the bridge network", "err", err)
+		}
+
+		// first container sets up the bridge, which is removed again if the setup fails as the
+		// state is only saved on success
+		if len(state.Allocations) == 0 {
+			if err := setupBridge(gateway, prefix); err != nil {
+				teardownBridge()
+				return err
+			}
+			ipForward, err := enableIPForward()
+			if err != nil {
+				teardownBridge()
+				return fmt.Errorf("failed to enable IP forwarding: %w", err)
+			}
+			state.Subnet = ipNet.String()
+			state.IPForward = ipForward
+		} else if state.Subnet != ipNet.String() {
+			return fmt.Errorf("bridge is already in use with subnet %s", state.Subnet)
+		}
+
+		// find a free address, skipping the network, gateway and broadcast addresses
+		used := map[string]bool{}
+		for _, ip := range state.Allocations {
+			used[ip] = true
+		}
+		size := 1 << (bits - prefix)
+		for i := 2; i < size-1; i++ {
+			ip := nthAddress(ipNet, i).String()
+			if !used[ip] {
+				state.Allocations[containerId] = ip
+				network = &ContainerNetwork{
+					IP:       ip,
+					Gateway:  gateway.String(),
+					Prefix:   prefix,
+					HostVeth: hostVethName(containerId),
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("no free addresses left in subnet %s", state.Subnet)
+	})
+	return network, err
+}
+
+// ReleaseNetwork returns the address of container `containerId` to the pool. The last container to
+// release its address also removes the bridge and restores IP forwarding. The address is released
+// even if that fails, which is only logged.
+func ReleaseNetwork(ctx context.Context, containerId string) error {
+	return withIPAM(func(state *ipamState) error {
+		delete(state.Allocations, containerId)
+		if err := pruneNetwork(state); err != nil {
+			Logger(ctx).Warn("failed to remove the bridge network", "err", err)
+		}
+		return nil
+	})
+}
+
+// pruneNetwork drops the addresses of containers which no longer exist, whose monitor died before
+// releasing them. Once no addresses are left it removes the bridge and restores IP forwarding.
+func pruneNetwork(state *ipamState) error {
+	for id := range state.Allocations {
+		if _, err := os.Stat(containerPath(id)); errors.Is(err, os.ErrNotExist) {
+			delete(state.Allocations, id)
+		}
+	}
+	if len(state.Allocations) > 0 || state.Subnet == "" {
+		return nil
+	}
+	// the bridge is forgotten even if it can't be removed, setting it up again replaces it
+	state.Subnet = ""
+	return errors.Join(
+		teardownBridge(),
+		os.WriteFile(ipForwardFile, []byte(strconv.Itoa(state.IPForward)), 0644),
+	)
+}
+
+// ConnectContainer creates the veth pair for a container, placing one end inside the network
+// namespace of process `pid` and attaching the other to the bridge.
+func ConnectContainer(network *ContainerNetwork, pid int) error {
+	bridgeLink, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge interface: %w", err)
+	}
+	// create veth pair with the container end directly inside the container network namespace
+	hostVethAttrs := netlink.NewLinkAttrs()
+	hostVethAttrs.Name = network.HostVeth
+	hostVethAttrs.MasterIndex = bridgeLink.Attrs().Index
+	veth := &netlink.Veth{
+		LinkAttrs:     hostVethAttrs,
+		PeerName:      ContainerVethName,
+		PeerNamespace: netlink.NsPid(pid),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create container veth pair: %w", err)
+	}
+	hostVethLink, err := netlink.LinkByName(network.HostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth interface: %w", err)
+	}
+	if err := netlink.LinkSetUp(hostVethLink); err != nil {
+		return fmt.Errorf("failed to set host veth UP: %w", err)
+	}
+	return nil
+}
+
+// DisconnectContainer removes the host end of a container's veth pair, which destroys the
+// container end too.
+func DisconnectContainer(network *ContainerNetwork) {
+	if hostVethLink, err := netlink.LinkByName(network.HostVeth); err == nil {
+		netlink.LinkDel(hostVethLink)
+	}
+}
+
+func ensureBridge(gateway net.IP, prefix int) error {
+	bridgeLink, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		bridgeAttrs := netlink.NewLinkAttrs()
+		bridgeAttrs.Name = bridgeName
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: bridgeAttrs}); err != nil {
+			return fmt.Errorf("failed to create bridge interface: %w", err)
+		}
+		if bridgeLink, err = netlink.LinkByName(bridgeName); err != nil {
+			return fmt.Errorf("failed to find bridge interface: %w", err)
+		}
+	}
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   gateway,
+			Mask: net.CIDRMask(prefix, 32),
+		},
+	}
+	if err := netlink.AddrReplace(bridgeLink, addr); err != nil {
+		return fmt.Errorf("failed to add IP address to bridge %s: %w", gateway, err)
+	}
+	if err := netlink.LinkSetUp(bridgeLink); err != nil {
+		return fmt.Errorf("failed to set bridge UP: %w", err)
+	}
+	return nil
+}
+
+// deleteBridge removes the bridge, if it exists.
+func deleteBridge() error {
+	bridgeLink, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil
+	}
+	if err := netlink.LinkDel(bridgeLink); err != nil {
+		return fmt.Errorf("failed to delete bridge: %w", err)
+	}
+	return nil
+}
+
+// withIPAM runs `fn` on the IPAM state while holding an exclusive lock, saving any changes after.
+func withIPAM(fn func(state *ipamState) error) error {
+	networkPath := filepath.Join(stateRoot, networkFolder)
+	if err := os.MkdirAll(networkPath, 0755); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(networkPath, ipamLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock IPAM state: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	statePath := filepath.Join(networkPath, ipamFile)
+	state := &ipamState{}
+	data, err := os.ReadFile(statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, state); err != nil {
+			return fmt.Errorf("failed to decode IPAM state: %w", err)
+		}
+	}
+	if state.Allocations == nil {
+		state.Allocations = map[string]string{}
+	}
+
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, data, 0644)
+}
+
+// enableIPForward turns on IP forwarding and returns its previous value.
+func enableIPForward() (int, error) {
+	data, err := os.ReadFile(ipForwardFile)
+	if err != nil {
+		return 0, err
+	}
+	ipForwardEnabled, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, err
+	}
+	if ipForwardEnabled != 1 {
+		if err := os.WriteFile(ipForwardFile, []byte("1"), 0644); err != nil {
+			return ipForwardEnabled, err
+		}
+	}
+	return ipForwardEnabled, nil
+}
+
+// hostVethName derives a unique interface name for the host end of a container's veth pair.
+// Interface names are limited to 15 characters so the container ID is hashed.
+func hostVethName(containerId string) string {
+	sum := sha256.Sum256([]byte(containerId))
+	return "veth" + hex.EncodeToString(sum[:])[:8]
+}
+
+func nthAddress(ipNet *net.IPNet, n int) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ipNet.IP.To4())+uint32(n))
+	return ip
+}
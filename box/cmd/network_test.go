@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testNetwork points the IPAM state at a temporary state root and replaces the bridge with a
+// stub, which returns `bridgeErr` when it is removed. It returns whether the bridge is up.
+func testNetwork(t *testing.T, bridgeErr error) *bool {
+	t.Helper()
+
+	bridgeUp := false
+	root := t.TempDir()
+	ipForward := filepath.Join(root, "ip_forward")
+	if err := os.WriteFile(ipForward, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRoot, oldSetup, oldTeardown, oldIPForward := stateRoot, setupBridge, teardownBridge, ipForwardFile
+	t.Cleanup(func() {
+		stateRoot, setupBridge, teardownBridge, ipForwardFile = oldRoot, oldSetup, oldTeardown, oldIPForward
+	})
+	stateRoot, ipForwardFile = root, ipForward
+	setupBridge = func(gateway net.IP, prefix int) error {
+		bridgeUp = true
+		return nil
+	}
+	teardownBridge = func() error {
+		if bridgeErr != nil {
+			return bridgeErr
+		}
+		bridgeUp = false
+		return nil
+	}
+	return &bridgeUp
+}
+
+// addTestContainer creates the state directory of container `containerId`, as allocations of
+// containers which don't exist are released.
+func addTestContainer(t *testing.T, containerId string) {
+	t.Helper()
+	if err := os.MkdirAll(containerPath(containerId), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readIPForward(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile(ipForwardFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestAllocateNetwork(t *testing.T) {
+	bridgeUp := testNetwork(t, nil)
+
+	var ips []string
+	for _, id := range []string{"a", "b", "c"} {
+		addTestContainer(t, id)
+		network, err := AllocateNetwork(t.Context(), id, "10.1.0.0/29")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if network.Gateway != "10.1.0.1" || network.Prefix != 29 || network.HostVeth != hostVethName(id) {
+			t.Errorf("got network %+v", network)
+		}
+		ips = append(ips, network.IP)
+	}
+	if want := []string{"10.1.0.2", "10.1.0.3", "10.1.0.4"}; strings.Join(ips, " ") != strings.Join(want, " ") {
+		t.Errorf("got addresses %v, want %v", ips, want)
+	}
+	if !*bridgeUp || readIPForward(t) != "1" {
+		t.Errorf("bridge up %t, ip_forward %s after allocating", *bridgeUp, readIPForward(t))
+	}
+
+	if _, err := AllocateNetwork(t.Context(), "a", "10.1.0.0/29"); err == nil {
+		t.Error("expected an error allocating a second address to a container")
+	}
+	addTestContainer(t, "d")
+	if _, err := AllocateNetwork(t.Context(), "d", "10.2.0.0/29"); err == nil || !strings.Contains(err.Error(), "already in use with subnet 10.1.0.0/29") {
+		t.Errorf("got error %v allocating from another subnet", err)
+	}
+
+	// a released address is the first to be allocated again
+	if err := ReleaseNetwork(t.Context(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	network, err := AllocateNetwork(t.Context(), "d", "10.1.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.IP != "10.1.0.3" {
+		t.Errorf("got address %s, want the released 10.1.0.3", network.IP)
+	}
+
+	// the last release removes the bridge and restores ip_forward
+	for _, id := range []string{"a", "c", "d"} {
+		if err := ReleaseNetwork(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *bridgeUp || readIPForward(t) != "0" {
+		t.Errorf("bridge up %t, ip_forward %s after releasing", *bridgeUp, readIPForward(t))
+	}
+
+	// with the bridge gone any subnet can be used
+	if _, err := AllocateNetwork(t.Context(), "a", "10.2.0.0/29"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateNetworkExhausted(t *testing.T) {
+	testNetwork(t, nil)
+
+	// a /30 has the network, gateway and broadcast addresses and one for a container
+	addTestContainer(t, "a")
+	addTestContainer(t, "b")
+	if _, err := AllocateNetwork(t.Context(), "a", "10.1.0.0/30"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AllocateNetwork(t.Context(), "b", "10.1.0.0/30"); err == nil || !strings.Contains(err.Error(), "no free addresses") {
+		t.Fatalf("got error %v, want no free addresses", err)
+	}
+
+	// the address of a container which was removed without releasing it can be used again
+	if err := os.RemoveAll(containerPath("a")); err != nil {
+		t.Fatal(err)
+	}
+	network, err := AllocateNetwork(t.Context(), "b", "10.1.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.IP != "10.1.0.2" {
+		t.Errorf("got address %s, want 10.1.0.2", network.IP)
+	}
+}
+
+func TestAllocateNetworkInvalidSubnet(t *testing.T) {
+	testNetwork(t, nil)
+
+	for _, subnet := range []string{"10.1.0.0", "10.1.0.0/31", "fd00::/64"} {
+		if _, err := AllocateNetwork(t.Context(), "a", subnet); err == nil {
+			t.Errorf("expected an error allocating from %s", subnet)
+		}
+	}
+}
+
+func TestReleaseNetworkTeardownFailure(t *testing.T) {
+	bridgeUp := testNetwork(t, errors.New("failed to delete bridge"))
+
+	addTestContainer(t, "a")
+	if _, err := AllocateNetwork(t.Context(), "a", "10.1.0.0/29"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseNetwork(t.Context(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if !*bridgeUp {
+		t.Fatal("expected the stub bridge to still be up")
+	}
+
+	// the address is released anyway, and the bridge is set up again for the next container
+	addTestContainer(t, "b")
+	network, err := AllocateNetwork(t.Context(), "b", "10.2.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.IP != "10.2.0.2" {
+		t.Errorf("got address %s, want 10.2.0.2", network.IP)
+	}
+}
+
+func TestNthAddress(t *testing.T) {
+	tests := []struct {
+		subnet string
+		n      int
+		want   string
+	}{
+		{"10.0.0.0/24", 0, "10.0.0.0"},
+		{"10.0.0.0/24", 1, "10.0.0.1"},
+		{"10.0.0.0/24", 255, "10.0.0.255"},
+		{"10.0.0.0/16", 256, "10.0.1.0"},
+		{"172.16.254.0/23", 300, "172.16.255.44"},
+	}
+
+	for _, test := range tests {
+		_, ipNet, err := net.ParseCIDR(test.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nthAddress(ipNet, test.n).String(); got != test.want {
+			t.Errorf("nthAddress(%s, %d): got %s, want %s", test.subnet, test.n, got, test.want)
+		}
+	}
+}
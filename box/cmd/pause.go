@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause <container-id>",
+	Short: "freeze every process in a running container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		if container.Status != specs.StateRunning {
+			return fmt.Errorf("container %s is %s", container.ID, container.Status)
+		}
+		return pauseContainer(cmd.Context(), container, true)
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume <container-id>",
+	Short: "thaw every process in a paused container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		if container.Status != StatePaused {
+			return fmt.Errorf("container %s is %s", container.ID, container.Status)
+		}
+		return pauseContainer(cmd.Context(), container, false)
+	},
+}
+
+// pauseContainer freezes the cgroup of `container` if `paused` is set, otherwise it thaws it, and
+// saves the container as paused or running.
+func pauseContainer(ctx context.Context, container *Container, paused bool) error {
+	cgroupManager, err := LoadCgroupManager(container)
+	if err != nil {
+		return err
+	}
+	action, status, eventType := "resume", specs.StateRunning, EventResumed
+	if paused {
+		action, status, eventType = "pause", StatePaused, EventPaused
+	}
+	if err := cgroupManager.Freeze(ctx, paused); err != nil {
+		return fmt.Errorf("failed to %s container %s: %w", action, container.ID, err)
+	}
+
+	if err := container.Update(func(stored *Container) error {
+		stored.Status = status
+		return nil
+	}); err != nil {
+		return err
+	}
+	EmitEvent(ctx, container, eventType)
+	return nil
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var psFormat string
+
+func init() {
+	psCmd.Flags().StringVar(&psFormat, "format", "table", "Output format (table or json)")
+}
+
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "list containers",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		containers, err := ListContainers()
+		if err != nil {
+			return fmt.Errorf("failed to list containers: %w", err)
+		}
+
+		switch psFormat {
+		case "json":
+			if containers == nil {
+				containers = []*Container{}
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(containers)
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "CONTAINER ID\tSTATUS\tPID\tIP\tCGROUP\tCREATED\tBUNDLE")
+			for _, c := range containers {
+				ip := "-"
+				if c.Network != nil {
+					ip = c.Network.IP
+				}
+				// the cgroupfs manager has no unit
+				cgroup := c.CgroupUnit
+				if cgroup == "" {
+					cgroup = c.CgroupPath
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", c.ID, c.Status, c.Pid, ip, cgroup, c.Created.Format(time.DateTime), c.Bundle)
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown output format %s", psFormat)
+		}
+	},
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Console is a pseudoterminal for a container process. The process gets the slave end as its
+// stdio and controlling terminal, while box copies between the master end and the host stdio.
+type Console struct {
+	master *os.File
+	Slave  *os.File
+
+	// host terminal, if stdin is one
+	terminal      int
+	terminalState *unix.Termios
+	sigChan       chan os.Signal
+	outputDone    chan struct{}
+}
+
+// NewConsole allocates a new pseudoterminal pair.
+func NewConsole() (*Console, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pty master: %w", err)
+	}
+	// unlock the slave and find its number
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetUint32(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open pty slave: %w", err)
+	}
+	return &Console{master: master, Slave: slave, terminal: -1}, nil
+}
+
+// Attach starts copying between the console and the host's `stdin` and `stdout`. It must be called
+// once the process has been started with the slave end, which is closed here. When `stdin` is a
+// terminal it is put into raw mode and its window size is kept in sync with the console.
+func (c *Console) Attach(stdin io.Reader, stdout io.Writer) error {
+	c.Slave.Close()
+
+	if f, ok := stdin.(*os.File); ok && IsTerminal(int(f.Fd())) {
+		c.terminal = int(f.Fd())
+		state, err := MakeRaw(c.terminal)
+		if err != nil {
+			return fmt.Errorf("failed to put terminal into raw mode: %w", err)
+		}
+		c.terminalState = state
+
+		// forward window size changes
+		c.sigChan = make(chan os.Signal, 1)
+		signal.Notify(c.sigChan, syscall.SIGWINCH)
+		c.resize()
+		go func() {
+			for range c.sigChan {
+				c.resize()
+			}
+		}()
+	}
+
+	if stdin != nil {
+		go io.Copy(c.master, stdin)
+	}
+	c.outputDone = make(chan struct{})
+	go func() {
+		// ends with EIO once every process holding the slave end has exited
+		io.Copy(stdout, c.master)
+		close(c.outputDone)
+	}()
+	return nil
+}
+
+// consoleDrainTimeout is how long Close waits for the remaining output of the console, which
+// never ends while a process left behind by the container still holds the slave end.
+const consoleDrainTimeout = time.Second
+
+// Close restores the host terminal and waits a short while for the remaining output of the
+// console. It is called once the container process has exited.
+func (c *Console) Close() {
+	if c.sigChan != nil {
+		signal.Stop(c.sigChan)
+		close(c.sigChan)
+	}
+	if c.terminalState != nil {
+		RestoreTerminal(c.terminal, c.terminalState)
+	}
+	c.Slave.Close()
+	if c.outputDone != nil {
+		select {
+		case <-c.outputDone:
+		case <-time.After(consoleDrainTimeout):
+		}
+	}
+	// stops the copy if it is still running
+	c.master.Close()
+}
+
+func (c *Console) resize() {
+	ws, err := unix.IoctlGetWinsize(c.terminal, unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	unix.IoctlSetWinsize(int(c.master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// IsTerminal returns whether `fd` refers to a terminal.
+func IsTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err == nil
+}
+
+// MakeRaw puts the terminal `fd` into raw mode, as cfmakeraw(3) does, and returns its previous
+// state.
+func MakeRaw(fd int) (*unix.Termios, error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	state := *termios
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// RestoreTerminal returns the terminal `fd` to a state saved by MakeRaw.
+func RestoreTerminal(fd int, state *unix.Termios) error {
+	return unix.IoctlSetTermios(fd, unix.TCSETS, state)
+}
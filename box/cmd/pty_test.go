@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer which the console can write to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConsoleClose(t *testing.T) {
+	console, err := NewConsole()
+	if err != nil {
+		t.Skip("no pseudoterminals:", err)
+	}
+	// a process left behind by the container keeps the slave end open
+	slave, err := os.OpenFile(console.Slave.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slave.Close()
+
+	var output syncBuffer
+	if err := console.Attach(nil, &output); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slave.WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	console.Close()
+	if elapsed := time.Since(start); elapsed > 2*consoleDrainTimeout {
+		t.Errorf("Close took %s", elapsed)
+	}
+	if output.String() != "hello" {
+		t.Errorf("got output %q, want %q", output.String(), "hello")
+	}
+}
@@ -2,57 +2,67 @@ package cmd
 
 import (
 	"archive/tar"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	rootfsFolder = "rootfs"
 	configFile   = "config.json"
+
+	// imageDigestAnnotation records which image in the store a bundle was created from
+	imageDigestAnnotation = "box.image.digest"
+	// stopSignalAnnotation is the signal to stop a container with, from the image config
+	stopSignalAnnotation = "org.opencontainers.image.stopSignal"
 )
 
 var pullCmd = &cobra.Command{
-	Use:   "pull uri runtime-bundle-path",
-	Short: "pull a remote image and write a container runtime bundle to disk",
-	Args:  cobra.ExactArgs(2),
+	Use:   "pull uri [runtime-bundle-path]",
+	Short: "pull a remote image into the local store and optionally write a container runtime bundle to disk",
+	Args:  cobra.RangeArgs(1, 2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		imageURI := args[0]
-		savePath := args[1]
-
 		ctx := cmd.Context()
+
+		// without root, pull inside a user namespace so the layers can have files of any owner
+		if os.Geteuid() != 0 {
+			return runInUserNamespace(ctx)
+		}
+
 		log := Logger(ctx)
 
-		// pull image
-		log.Info("Pulling image", "image", imageURI)
-		image, err := crane.Pull(imageURI, crane.WithPlatform(&v1.Platform{
-			Architecture: "amd64",
-			OS:           "linux",
-		}))
+		store, err := OpenStore(stateRoot)
 		if err != nil {
-			return fmt.Errorf("failed to pull image: %w", err)
+			return err
 		}
-		mediaType, err := image.MediaType()
+
+		// pull image into the store
+		log.Info("Pulling image", "image", imageURI)
+		image, err := store.Pull(imageURI)
 		if err != nil {
-			return fmt.Errorf("image has no media type: %w", err)
+			return fmt.Errorf("failed to pull image: %w", err)
 		}
-		if !mediaType.IsImage() {
-			return errors.New("the provided URI does not reference an image")
+		if len(args) < 2 {
+			return nil
 		}
+		savePath := args[1]
 
-		// extract rootfs to disk
-		log.Info("Extracting rootfs", "savePath", savePath)
-		if err := extractRootFS(image, savePath); err != nil {
-			return fmt.Errorf("failed to extract image rootfs: %w", err)
+		// assemble rootfs from the unpacked layers in the store
+		log.Info("Creating rootfs", "savePath", savePath)
+		if err := store.CreateRootFS(ctx, image, filepath.Join(savePath, rootfsFolder)); err != nil {
+			return fmt.Errorf("failed to create rootfs: %w", err)
 		}
 
 		// write runtime config
@@ -65,73 +75,120 @@ var pullCmd = &cobra.Command{
 	},
 }
 
-func extractRootFS(image v1.Image, path string) error {
-	layers, err := image.Layers()
-	if err != nil {
-		return fmt.Errorf("failed to get image layers: %w", err)
-	}
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+	// userOpaqueXattr is used in a user namespace, where trusted xattrs can't be set. It is what
+	// overlayfs reads instead with the userxattr mount option
+	userOpaqueXattr = "user.overlay.opaque"
+)
 
-	base := filepath.Join(path, rootfsFolder)
-	if err := os.MkdirAll(base, 0755); err != nil {
+// extractLayer unpacks a single image layer into the empty directory `base`. Whiteout entries
+// (`.wh.<name>`) and opaque markers (`.wh..wh..opq`) are converted into their overlayfs form, a
+// 0/0 character device and the `trusted.overlay.opaque` xattr (`user.overlay.opaque` in a user
+// namespace) respectively, so that the directory can be used as an overlay lower dir or applied
+// on top of the layers below it with applyLayer.
+// See: https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+func extractLayer(ctx context.Context, layer v1.Layer, base string) error {
+	ur, err := layer.Uncompressed()
+	if err != nil {
 		return err
 	}
+	defer ur.Close()
 
-	for _, layer := range layers {
-		ur, err := layer.Uncompressed()
+	tr := tar.NewReader(ur)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
 			return err
 		}
-		defer ur.Close()
 
-		tr := tar.NewReader(ur)
-		for {
-			header, err := tr.Next()
-			if errors.Is(err, io.EOF) {
-				break
+		target, err := layerPath(base, header.Name)
+		if err != nil {
+			return err
+		}
+
+		// layers are not required to include entries for parent directories
+		dir, name := filepath.Split(target)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		// handle whiteouts
+		if name == whiteoutOpaque {
+			xattr := opaqueXattr
+			if InUserNamespace() {
+				xattr = userOpaqueXattr
 			}
-			if err != nil {
+			if err := unix.Setxattr(dir, xattr, []byte("y"), 0); err != nil {
+				return fmt.Errorf("failed to mark directory opaque %s: %w", header.Name, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			deleted := filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix))
+			if err := unix.Mknod(deleted, unix.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("failed to create whiteout %s: %w", header.Name, err)
+			}
+			continue
+		}
+
+		// a layer may contain the same path more than once, the last entry wins
+		if existing, err := os.Lstat(target); err == nil && (header.Typeflag != tar.TypeDir || !existing.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
 				return err
 			}
+		}
 
-			target := filepath.Join(base, header.Name)
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
 
-			// check for path traversal
-			if !strings.HasPrefix(target, filepath.Clean(base)) {
-				return fmt.Errorf("invalid file path: %s", header.Name)
+		case tar.TypeDir:
+			// create directory
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return err
 			}
-
-			switch header.Typeflag {
-
-			case tar.TypeDir:
-				// create directory
-				if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-					return err
-				}
-			case tar.TypeReg:
-				// create file
-				file, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode))
-				if err != nil {
-					return err
-				}
-				if _, err := io.CopyN(file, tr, header.Size); err != nil {
-					file.Close()
-					return err
-				}
+		case tar.TypeReg:
+			// create file
+			file, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode.Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(file, tr, header.Size); err != nil {
 				file.Close()
-			case tar.TypeLink:
-				linkTarget := filepath.Join(base, header.Linkname)
-				if err := os.Link(linkTarget, target); err != nil {
-					return err
-
-				}
-			case tar.TypeSymlink:
-				if err := os.Symlink(header.Linkname, target); err != nil {
-					if !errors.Is(err, os.ErrExist) {
-						return err
-					}
-				}
-			default:
-				fmt.Printf("Ignoring unknown tar entry: %d\n", header.Typeflag)
+				return err
+			}
+			file.Close()
+		case tar.TypeLink:
+			// shares the owner and mode of the file it links to
+			linkTarget, err := layerPath(base, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			Logger(ctx).Debug("ignoring unknown tar entry", "name", header.Name, "type", header.Typeflag)
+			continue
+		}
+
+		// ownership, chown clears setuid and setgid bits so the mode is applied after
+		if err := lchown(ctx, target, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %w", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg {
+			if err := os.Chmod(target, mode); err != nil {
+				return err
 			}
 		}
 	}
@@ -139,6 +196,43 @@ func extractRootFS(image v1.Image, path string) error {
 	return nil
 }
 
+// layerPath resolves the tar entry `name` inside `base`. Earlier entries of the layer may be
+// symlinks pointing anywhere, so a path which leaves `base` or passes through a symlink is
+// rejected rather than followed.
+func layerPath(base string, name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid file path: %s", name)
+	}
+
+	dir := filepath.Join(base, filepath.Dir(rel))
+	resolved, err := SecureJoin(base, filepath.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	if resolved != dir {
+		return "", fmt.Errorf("invalid file path through a symlink: %s", name)
+	}
+	return filepath.Join(dir, filepath.Base(rel)), nil
+}
+
+// clearDirectory removes every entry inside `dir`, leaving the directory itself in place.
+func clearDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var defaultCaps = []string{
 	"CAP_CHOWN",
 	"CAP_DAC_OVERRIDE",
@@ -163,6 +257,20 @@ func generateConfig(image v1.Image, path string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get image config: %w", err)
 	}
+	imageDigest, err := image.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to get image digest: %w", err)
+	}
+
+	// resolve the image user against the rootfs, since uids and gids are what the child needs
+	user, home, err := ResolveUser(filepath.Join(path, rootfsFolder), imageConfig.Config.User)
+	if err != nil {
+		return fmt.Errorf("failed to resolve image user %q: %w", imageConfig.Config.User, err)
+	}
+	env := imageConfig.Config.Env
+	if !slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, "HOME=") }) {
+		env = append(env, "HOME="+home)
+	}
 
 	// Based on:
 	//  - https://github.com/opencontainers/runc/blob/506a849db794a0ee84ba9fb0d9465d960b62876c/libcontainer/specconv/example.go#L14
@@ -170,13 +278,10 @@ func generateConfig(image v1.Image, path string) error {
 	config := &specs.Spec{
 		Version: specs.Version,
 		Process: &specs.Process{
-			Terminal: true,
-			User: specs.User{
-				UID: 0,
-				GID: 0,
-			},
-			Args:            imageConfig.Config.Cmd,
-			Env:             imageConfig.Config.Env,
+			Terminal:        true,
+			User:            user,
+			Args:            MergeArgs(imageConfig.Config.Entrypoint, imageConfig.Config.Cmd, nil, nil),
+			Env:             env,
 			Cwd:             imageConfig.Config.WorkingDir,
 			NoNewPrivileges: true,
 			Capabilities: &specs.LinuxCapabilities{
@@ -193,6 +298,9 @@ func generateConfig(image v1.Image, path string) error {
 			},
 		},
 		Hostname: "box",
+		Annotations: map[string]string{
+			imageDigestAnnotation: imageDigest.String(),
+		},
 		Mounts: []specs.Mount{
 			{
 				Destination: "/proc",
@@ -238,6 +346,7 @@ func generateConfig(image v1.Image, path string) error {
 			},
 		},
 		Linux: &specs.Linux{
+			Seccomp: DefaultSeccompProfile(defaultCaps),
 			MaskedPaths: []string{
 				"/proc/acpi",
 				"/proc/asound",
@@ -284,6 +393,9 @@ func generateConfig(image v1.Image, path string) error {
 			},
 		},
 	}
+	if imageConfig.Config.StopSignal != "" {
+		config.Annotations[stopSignalAnnotation] = imageConfig.Config.StopSignal
+	}
 
 	// write to file
 	file, err := os.Create(configPath)
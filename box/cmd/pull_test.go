@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// tarEntry is an entry of an in-memory layer. Names ending in / are directories, and entries with
+// a link are symlinks, or hard links if `hard` is set.
+type tarEntry struct {
+	name     string
+	contents string
+	link     string
+	hard     bool
+}
+
+func file(name string, contents string) tarEntry { return tarEntry{name: name, contents: contents} }
+func dir(name string) tarEntry                   { return tarEntry{name: name + "/"} }
+func symlink(name string, link string) tarEntry  { return tarEntry{name: name, link: link} }
+func hardlink(name string, link string) tarEntry { return tarEntry{name: name, link: link, hard: true} }
+
+// testLayer builds an image layer from `entries`, in order.
+func testLayer(t *testing.T, entries ...tarEntry) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.contents))}
+		switch {
+		case strings.HasSuffix(entry.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		case entry.hard:
+			header.Typeflag, header.Linkname = tar.TypeLink, entry.link
+		case entry.link != "":
+			header.Typeflag, header.Linkname = tar.TypeSymlink, entry.link
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := tarball.LayerFromReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// snapshot describes every path under `root`, as "dir", "opaque dir", "whiteout", "file <contents>"
+// or "symlink <target>".
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	tree := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir() && isOpaque(path):
+			tree[rel] = "opaque dir"
+		case mode.IsDir():
+			tree[rel] = "dir"
+		case mode&fs.ModeCharDevice != 0 && info.Sys().(*syscall.Stat_t).Rdev == 0:
+			tree[rel] = "whiteout"
+		case mode&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "symlink " + target
+		case mode.IsRegular():
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "file " + string(contents)
+		default:
+			tree[rel] = mode.String()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func checkTree(t *testing.T, root string, want map[string]string) {
+	t.Helper()
+
+	got := snapshot(t, root)
+	for _, path := range slices.Sorted(maps.Keys(want)) {
+		if got[path] != want[path] {
+			t.Errorf("%s: got %q, want %q", path, got[path], want[path])
+		}
+	}
+	for _, path := range slices.Sorted(maps.Keys(got)) {
+		if _, ok := want[path]; !ok {
+			t.Errorf("%s: unexpected %q", path, got[path])
+		}
+	}
+}
+
+// requireRoot skips tests which create whiteouts, as they are character devices.
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 || InUserNamespace() {
+		t.Skip("creating whiteouts requires root")
+	}
+}
+
+func TestExtractLayer(t *testing.T) {
+	requireRoot(t)
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "files and directories",
+			entries: []tarEntry{dir("etc"), file("etc/hostname", "box"), symlink("etc/name", "hostname")},
+			want:    map[string]string{"etc": "dir", "etc/hostname": "file box", "etc/name": "symlink hostname"},
+		},
+		{
+			name:    "missing parent directories",
+			entries: []tarEntry{file("usr/lib/os-release", "linux")},
+			want:    map[string]string{"usr": "dir", "usr/lib": "dir", "usr/lib/os-release": "file linux"},
+		},
+		{
+			name:    "whiteout",
+			entries: []tarEntry{dir("etc"), file("etc/.wh.motd", "")},
+			want:    map[string]string{"etc": "dir", "etc/motd": "whiteout"},
+		},
+		{
+			name:    "whiteout at root",
+			entries: []tarEntry{file(".wh.tmp", "")},
+			want:    map[string]string{"tmp": "whiteout"},
+		},
+		{
+			name:    "opaque directory",
+			entries: []tarEntry{dir("var"), file("var/.wh..wh..opq", ""), file("var/log", "new")},
+			want:    map[string]string{"var": "opaque dir", "var/log": "file new"},
+		},
+		{
+			name:    "opaque directory without an entry",
+			entries: []tarEntry{file("var/cache/.wh..wh..opq", "")},
+			want:    map[string]string{"var": "dir", "var/cache": "opaque dir"},
+		},
+		{
+			name:    "repeated file",
+			entries: []tarEntry{file("a", "first"), file("a", "second")},
+			want:    map[string]string{"a": "file second"},
+		},
+		{
+			name:    "file replaced by symlink",
+			entries: []tarEntry{file("a", "first"), symlink("a", "b")},
+			want:    map[string]string{"a": "symlink b"},
+		},
+		{
+			name:    "hard link",
+			entries: []tarEntry{file("a", "first"), hardlink("b", "a")},
+			want:    map[string]string{"a": "file first", "b": "file first"},
+		},
+		{
+			name:    "directory replaces symlink",
+			entries: []tarEntry{symlink("a", "/etc"), dir("a")},
+			want:    map[string]string{"a": "dir"},
+		},
+		{
+			name:    "path traversal",
+			entries: []tarEntry{file("../escape", "")},
+			wantErr: true,
+		},
+		{
+			name:    "path traversal to a sibling",
+			entries: []tarEntry{file("../base-evil/escape", "")},
+			wantErr: true,
+		},
+		{
+			name:    "path traversal through a symlinked parent",
+			entries: []tarEntry{symlink("a", "/etc"), file("a/passwd", "")},
+			wantErr: true,
+		},
+		{
+			name:    "path traversal through a relative symlinked parent",
+			entries: []tarEntry{symlink("a", "../.."), file("a/escape", "")},
+			wantErr: true,
+		},
+		{
+			name:    "hard link traversal",
+			entries: []tarEntry{hardlink("passwd", "../../etc/passwd")},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			err := extractLayer(t.Context(), testLayer(t, test.entries...), base)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, base, test.want)
+		})
+	}
+}
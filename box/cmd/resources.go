@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+)
+
+// ResourceOptions are the flags which limit the resources of a container. A limit which is left
+// at its default keeps the value from the bundle config.
+type ResourceOptions struct {
+	// CPUs and MemoryMiB are -1 when unset
+	CPUs       float64 `json:"cpus"`
+	MemoryMiB  int     `json:"memoryMiB"`
+	CPUShares  uint64  `json:"cpuShares,omitempty"`
+	CPUsetCPUs string  `json:"cpusetCpus,omitempty"`
+	CPUsetMems string  `json:"cpusetMems,omitempty"`
+	// MemoryReservationMiB is the memory below which the container isn't reclaimed from
+	MemoryReservationMiB int `json:"memoryReservationMiB,omitempty"`
+	// MemorySwapMiB limits memory and swap together, -1 for unlimited swap
+	MemorySwapMiB int `json:"memorySwapMiB,omitempty"`
+	// PidsLimit is -1 for no limit
+	PidsLimit   int64  `json:"pidsLimit,omitempty"`
+	BlkioWeight uint16 `json:"blkioWeight,omitempty"`
+	// the IO throttles are <device-path>:<rate>
+	DeviceReadBps   []string `json:"deviceReadBps,omitempty"`
+	DeviceWriteBps  []string `json:"deviceWriteBps,omitempty"`
+	DeviceReadIOps  []string `json:"deviceReadIOps,omitempty"`
+	DeviceWriteIOps []string `json:"deviceWriteIOps,omitempty"`
+	// HugetlbLimits are <page-size>:<limit>
+	HugetlbLimits []string `json:"hugetlbLimits,omitempty"`
+}
+
+// addResourceFlags adds the flags for `opts` to `flags`.
+func addResourceFlags(flags *pflag.FlagSet, opts *ResourceOptions) {
+	flags.Float64Var(&opts.CPUs, "cpus", -1, "Limit the number of CPUs available to the container, e.g. 1.5")
+	flags.IntVar(&opts.MemoryMiB, "mem", -1, "Limit the amount of memory available to the container (in MiB)")
+	flags.Uint64Var(&opts.CPUShares, "cpu-shares", 0, "Relative CPU weight of the container from 2 to 262144, the default is 1024")
+	flags.StringVar(&opts.CPUsetCPUs, "cpuset-cpus", "", "CPUs the container may run on, e.g. 0-3,6")
+	flags.StringVar(&opts.CPUsetMems, "cpuset-mems", "", "NUMA nodes the container may allocate memory from, e.g. 0,1")
+	flags.IntVar(&opts.MemoryReservationMiB, "mem-reservation", 0, "Amount of memory the container is protected from reclaim below (in MiB)")
+	flags.IntVar(&opts.MemorySwapMiB, "mem-swap", 0, "Limit the amount of memory and swap together (in MiB), -1 for unlimited swap")
+	flags.Int64Var(&opts.PidsLimit, "pids-limit", 0, "Limit the number of processes in the container, -1 for no limit")
+	flags.Uint16Var(&opts.BlkioWeight, "blkio-weight", 0, "Relative IO weight of the container from 10 to 1000")
+	flags.StringArrayVar(&opts.DeviceReadBps, "device-read-bps", nil, "Limit the rate of reads from a device as <device-path>:<bytes per second>, e.g. /dev/sda:10m")
+	flags.StringArrayVar(&opts.DeviceWriteBps, "device-write-bps", nil, "Limit the rate of writes to a device as <device-path>:<bytes per second>, e.g. /dev/sda:10m")
+	flags.StringArrayVar(&opts.DeviceReadIOps, "device-read-iops", nil, "Limit the rate of reads from a device as <device-path>:<operations per second>")
+	flags.StringArrayVar(&opts.DeviceWriteIOps, "device-write-iops", nil, "Limit the rate of writes to a device as <device-path>:<operations per second>")
+	flags.StringArrayVar(&opts.HugetlbLimits, "hugetlb-limit", nil, "Limit the hugepages the container uses as <page-size>:<limit>, e.g. 2MB:512m")
+}
+
+// ApplyTo sets the limits given by the options in `resources`.
+func (o ResourceOptions) ApplyTo(resources *specs.LinuxResources) error {
+	if o.CPUs != -1 {
+		if o.CPUs <= 0 {
+			return fmt.Errorf("invalid --cpus %g, must be more than 0", o.CPUs)
+		}
+		if o.CPUs > float64(runtime.NumCPU()) {
+			return fmt.Errorf("invalid --cpus %g, only %d CPUs are available", o.CPUs, runtime.NumCPU())
+		}
+		period := uint64(100000)
+		quota := int64(o.CPUs * float64(period))
+		resourcesCPU(resources).Quota, resourcesCPU(resources).Period = &quota, &period
+	}
+	if o.CPUShares != 0 {
+		shares := o.CPUShares
+		resourcesCPU(resources).Shares = &shares
+	}
+	if o.CPUsetCPUs != "" {
+		resourcesCPU(resources).Cpus = o.CPUsetCPUs
+	}
+	if o.CPUsetMems != "" {
+		resourcesCPU(resources).Mems = o.CPUsetMems
+	}
+
+	if o.MemoryMiB != -1 {
+		if o.MemoryMiB <= 0 {
+			return fmt.Errorf("invalid --mem %d, must be more than 0", o.MemoryMiB)
+		}
+		limit := int64(o.MemoryMiB) * 1048576
+		resourcesMemory(resources).Limit = &limit
+	}
+	if o.MemoryReservationMiB != 0 {
+		if o.MemoryReservationMiB < 0 {
+			return fmt.Errorf("invalid --mem-reservation %d, must be more than 0", o.MemoryReservationMiB)
+		}
+		reservation := int64(o.MemoryReservationMiB) * 1048576
+		resourcesMemory(resources).Reservation = &reservation
+	}
+	if o.MemorySwapMiB != 0 {
+		swap := int64(-1)
+		if o.MemorySwapMiB != -1 {
+			swap = int64(o.MemorySwapMiB) * 1048576
+		}
+		resourcesMemory(resources).Swap = &swap
+	}
+
+	if o.PidsLimit != 0 {
+		limit := o.PidsLimit
+		resources.Pids = &specs.LinuxPids{Limit: &limit}
+	}
+
+	if o.BlkioWeight != 0 {
+		weight := o.BlkioWeight
+		resourcesBlockIO(resources).Weight = &weight
+	}
+	throttles := []struct {
+		flags  []string
+		name   string
+		size   bool
+		target func(*specs.LinuxBlockIO) *[]specs.LinuxThrottleDevice
+	}{
+		{o.DeviceReadBps, "--device-read-bps", true, func(b *specs.LinuxBlockIO) *[]specs.LinuxThrottleDevice { return &b.ThrottleReadBpsDevice }},
+		{o.DeviceWriteBps, "--device-write-bps", true, func(b *specs.LinuxBlockIO) *[]specs.LinuxThrottleDevice { return &b.ThrottleWriteBpsDevice }},
+		{o.DeviceReadIOps, "--device-read-iops", false, func(b *specs.LinuxBlockIO) *[]specs.LinuxThrottleDevice { return &b.ThrottleReadIOPSDevice }},
+		{o.DeviceWriteIOps, "--device-write-iops", false, func(b *specs.LinuxBlockIO) *[]specs.LinuxThrottleDevice { return &b.ThrottleWriteIOPSDevice }},
+	}
+	for _, throttle := range throttles {
+		for _, flag := range throttle.flags {
+			device, err := parseThrottleDevice(flag, throttle.size)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s: %w", throttle.name, flag, err)
+			}
+			target := throttle.target(resourcesBlockIO(resources))
+			*target = slices.DeleteFunc(*target, func(d specs.LinuxThrottleDevice) bool {
+				return d.Major == device.Major && d.Minor == device.Minor
+			})
+			*target = append(*target, device)
+		}
+	}
+
+	for _, flag := range o.HugetlbLimits {
+		pagesize, limit, ok := strings.Cut(flag, ":")
+		if !ok {
+			return fmt.Errorf("invalid --hugetlb-limit %s, must be <page-size>:<limit>", flag)
+		}
+		bytes, err := parseSize(limit)
+		if err != nil {
+			return fmt.Errorf("invalid --hugetlb-limit %s: %w", flag, err)
+		}
+		resources.HugepageLimits = slices.DeleteFunc(resources.HugepageLimits, func(l specs.LinuxHugepageLimit) bool {
+			return l.Pagesize == pagesize
+		})
+		resources.HugepageLimits = append(resources.HugepageLimits, specs.LinuxHugepageLimit{Pagesize: pagesize, Limit: bytes})
+	}
+	return nil
+}
+
+// Merge sets the options in `o` which were given on the command line in `flags`, a flag set the
+// resource flags were added to. Throttled devices and hugepage limits are added to those in `o`.
+func (o *ResourceOptions) Merge(flags *pflag.FlagSet) error {
+	// adding the flags resets the options to their defaults
+	current := *o
+	target := pflag.NewFlagSet("resources", pflag.ContinueOnError)
+	addResourceFlags(target, o)
+	*o = current
+
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		option := target.Lookup(flag.Name)
+		if !flag.Changed || option == nil || err != nil {
+			return
+		}
+		if values, ok := flag.Value.(pflag.SliceValue); ok {
+			options := option.Value.(pflag.SliceValue)
+			err = options.Replace(append(options.GetSlice(), values.GetSlice()...))
+			return
+		}
+		err = option.Value.Set(flag.Value.String())
+	})
+	return err
+}
+
+func resourcesCPU(resources *specs.LinuxResources) *specs.LinuxCPU {
+	if resources.CPU == nil {
+		resources.CPU = &specs.LinuxCPU{}
+	}
+	return resources.CPU
+}
+
+func resourcesMemory(resources *specs.LinuxResources) *specs.LinuxMemory {
+	if resources.Memory == nil {
+		resources.Memory = &specs.LinuxMemory{}
+	}
+	return resources.Memory
+}
+
+func resourcesBlockIO(resources *specs.LinuxResources) *specs.LinuxBlockIO {
+	if resources.BlockIO == nil {
+		resources.BlockIO = &specs.LinuxBlockIO{}
+	}
+	return resources.BlockIO
+}
+
+// parseThrottleDevice parses <device-path>:<rate>, where the rate is a size such as 10m if `size`
+// is set and otherwise a number.
+func parseThrottleDevice(flag string, size bool) (specs.LinuxThrottleDevice, error) {
+	path, value, ok := strings.Cut(flag, ":")
+	if !ok {
+		return specs.LinuxThrottleDevice{}, errors.New("must be <device-path>:<rate>")
+	}
+	var rate uint64
+	var err error
+	if size {
+		rate, err = parseSize(value)
+	} else {
+		rate, err = strconv.ParseUint(value, 10, 64)
+	}
+	if err != nil {
+		return specs.LinuxThrottleDevice{}, err
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return specs.LinuxThrottleDevice{}, fmt.Errorf("failed to stat device: %w", err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return specs.LinuxThrottleDevice{}, fmt.Errorf("%s is not a block device", path)
+	}
+	device := specs.LinuxThrottleDevice{Rate: rate}
+	device.Major, device.Minor = int64(unix.Major(stat.Rdev)), int64(unix.Minor(stat.Rdev))
+	return device, nil
+}
+
+var sizePattern = regexp.MustCompile(`^(?i)([0-9]+)([kmgt]?)i?b?$`)
+
+// parseSize parses a number of bytes with an optional binary unit, e.g. 512k, 10m or 1g.
+func parseSize(size string) (uint64, error) {
+	match := sizePattern.FindStringSubmatch(size)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %s, must be a number of bytes with an optional unit of k, m, g or t", size)
+	}
+	value, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	shift := 0
+	if match[2] != "" {
+		shift = 10 * (strings.Index("kmgt", strings.ToLower(match[2])) + 1)
+	}
+	if value > math.MaxUint64>>shift {
+		return 0, fmt.Errorf("invalid size %s, it is too large", size)
+	}
+	return value << shift, nil
+}
+
+var cpuListPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+var pagesizePattern = regexp.MustCompile(`^([0-9]+)([KMG])B$`)
+
+// validateResources checks the values in `resources` can be applied to a cgroup v2 cgroup by the
+// cgroup manager called `manager`, as the kernel would otherwise reject them when the container
+// starts or some would be ignored.
+func validateResources(resources *specs.LinuxResources, manager string) error {
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Shares != nil && (*cpu.Shares < 2 || *cpu.Shares > 262144) {
+			return fmt.Errorf("invalid cpu shares %d, must be from 2 to 262144", *cpu.Shares)
+		}
+		if cpu.Quota != nil && *cpu.Quota <= 0 && *cpu.Quota != -1 {
+			return fmt.Errorf("invalid cpu quota %d, must be more than 0 or -1 for no limit", *cpu.Quota)
+		}
+		if cpu.Period != nil && (*cpu.Period < 1000 || *cpu.Period > 1000000) {
+			return fmt.Errorf("invalid cpu period %d, must be from 1000 to 1000000", *cpu.Period)
+		}
+		if cpu.RealtimeRuntime != nil || cpu.RealtimePeriod != nil {
+			return errors.New("realtime cpu limits are not supported with cgroup v2")
+		}
+		if cpu.Cpus != "" && !cpuListPattern.MatchString(cpu.Cpus) {
+			return fmt.Errorf("invalid cpuset cpus %s, must be a list such as 0-3,6", cpu.Cpus)
+		}
+		if cpu.Mems != "" && !cpuListPattern.MatchString(cpu.Mems) {
+			return fmt.Errorf("invalid cpuset mems %s, must be a list such as 0,1", cpu.Mems)
+		}
+	}
+
+	if memory := resources.Memory; memory != nil {
+		if memory.Limit != nil && *memory.Limit <= 0 && *memory.Limit != -1 {
+			return fmt.Errorf("invalid memory limit %d, must be more than 0 or -1 for no limit", *memory.Limit)
+		}
+		if memory.Reservation != nil && *memory.Reservation < 0 && *memory.Reservation != -1 {
+			return fmt.Errorf("invalid memory reservation %d", *memory.Reservation)
+		}
+		if memory.Swap != nil && *memory.Swap != -1 {
+			// cgroup v2 limits swap on its own, which is the difference between the two
+			if memory.Limit == nil || *memory.Limit <= 0 {
+				return errors.New("a memory and swap limit needs a memory limit")
+			}
+			if *memory.Swap < *memory.Limit {
+				return fmt.Errorf("invalid memory and swap limit %d, must be at least the memory limit %d", *memory.Swap, *memory.Limit)
+			}
+		}
+		if memory.Kernel != nil || memory.KernelTCP != nil {
+			return errors.New("kernel memory limits are not supported with cgroup v2")
+		}
+		if memory.Swappiness != nil {
+			return errors.New("memory swappiness is not supported with cgroup v2")
+		}
+		if memory.DisableOOMKiller != nil && *memory.DisableOOMKiller {
+			return errors.New("disabling the OOM killer is not supported with cgroup v2")
+		}
+	}
+
+	if blockIO := resources.BlockIO; blockIO != nil {
+		if blockIO.Weight != nil && (*blockIO.Weight < 10 || *blockIO.Weight > 1000) {
+			return fmt.Errorf("invalid blkio weight %d, must be from 10 to 1000", *blockIO.Weight)
+		}
+		for _, device := range blockIO.WeightDevice {
+			if device.Weight != nil && (*device.Weight < 10 || *device.Weight > 1000) {
+				return fmt.Errorf("invalid blkio weight %d of device %d:%d, must be from 10 to 1000", *device.Weight, device.Major, device.Minor)
+			}
+		}
+		if blockIO.LeafWeight != nil || slices.ContainsFunc(blockIO.WeightDevice, func(d specs.LinuxWeightDevice) bool {
+			return d.LeafWeight != nil
+		}) {
+			return errors.New("blkio leaf weights are not supported with cgroup v2")
+		}
+	}
+
+	// systemd has no property for hugepages, and only a delegated scope may be written to
+	if len(resources.HugepageLimits) > 0 && manager == systemdCgroupManager && !Rootless() {
+		return errors.New("hugepage limits are not supported with the systemd cgroup manager, use --cgroup-manager cgroupfs")
+	}
+	for _, limit := range resources.HugepageLimits {
+		match := pagesizePattern.FindStringSubmatch(limit.Pagesize)
+		if match == nil {
+			return fmt.Errorf("invalid hugepage size %s, must be a size such as 2MB", limit.Pagesize)
+		}
+		kB, _ := strconv.ParseUint(match[1], 10, 64)
+		kB <<= 10 * strings.Index("KMG", match[2])
+		if _, err := os.Stat(fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB", kB)); err != nil {
+			return fmt.Errorf("hugepage size %s is not supported by the host", limit.Pagesize)
+		}
+	}
+
+	if network := resources.Network; network != nil && (network.ClassID != nil || len(network.Priorities) > 0) {
+		return errors.New("network class and priority limits are not supported with cgroup v2")
+	}
+	return nil
+}
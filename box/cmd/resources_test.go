@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		{size: "0", want: 0},
+		{size: "512", want: 512},
+		{size: "512b", want: 512},
+		{size: "4k", want: 4096},
+		{size: "10m", want: 10 << 20},
+		{size: "10M", want: 10 << 20},
+		{size: "10MB", want: 10 << 20},
+		{size: "10MiB", want: 10 << 20},
+		{size: "1g", want: 1 << 30},
+		{size: "2t", want: 2 << 40},
+		{size: "", wantErr: true},
+		{size: "m", wantErr: true},
+		{size: "-1", wantErr: true},
+		{size: "1.5g", wantErr: true},
+		{size: "10p", wantErr: true},
+		{size: "99999999999999999999", wantErr: true},
+		{size: "99999999t", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.size, func(t *testing.T) {
+			got, err := parseSize(test.size)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseThrottleDevice(t *testing.T) {
+	requireRoot(t)
+
+	device := filepath.Join(t.TempDir(), "sda")
+	if err := unix.Mknod(device, unix.S_IFBLK|0600, int(unix.Mkdev(8, 16))); err != nil {
+		t.Fatal(err)
+	}
+	sdaDevice := specs.LinuxBlockIODevice{Major: 8, Minor: 16}
+
+	tests := []struct {
+		flag    string
+		size    bool
+		want    specs.LinuxThrottleDevice
+		wantErr bool
+	}{
+		{flag: device + ":10m", size: true, want: specs.LinuxThrottleDevice{LinuxBlockIODevice: sdaDevice, Rate: 10 << 20}},
+		{flag: device + ":100", size: false, want: specs.LinuxThrottleDevice{LinuxBlockIODevice: sdaDevice, Rate: 100}},
+		{flag: device + ":0", size: true, want: specs.LinuxThrottleDevice{LinuxBlockIODevice: sdaDevice}},
+		{flag: device + ":10m", size: false, wantErr: true},
+		{flag: device, size: true, wantErr: true},
+		{flag: device + ":", size: true, wantErr: true},
+		{flag: "/dev/null:10m", size: true, wantErr: true},
+		{flag: "/dev/missing:10m", size: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.TrimPrefix(test.flag, filepath.Dir(device)), func(t *testing.T) {
+			got, err := parseThrottleDevice(test.flag, test.size)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources specs.LinuxResources
+		manager   string
+		wantErr   string
+	}{
+		{
+			name: "valid",
+			resources: specs.LinuxResources{
+				CPU:     &specs.LinuxCPU{Shares: ptr(uint64(1024)), Quota: ptr(int64(50000)), Period: ptr(uint64(100000)), Cpus: "0-3,6", Mems: "0"},
+				Memory:  &specs.LinuxMemory{Limit: ptr(int64(100)), Swap: ptr(int64(200)), Reservation: ptr(int64(50))},
+				BlockIO: &specs.LinuxBlockIO{Weight: ptr(uint16(500))},
+			},
+		},
+		{
+			name:      "no limits",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{Quota: ptr(int64(-1))}, Memory: &specs.LinuxMemory{Limit: ptr(int64(-1)), Swap: ptr(int64(-1))}},
+		},
+		{
+			name:      "cpu shares",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{Shares: ptr(uint64(1))}},
+			wantErr:   "invalid cpu shares",
+		},
+		{
+			name:      "cpu quota",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{Quota: ptr(int64(0))}},
+			wantErr:   "invalid cpu quota",
+		},
+		{
+			name:      "cpu period",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{Period: ptr(uint64(999))}},
+			wantErr:   "invalid cpu period",
+		},
+		{
+			name:      "realtime cpu",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{RealtimeRuntime: ptr(int64(1000))}},
+			wantErr:   "realtime cpu limits are not supported",
+		},
+		{
+			name:      "cpuset cpus",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{Cpus: "0-"}},
+			wantErr:   "invalid cpuset cpus",
+		},
+		{
+			name:      "cpuset mems",
+			resources: specs.LinuxResources{CPU: &specs.LinuxCPU{Mems: "a"}},
+			wantErr:   "invalid cpuset mems",
+		},
+		{
+			name:      "memory limit",
+			resources: specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: ptr(int64(0))}},
+			wantErr:   "invalid memory limit",
+		},
+		{
+			name:      "swap without a memory limit",
+			resources: specs.LinuxResources{Memory: &specs.LinuxMemory{Swap: ptr(int64(100))}},
+			wantErr:   "needs a memory limit",
+		},
+		{
+			name:      "swap below the memory limit",
+			resources: specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: ptr(int64(200)), Swap: ptr(int64(100))}},
+			wantErr:   "must be at least the memory limit",
+		},
+		{
+			name:      "swappiness",
+			resources: specs.LinuxResources{Memory: &specs.LinuxMemory{Swappiness: ptr(uint64(10))}},
+			wantErr:   "swappiness is not supported",
+		},
+		{
+			name:      "blkio weight",
+			resources: specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{Weight: ptr(uint16(5))}},
+			wantErr:   "invalid blkio weight",
+		},
+		{
+			name:      "blkio leaf weight",
+			resources: specs.LinuxResources{BlockIO: &specs.LinuxBlockIO{LeafWeight: ptr(uint16(500))}},
+			wantErr:   "leaf weights are not supported",
+		},
+		{
+			name:      "hugepage size",
+			resources: specs.LinuxResources{HugepageLimits: []specs.LinuxHugepageLimit{{Pagesize: "2M", Limit: 1}}},
+			manager:   cgroupfsCgroupManager,
+			wantErr:   "invalid hugepage size",
+		},
+		{
+			name:      "hugepages with systemd",
+			resources: specs.LinuxResources{HugepageLimits: []specs.LinuxHugepageLimit{{Pagesize: "2MB", Limit: 1}}},
+			manager:   systemdCgroupManager,
+			wantErr:   "not supported with the systemd cgroup manager",
+		},
+		{
+			name:      "network",
+			resources: specs.LinuxResources{Network: &specs.LinuxNetwork{ClassID: ptr(uint32(1))}},
+			wantErr:   "network class and priority limits are not supported",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.manager == systemdCgroupManager && Rootless() {
+				t.Skip("a rootless systemd scope is delegated, so hugepage limits can be set")
+			}
+			err := validateResources(&test.resources, test.manager)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -2,16 +2,20 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
-	logJSON bool
-	verbose bool
-	quiet   bool
+	stateRoot string
+	logJSON   bool
+	verbose   bool
+	quiet     bool
 )
 
 var rootCmd = &cobra.Command{
@@ -30,7 +34,7 @@ var rootCmd = &cobra.Command{
 		ctx := context.WithValue(cmd.Context(), loggerKey{}, log)
 		cmd.SetContext(ctx)
 
-		return nil
+		return waitForIDMappings()
 	},
 }
 
@@ -64,14 +68,38 @@ func newLogger(json bool, verbose bool, quiet bool) *slog.Logger {
 	return slog.New(handler)
 }
 
+// ExitCodeError is returned by commands which need box to exit with a specific code, such as the
+// exit code of a process run inside a container. It is not logged as a failure.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("exited with code %d", e.Code)
+}
+
+// rootFlagArgs returns the root flags as arguments, to pass them down to box subprocesses.
+func rootFlagArgs() []string {
+	var args []string
+	rootCmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+	})
+	return args
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		var exitErr *ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		slog.Error("command failure", "err", err)
 		os.Exit(1)
 	}
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&stateRoot, "root", defaultStateRoot(), "root directory for box state (images, containers, etc)")
 	rootCmd.PersistentFlags().BoolVar(&logJSON, "json", false, "enable JSON format logging")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose logging")
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "hide all logging")
@@ -79,4 +107,19 @@ func init() {
 	rootCmd.AddCommand(pullCmd)
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(childCmd)
+	rootCmd.AddCommand(psCmd)
+	rootCmd.AddCommand(stateCmd)
+	rootCmd.AddCommand(monitorCmd)
+	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(killCmd)
+	rootCmd.AddCommand(updateCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(eventsCmd)
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(deleteCmd)
+	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(execChildCmd)
+	rootCmd.AddCommand(volumeCmd)
 }
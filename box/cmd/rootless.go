@@ -0,0 +1,424 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// Rootless containers are run by an unprivileged user inside a user namespace where they are
+// root. The rest of the container IDs are mapped onto the user's subordinate IDs from /etc/subuid
+// and /etc/subgid, and images are pulled inside the same kind of user namespace so the owners of
+// the files in their layers are kept.
+
+const (
+	subUIDFile = "/etc/subuid"
+	subGIDFile = "/etc/subgid"
+	// idMappingSyncEnv tells a box subprocess started by StartInUserNamespace which fd to wait on
+	// for its mappings
+	idMappingSyncEnv = "_BOX_ID_MAPPING_FD"
+)
+
+// Rootless returns whether box is running without the privileges of root, either as an
+// unprivileged user or as a root without CAP_SYS_ADMIN. Root in a user namespace other than the
+// initial one still has it, so box isn't rootless there.
+func Rootless() bool {
+	return rootless()
+}
+
+var rootless = sync.OnceValue(func() bool {
+	if os.Geteuid() != 0 {
+		return true
+	}
+	sysAdmin, err := cap.GetProc().GetFlag(cap.Effective, cap.SYS_ADMIN)
+	return err != nil || !sysAdmin
+})
+
+// InUserNamespace returns whether box is running inside a user namespace other than the initial
+// one, which maps every ID.
+func InUserNamespace() bool {
+	return inUserNamespace()
+}
+
+var inUserNamespace = sync.OnceValue(func() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	return strings.Join(strings.Fields(string(data)), " ") != "0 0 4294967295"
+})
+
+// defaultStateRoot is /var/lib/box, or $XDG_DATA_HOME/box when rootless.
+func defaultStateRoot() string {
+	if !Rootless() {
+		return "/var/lib/box"
+	}
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "box")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "/var/lib/box"
+	}
+	return filepath.Join(home, ".local", "share", "box")
+}
+
+// RootlessIDMappings returns the uid and gid mappings for a rootless container. Root is mapped to
+// the current user and the IDs from 1 onwards to their subordinate IDs, if they have any and
+// newuidmap and newgidmap are installed to map them.
+func RootlessIDMappings(ctx context.Context) ([]specs.LinuxIDMapping, []specs.LinuxIDMapping, error) {
+	uid, gid := os.Getuid(), os.Getgid()
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			Logger(ctx).Warn("only root is mapped in the container as uidmap is not installed", "tool", tool)
+			return []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(uid), Size: 1}},
+				[]specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(gid), Size: 1}}, nil
+		}
+	}
+	passwd, err := readPasswd(passwdFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", passwdFile, err)
+	}
+	name := ""
+	for _, entry := range passwd {
+		if int(entry.UID) == uid {
+			name = entry.Name
+			break
+		}
+	}
+
+	uidMappings, err := rootlessIDMapping(ctx, subUIDFile, name, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	gidMappings, err := rootlessIDMapping(ctx, subGIDFile, name, gid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uidMappings, gidMappings, nil
+}
+
+// rootlessIDMapping maps root to `id` and 1 onwards to the first range of subordinate IDs for
+// user `name` in `path`, which is either /etc/subuid or /etc/subgid.
+func rootlessIDMapping(ctx context.Context, path string, name string, id int) ([]specs.LinuxIDMapping, error) {
+	mappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(id), Size: 1}}
+	found := false
+	err := readColonFile(path, func(fields []string) {
+		// name:start:count, the name can also be a uid
+		if found || len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(os.Getuid())) {
+			return
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil || count == 0 {
+			return
+		}
+		mappings = append(mappings, specs.LinuxIDMapping{ContainerID: 1, HostID: uint32(start), Size: uint32(count)})
+		found = true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !found {
+		Logger(ctx).Warn("no subordinate IDs for user, only root is mapped in the container", "user", name, "file", path)
+	}
+	return mappings, nil
+}
+
+// idMapped returns whether container ID `id` is mapped by `mappings`.
+func idMapped(mappings []specs.LinuxIDMapping, id uint32) bool {
+	return slices.ContainsFunc(mappings, func(m specs.LinuxIDMapping) bool {
+		return id >= m.ContainerID && id-m.ContainerID < m.Size
+	})
+}
+
+// rootlessConfig adapts `config` to run without root. It adds a user namespace, with the
+// mappings from RootlessIDMappings if the config has none, and changes the mounts which can't
+// be created in it.
+func rootlessConfig(ctx context.Context, config *specs.Spec) error {
+	if !HasNamespace(config.Linux.Namespaces, specs.UserNamespace) {
+		config.Linux.Namespaces = append(config.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+	}
+	if len(config.Linux.UIDMappings) == 0 && len(config.Linux.GIDMappings) == 0 {
+		uidMappings, gidMappings, err := RootlessIDMappings(ctx)
+		if err != nil {
+			return err
+		}
+		config.Linux.UIDMappings, config.Linux.GIDMappings = uidMappings, gidMappings
+	}
+
+	for i, m := range config.Mounts {
+		switch m.Type {
+		case "cgroup", "cgroup2":
+			// mounting cgroupfs needs a cgroup namespace owned by the user namespace
+			if !HasNamespace(config.Linux.Namespaces, specs.CgroupNamespace) {
+				config.Mounts[i] = specs.Mount{
+					Destination: m.Destination,
+					Type:        "bind",
+					Source:      cgroupRoot,
+					Options:     []string{"rbind", "nosuid", "noexec", "nodev"},
+				}
+			}
+		case "devpts":
+			// ptys can't be given a group which isn't mapped
+			config.Mounts[i].Options = slices.DeleteFunc(slices.Clone(m.Options), func(option string) bool {
+				value, ok := strings.CutPrefix(option, "gid=")
+				if !ok {
+					return false
+				}
+				gid, err := strconv.ParseUint(value, 10, 32)
+				return err != nil || !idMapped(config.Linux.GIDMappings, uint32(gid))
+			})
+		}
+	}
+	return nil
+}
+
+// WriteIDMappings writes the uid and gid mappings of the user namespace of process `pid`. Root
+// can write any mappings. An unprivileged user can only map their own IDs, so newuidmap and
+// newgidmap are used to map their subordinate IDs. A single mapping is written directly instead,
+// which also needs setgroups to be denied in the namespace.
+func WriteIDMappings(pid int, uidMappings []specs.LinuxIDMapping, gidMappings []specs.LinuxIDMapping) error {
+	procPath := fmt.Sprintf("/proc/%d", pid)
+	if os.Geteuid() == 0 || (len(uidMappings) <= 1 && len(gidMappings) <= 1) {
+		if os.Geteuid() != 0 {
+			if err := os.WriteFile(filepath.Join(procPath, "setgroups"), []byte("deny"), 0); err != nil {
+				return fmt.Errorf("failed to deny setgroups: %w", err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(procPath, "uid_map"), []byte(formatIDMappings(uidMappings)), 0); err != nil {
+			return fmt.Errorf("failed to write uid mappings: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(procPath, "gid_map"), []byte(formatIDMappings(gidMappings)), 0); err != nil {
+			return fmt.Errorf("failed to write gid mappings: %w", err)
+		}
+		return nil
+	}
+
+	for _, tool := range []struct {
+		name     string
+		mappings []specs.LinuxIDMapping
+	}{{"newuidmap", uidMappings}, {"newgidmap", gidMappings}} {
+		args := []string{strconv.Itoa(pid)}
+		for _, m := range tool.mappings {
+			args = append(args, strconv.FormatUint(uint64(m.ContainerID), 10), strconv.FormatUint(uint64(m.HostID), 10), strconv.FormatUint(uint64(m.Size), 10))
+		}
+		if output, err := exec.Command(tool.name, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run %s (is uidmap installed?): %w: %s", tool.name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func formatIDMappings(mappings []specs.LinuxIDMapping) string {
+	var builder strings.Builder
+	for _, m := range mappings {
+		fmt.Fprintf(&builder, "%d %d %d\n", m.ContainerID, m.HostID, m.Size)
+	}
+	return builder.String()
+}
+
+// StartInUserNamespace starts the box subprocess `cmd` in a new user namespace with the given
+// mappings. The subprocess waits in waitForIDMappings until they have been written, as until then
+// it has no uid or gid.
+func StartInUserNamespace(cmd *exec.Cmd, uidMappings []specs.LinuxIDMapping, gidMappings []specs.LinuxIDMapping) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	cmd.Env = append(cmd.Environ(), fmt.Sprintf("%s=%d", idMappingSyncEnv, 2+len(cmd.ExtraFiles)))
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := WriteIDMappings(cmd.Process.Pid, uidMappings, gidMappings); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	_, err = w.Write([]byte{0})
+	return err
+}
+
+// waitForIDMappings blocks until the mappings of a box subprocess started by
+// StartInUserNamespace have been written, and does nothing otherwise. It then executes box again,
+// as the capabilities in the user namespace were lost when box was executed without a uid.
+func waitForIDMappings() error {
+	fdEnv, ok := os.LookupEnv(idMappingSyncEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(idMappingSyncEnv)
+	fd, err := strconv.Atoi(fdEnv)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", idMappingSyncEnv, err)
+	}
+	pipe := os.NewFile(uintptr(fd), "id-mapping-sync")
+	_, err = pipe.Read(make([]byte, 1))
+	pipe.Close()
+	if err != nil {
+		return errors.New("user namespace mappings were never written")
+	}
+	if err := syscall.Exec("/proc/self/exe", os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to execute box in user namespace: %w", err)
+	}
+	return nil
+}
+
+// runInUserNamespace runs box again with the same arguments inside a user namespace with the
+// rootless mappings, for commands which need to create files owned by other users.
+func runInUserNamespace(ctx context.Context) error {
+	uidMappings, gidMappings, err := RootlessIDMappings(ctx)
+	if err != nil {
+		return err
+	}
+	// root in the user namespace isn't rootless, so it is given the state root of the user
+	args := append([]string{"--root", stateRoot}, os.Args[1:]...)
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := StartInUserNamespace(cmd, uidMappings, gidMappings); err != nil {
+		return fmt.Errorf("failed to start box in a user namespace: %w", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// it has already logged why
+			return &ExitCodeError{Code: exitErr.ExitCode()}
+		}
+		return err
+	}
+	return nil
+}
+
+// lchown is os.Lchown, except that owners which can't be set without root are left as they are.
+// In a user namespace these are the IDs which aren't mapped, as a user without subordinate IDs
+// only has root mapped, and outside of one it is every other user.
+func lchown(ctx context.Context, path string, uid int, gid int) error {
+	err := os.Lchown(path, uid, gid)
+	if (errors.Is(err, syscall.EINVAL) && InUserNamespace()) || (errors.Is(err, syscall.EPERM) && Rootless()) {
+		Logger(ctx).Debug("leaving owner of file as it can't be set", "path", path, "uid", uid, "gid", gid)
+		return nil
+	}
+	return err
+}
+
+// setgroupsDenied returns whether setgroups is denied in our user namespace.
+func setgroupsDenied() bool {
+	data, err := os.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(data)) == "deny"
+}
+
+// StartSlirp4netns gives the network namespace of process `pid` a tap device connected to the
+// host network through slirp4netns, as a rootless container can't use the bridge. The port in
+// `portMapping` is forwarded to the container. It returns a function which stops slirp4netns.
+func StartSlirp4netns(pid int, portMapping string) (func(), error) {
+	path, err := exec.LookPath("slirp4netns")
+	if err != nil {
+		return nil, err
+	}
+	apiSocket := filepath.Join(os.TempDir(), fmt.Sprintf("box-slirp4netns-%d.sock", pid))
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, "--configure", "--mtu=65520", "--disable-host-loopback",
+		"--ready-fd=3", "--api-socket", apiSocket, strconv.Itoa(pid), "tap0")
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start slirp4netns: %w", err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.Remove(apiSocket)
+	}
+	// it writes to the ready fd once the tap device is configured
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		stop()
+		return nil, errors.New("slirp4netns exited before it was ready")
+	}
+	if portMapping != "" {
+		if err := slirp4netnsForwardPort(apiSocket, portMapping); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+	return stop, nil
+}
+
+// slirp4netnsForwardPort forwards `portMapping`, as <host-port>:<container-port>:<protocol>, to
+// the container using the slirp4netns API.
+func slirp4netnsForwardPort(apiSocket string, portMapping string) error {
+	ports := strings.Split(portMapping, ":")
+	if len(ports) != 3 {
+		return errors.New("invalid port mapping provided")
+	}
+	hostPort, err := strconv.Atoi(ports[0])
+	if err != nil {
+		return fmt.Errorf("invalid host port %s: %w", ports[0], err)
+	}
+	containerPort, err := strconv.Atoi(ports[1])
+	if err != nil {
+		return fmt.Errorf("invalid container port %s: %w", ports[1], err)
+	}
+
+	conn, err := net.Dial("unix", apiSocket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to slirp4netns: %w", err)
+	}
+	defer conn.Close()
+	request := map[string]any{
+		"execute": "add_hostfwd",
+		"arguments": map[string]any{
+			"proto":      ports[2],
+			"host_addr":  "0.0.0.0",
+			"host_port":  hostPort,
+			"guest_port": containerPort,
+		},
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return fmt.Errorf("failed to send port forward to slirp4netns: %w", err)
+	}
+	conn.(*net.UnixConn).CloseWrite()
+	var response struct {
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("failed to read slirp4netns response: %w", err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("failed to forward port %s: %s", portMapping, response.Error.Desc)
+	}
+	return nil
+}
@@ -1,190 +1,503 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
-	"runtime"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
-	systemd "github.com/coreos/go-systemd/v22/dbus"
-	dbus "github.com/godbus/dbus/v5"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/spf13/cobra"
-	"github.com/spf13/pflag"
-	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	bridgeName        = "bridge-box"
-	BridgeIP          = "10.0.0.171"
-	BridgePrefix      = 24
-	hostVethName      = "veth-box-host"
-	ContainerVethName = "veth-box-cont"
-	ContainerIP       = "10.0.0.172"
+	containersFolder = "containers"
+	logFile          = "container.log"
 )
 
-var cpuCount int
-var memoryMiB int
-var portMapping string
+// RunOptions are the `box run` flags which configure a container. They are kept in the container
+// state so that a detached container can be started again with the same configuration.
+type RunOptions struct {
+	ResourceOptions
+	Port    string `json:"port,omitempty"`
+	Subnet  string `json:"subnet"`
+	Overlay bool   `json:"overlay,omitempty"`
+	Keep    bool   `json:"keep,omitempty"`
+	// Entrypoint replaces the image entrypoint when set, an empty string removes it
+	Entrypoint *string  `json:"entrypoint,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	Ulimits    []string `json:"ulimits,omitempty"`
+	// SecurityOpts are `seccomp=unconfined` or `seccomp=<profile path>`
+	SecurityOpts []string `json:"securityOpts,omitempty"`
+	CapAdd       []string `json:"capAdd,omitempty"`
+	CapDrop      []string `json:"capDrop,omitempty"`
+	Privileged   bool     `json:"privileged,omitempty"`
+	// Mounts are from the `--volume` and `--mount` flags, in the order they were given
+	Mounts []MountRequest `json:"mounts,omitempty"`
+	// Devices are <host-path>[:<container-path>][:<permissions>]
+	Devices []string `json:"devices,omitempty"`
+	// CgroupManager is systemd or cgroupfs, empty to use systemd when it is available
+	CgroupManager string `json:"cgroupManager,omitempty"`
+	// Init runs box as PID 1 of the container to reap zombies and forward signals
+	Init bool `json:"init,omitempty"`
+	// StopTimeout is the seconds the container has to exit after its stop signal before it is
+	// killed
+	StopTimeout int `json:"stopTimeout,omitempty"`
+}
+
+var runOptions RunOptions
+var runEntrypoint string
+var runVolumes []string
+var runMounts []string
+var detach bool
 
 func init() {
-	runCmd.Flags().IntVar(&cpuCount, "cpus", -1, "Limit the number of CPUs available to the container")
-	runCmd.Flags().IntVar(&memoryMiB, "mem", -1, "Limit the amount of memory available to the container (in MiB)")
-	runCmd.Flags().StringVarP(&portMapping, "port", "p", "", "Expose a port within the container on the host as <host-port>:<container-port>:<protocol>")
+	addResourceFlags(runCmd.Flags(), &runOptions.ResourceOptions)
+	runCmd.Flags().StringVarP(&runOptions.Port, "port", "p", "", "Expose a port within the container on the host as <host-port>:<container-port>:<protocol>")
+	runCmd.Flags().StringVar(&runOptions.Subnet, "subnet", defaultSubnet, "Subnet of the bridge network to allocate the container an address from")
+	runCmd.Flags().BoolVar(&runOptions.Overlay, "overlay", false, "Mount the rootfs as an overlay of the image layers with a per-container writable layer")
+	runCmd.Flags().BoolVar(&runOptions.Keep, "keep", false, "Keep the container's writable layer after exit and reuse it on the next run (requires --overlay)")
+	runCmd.Flags().StringVar(&runEntrypoint, "entrypoint", "", "Override the image entrypoint, an empty string removes it")
+	runCmd.Flags().StringArrayVar(&runOptions.Ulimits, "ulimit", nil, "Set an rlimit for the container process as <name>=<soft>[:<hard>], e.g. nofile=1024:4096")
+	runCmd.Flags().StringArrayVar(&runOptions.SecurityOpts, "security-opt", nil, "Security options: seccomp=unconfined to disable syscall filtering, or seccomp=<file> for a profile in the format of linux.seccomp")
+	runCmd.Flags().StringArrayVar(&runOptions.CapAdd, "cap-add", nil, "Add a capability to the container process, or ALL")
+	runCmd.Flags().StringArrayVar(&runOptions.CapDrop, "cap-drop", nil, "Drop a capability from the container process, or ALL")
+	runCmd.Flags().BoolVar(&runOptions.Privileged, "privileged", false, "Give the container process every capability and device, and disable seccomp and masked paths")
+	runCmd.Flags().StringArrayVar(&runVolumes, "volume", nil, "Mount a host path or volume as <host-path>|<name>:<container-path>[:<options>], e.g. ro or rshared, or an anonymous volume at <container-path>")
+	runCmd.Flags().StringArrayVar(&runMounts, "mount", nil, "Mount a bind, volume or tmpfs as type=<type>,source=<source>,target=<container-path>[,readonly]")
+	runCmd.Flags().StringArrayVar(&runOptions.Devices, "device", nil, "Give the container a host device as <host-path>[:<container-path>][:<permissions>], e.g. /dev/fuse")
+	runCmd.Flags().IntVar(&runOptions.StopTimeout, "stop-timeout", 10, "Seconds to wait for the container to stop after its stop signal before killing it")
+	runCmd.Flags().BoolVar(&runOptions.Init, "init", false, "Run an init as PID 1 of the container which forwards signals to the container process and reaps zombies")
+	runCmd.Flags().StringVar(&runOptions.CgroupManager, "cgroup-manager", "", "Create the container cgroup with systemd or by writing to cgroupfs directly, by default systemd if it is running")
+	runCmd.Flags().BoolVarP(&detach, "detach", "d", false, "Run the container in the background and print its ID")
 }
 
 var runCmd = &cobra.Command{
-	Use:   "run [flags] <container-id> <runtime-bundle-path>",
+	Use:   "run [flags] <container-id> <runtime-bundle-path> [-- <command> [args...]]",
 	Short: "run a container from a runtime bundle on disk",
-	Args:  cobra.ExactArgs(2),
+	Args:  cobra.MinimumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		containerId := args[0]
 		runtimePath := args[1]
+		if cmd.Flags().Changed("entrypoint") {
+			runOptions.Entrypoint = &runEntrypoint
+		}
+		runOptions.Command = args[2:]
+		// the config is rebuilt on every start, so profile paths must not depend on the cwd
+		for i, opt := range runOptions.SecurityOpts {
+			if profile, ok := strings.CutPrefix(opt, "seccomp="); ok && profile != "unconfined" && profile != "" {
+				absProfile, err := filepath.Abs(profile)
+				if err != nil {
+					return err
+				}
+				runOptions.SecurityOpts[i] = "seccomp=" + absProfile
+			}
+		}
+
+		for _, volume := range runVolumes {
+			request, err := ParseVolume(volume)
+			if err != nil {
+				return err
+			}
+			runOptions.Mounts = append(runOptions.Mounts, *request)
+		}
+		for _, mount := range runMounts {
+			request, err := ParseMount(mount)
+			if err != nil {
+				return err
+			}
+			runOptions.Mounts = append(runOptions.Mounts, *request)
+		}
 
 		ctx := cmd.Context()
-		log := Logger(ctx)
 
 		config, _, err := GetConfigAndRootFromRuntimePath(runtimePath)
 		if err != nil {
 			return err
 		}
+		if runOptions.Keep && !runOptions.Overlay {
+			return errors.New("--keep requires --overlay")
+		}
+		if m := runOptions.CgroupManager; m != "" && m != systemdCgroupManager && m != cgroupfsCgroupManager {
+			return fmt.Errorf("unknown cgroup manager %s, must be systemd or cgroupfs", m)
+		}
+		if runOptions.Overlay && Rootless() {
+			return errors.New("--overlay is not supported in rootless mode")
+		}
+
+		// record container state
+		if existing, err := LoadContainer(containerId); err == nil {
+			return fmt.Errorf("container %s already exists with status %s", containerId, existing.Status)
+		}
+		container, err := NewContainer(containerId, runtimePath, config)
+		if err != nil {
+			return err
+		}
+		container.Options = runOptions
+		container.Detached = detach
+		if _, err := buildConfig(ctx, container); err != nil {
+			return err
+		}
 
-		// signal trapping to ensure graceful shutdown
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt)
-		defer signal.Stop(sigChan)
+		// a detached container is owned by a monitor process which outlives us
+		if detach {
+			if err := container.Save(); err != nil {
+				return fmt.Errorf("failed to save container state: %w", err)
+			}
+			if err := startMonitor(container); err != nil {
+				return err
+			}
+			fmt.Println(container.ID)
+			return nil
+		}
 
-		log.Info("run", "container", containerId)
+		container.MonitorPid, container.MonitorStartTime = os.Getpid(), processStartTime(os.Getpid())
+		if err := container.Save(); err != nil {
+			return fmt.Errorf("failed to save container state: %w", err)
+		}
+		defer func() {
+			container.Remove()
+			EmitEvent(ctx, container, EventDeleted)
+		}()
 
-		// 1. configure exec
-		var childArgs []string
-		cmd.Root().PersistentFlags().VisitAll(func(f *pflag.Flag) {
-			// pass down root flags
-			childArgs = append(childArgs, fmt.Sprintf("--%s=%s", f.Name, f.Value))
-		})
-		childArgs = append(childArgs, "child")
-		childArgs = append(childArgs, runtimePath)
-
-		child := exec.Command("/proc/self/exe", childArgs...)
-		// TODO: use a PTY?
-		child.Stdin = os.Stdin
-		child.Stdout = os.Stdout
-		child.Stderr = os.Stderr
-		r, w, _ := os.Pipe() // create a pipe to communicate with the child
-		child.ExtraFiles = []*os.File{r}
-		child.SysProcAttr = &syscall.SysProcAttr{
-			Cloneflags: CloneFlagsFromNamespaces(config.Linux.Namespaces),
-		}
-		if err := child.Start(); err != nil {
-			return fmt.Errorf("failed to start child process: %w", err)
-		}
-
-		// 2. setup container networking
-		// create bridge
-		bridgeAttrs := netlink.NewLinkAttrs()
-		bridgeAttrs.Name = bridgeName
-		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: bridgeAttrs}); err != nil {
-			return fmt.Errorf("failed to create bridge interface: %w", err)
-		}
-		bridgeLink, err := netlink.LinkByName(bridgeName)
+		exitCode, err := runContainer(ctx, container, os.Stdin, os.Stdout, os.Stderr, nil)
 		if err != nil {
-			return fmt.Errorf("failed to find bridge interface: %w", err)
-		}
-		addr := &netlink.Addr{
-			IPNet: &net.IPNet{
-				IP:   net.ParseIP(BridgeIP),
-				Mask: net.CIDRMask(BridgePrefix, 32),
-			},
+			return err
 		}
-		if err := netlink.AddrAdd(bridgeLink, addr); err != nil {
-			return fmt.Errorf("failed to add IP address to bridge %s: %w", BridgeIP, err)
+		if container.OOMKilled {
+			return fmt.Errorf("container was killed for running out of memory (exit code %d)", exitCode)
 		}
-		defer netlink.LinkDel(bridgeLink)
-		// create veth pair
-		hostVethAttrs := netlink.NewLinkAttrs()
-		hostVethAttrs.Name = hostVethName
-		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: hostVethAttrs, PeerName: ContainerVethName}); err != nil {
-			return fmt.Errorf("failed to create container veth pair: %w", err)
+		// Ignore Ctrl+D
+		if exitCode != 0 && exitCode != 130 {
+			return fmt.Errorf("container exited with code %d", exitCode)
 		}
-		hostVethLink, err := netlink.LinkByName(hostVethName)
+		return nil
+	},
+}
+
+// runContainer creates the container described by `container` and blocks until it exits,
+// returning its exit code. `ready` is called, if set, once the container process is running. All
+// host resources set up for the container are torn down before it returns and the container
+// state is left as stopped.
+func runContainer(ctx context.Context, container *Container, stdin io.Reader, stdout io.Writer, stderr io.Writer, ready func()) (int, error) {
+	log := Logger(ctx)
+	opts := container.Options
+	rootless := Rootless()
+
+	// catch every signal from the start so that setup is never cut short and teardown always
+	// runs, they are forwarded to the container process once it exists
+	sigChan := make(chan os.Signal, 16)
+	signal.Notify(sigChan, forwardedSignals()...)
+	defer signal.Stop(sigChan)
+
+	config, err := buildConfig(ctx, container)
+	if err != nil {
+		return -1, err
+	}
+	configPath, err := writeConfig(container, config)
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		// keeps the options `box update` changed while the container ran
+		container.Status = specs.StateStopped
+		container.Update(func(stored *Container) error {
+			stored.Status, stored.ExitCode, stored.OOMKilled = container.Status, container.ExitCode, container.OOMKilled
+			return nil
+		})
+		EmitEvent(ctx, container, EventStopped)
+	}()
+
+	// prepare overlay rootfs
+	var overlayArgs []string
+	if opts.Overlay {
+		lower, upper, work, err := prepareOverlay(ctx, container.ID, config, opts.Keep)
 		if err != nil {
-			return fmt.Errorf("failed to find host veth interface: %w", err)
+			return -1, fmt.Errorf("failed to prepare overlay rootfs: %w", err)
+		}
+		if !opts.Keep {
+			defer os.RemoveAll(upper)
+			defer os.RemoveAll(work)
 		}
-		containerVethLink, err := netlink.LinkByName(ContainerVethName)
+		overlayArgs = []string{"--lowerdir", lower, "--upperdir", upper, "--workdir", work}
+	}
+
+	log.Info("run", "container", container.ID)
+
+	// 1. allocate the container an address on the bridge network, which needs root
+	var network *ContainerNetwork
+	if !rootless {
+		network, err = AllocateNetwork(ctx, container.ID, opts.Subnet)
 		if err != nil {
-			return fmt.Errorf("failed to find container veth interface: %w", err)
+			return -1, fmt.Errorf("failed to allocate container network: %w", err)
 		}
-		defer netlink.LinkDel(hostVethLink) // destroys container veth too
-		// move container veth into container network namespace
-		if err := netlink.LinkSetNsPid(containerVethLink, child.Process.Pid); err != nil {
-			return fmt.Errorf("failed to move container veth into namespace for pid %d: %w", child.Process.Pid, err)
+		defer ReleaseNetwork(ctx, container.ID)
+	}
+
+	// 2. configure exec
+	childArgs := rootFlagArgs()
+	childArgs = append(childArgs, "child")
+	childArgs = append(childArgs, overlayArgs...)
+	childArgs = append(childArgs, "--config", configPath)
+	if opts.Init {
+		childArgs = append(childArgs, "--init")
+	}
+	if network != nil {
+		childArgs = append(childArgs, "--ip", network.CIDR(), "--gateway", network.Gateway)
+	}
+	childArgs = append(childArgs, container.Bundle)
+
+	child := exec.Command("/proc/self/exe", childArgs...)
+	child.Stdin = stdin
+	child.Stdout = stdout
+	child.Stderr = stderr
+	r, w, _ := os.Pipe() // create a pipe to communicate with the child
+	child.ExtraFiles = []*os.File{r}
+	child.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: CloneFlagsFromNamespaces(config.Linux.Namespaces),
+	}
+	// give the container a pty as its stdio and controlling terminal
+	var console *Console
+	if config.Process.Terminal {
+		if console, err = NewConsole(); err != nil {
+			return -1, err
 		}
-		// attach host to bridge
-		if err := netlink.LinkSetMaster(hostVethLink, bridgeLink); err != nil {
-			return fmt.Errorf("failed to attach host veth to bridge: %w", err)
+		defer console.Close()
+		child.Stdin = console.Slave
+		child.Stdout = console.Slave
+		child.Stderr = console.Slave
+		child.SysProcAttr.Setsid = true
+		child.SysProcAttr.Setctty = true
+	}
+	if HasNamespace(config.Linux.Namespaces, specs.UserNamespace) {
+		err = StartInUserNamespace(child, config.Linux.UIDMappings, config.Linux.GIDMappings)
+	} else {
+		err = child.Start()
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to start child process: %w", err)
+	}
+	// don't leave the child blocked on the pipe if setup fails
+	defer func() {
+		if child.ProcessState == nil {
+			child.Process.Kill()
+			child.Wait()
 		}
-		// bring UP interfaces
-		if err := netlink.LinkSetUp(bridgeLink); err != nil {
-			return fmt.Errorf("failed to set bridge UP: %w", err)
+	}()
+	if console != nil {
+		if err := console.Attach(stdin, stdout); err != nil {
+			return -1, err
 		}
-		if err := netlink.LinkSetUp(hostVethLink); err != nil {
-			return fmt.Errorf("failed to set host veth UP: %w", err)
+	}
+	container.Pid, container.PidStartTime = child.Process.Pid, processStartTime(child.Process.Pid)
+	container.Network = network
+
+	// 3. connect container to the bridge, or to the host network with slirp4netns when rootless
+	if network != nil {
+		if err := ConnectContainer(network, child.Process.Pid); err != nil {
+			return -1, err
 		}
+		defer DisconnectContainer(network)
 		// setup NAT
-		ipForwardEnabled, err := SetupNAT(ContainerIP, portMapping)
-		defer CleanupNAT(ContainerIP, portMapping, ipForwardEnabled)
+		err = SetupNAT(network.IP, opts.Port)
+		defer CleanupNAT(network.IP, opts.Port)
 		if err != nil {
-			return fmt.Errorf("failed to setup container NAT: %w", err)
+			return -1, fmt.Errorf("failed to setup container NAT: %w", err)
+		}
+	} else if HasNamespace(config.Linux.Namespaces, specs.NetworkNamespace) {
+		stopSlirp, err := StartSlirp4netns(child.Process.Pid, opts.Port)
+		if errors.Is(err, exec.ErrNotFound) {
+			if opts.Port != "" {
+				return -1, errors.New("publishing a port in rootless mode needs slirp4netns")
+			}
+			log.Warn("slirp4netns is not installed, the container only has a loopback interface")
+		} else if err != nil {
+			return -1, err
+		} else {
+			defer stopSlirp()
 		}
+	}
 
-		// 3. place child in cgroup using systemd
-		conn, err := systemd.NewWithContext(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to connect to systemd dbus (sorry box doesn't support non-systemd): %w", err)
+	// 4. place child in a cgroup with its resource limits, using systemd or writing to cgroupfs
+	//    directly
+	cgroupManager, err := NewCgroupManager(opts.CgroupManager, container, config)
+	if err != nil {
+		return -1, err
+	}
+	// registered first so that a cgroup which Apply created is removed when it fails part way
+	defer func() {
+		// the cgroup can only be removed once the child has exited, systemd removes the scope
+		// itself once it is empty
+		if child.ProcessState == nil {
+			child.Process.Kill()
+			child.Wait()
 		}
-		defer conn.Close()
-		unitName := fmt.Sprintf("box-container-%d.scope", child.Process.Pid)
-		properties := []systemd.Property{
-			{Name: "PIDs", Value: dbus.MakeVariant([]uint32{uint32(child.Process.Pid)})},
-			{Name: "Description", Value: dbus.MakeVariant("Box container scope")},
+		if err := cgroupManager.Destroy(); err != nil {
+			log.Warn("failed to remove container cgroup", "err", err)
 		}
-		if cpuCount != -1 && cpuCount > 1 && cpuCount <= runtime.NumCPU() {
-			properties = append(properties, systemd.Property{
-				Name:  "CPUQuotaPerSecUSec",
-				Value: dbus.MakeVariant(uint64(cpuCount) * 100000),
-			})
+	}()
+	if err := cgroupManager.Apply(ctx, child.Process.Pid, config.Linux.Resources); err != nil {
+		return -1, err
+	}
+	// report the processes the OOM killer kills, and whether one was the container process
+	var oomKills uint64
+	if path := cgroupManager.Path(); path != "" {
+		oomKills, _ = oomKillCount(path)
+		stopWatching, err := WatchOOMKills(path, func() { EmitEvent(ctx, container, EventOOM) })
+		if err != nil {
+			log.Debug("not watching for OOM kills", "err", err)
+		} else {
+			defer stopWatching()
+		}
+	}
+	// only the host can restrict devices, a rootless container can only bind mount the devices
+	// its user already has access to
+	if !rootless && cgroupManager.Path() != "" {
+		if err := ApplyDeviceCgroup(cgroupManager.Path(), config.Linux.Resources.Devices); err != nil {
+			return -1, err
 		}
-		if memoryMiB != -1 {
-			properties = append(properties, systemd.Property{
-				Name: "MemoryMax", Value: dbus.MakeVariant(uint64(memoryMiB) * 1048576),
-			})
+	}
+
+	cgroupUnit := ""
+	if m, ok := cgroupManager.(*systemdManager); ok {
+		cgroupUnit = m.unit
+	}
+	if err := container.Update(func(stored *Container) error {
+		stored.Status = specs.StateCreated
+		stored.Pid, stored.PidStartTime, stored.Network = container.Pid, container.PidStartTime, container.Network
+		stored.CgroupPath, stored.CgroupUnit = cgroupManager.Path(), cgroupUnit
+		return nil
+	}); err != nil {
+		return -1, err
+	}
+	EmitEvent(ctx, container, EventCreated)
+
+	// 5. signal child to continue
+	w.Close()
+	if err := container.Update(func(stored *Container) error {
+		stored.Status = specs.StateRunning
+		return nil
+	}); err != nil {
+		return -1, err
+	}
+	EmitEvent(ctx, container, EventStarted)
+	if ready != nil {
+		ready()
+	}
+
+	// 6. wait for exit, forwarding signals to the container process in the meantime
+	forwardingDone := make(chan struct{})
+	go forwardSignals(ctx, child.Process, sigChan, stopSignal(config), time.Duration(opts.StopTimeout)*time.Second, forwardingDone)
+	err = child.Wait()
+	close(forwardingDone)
+	exitCode := ExitCodeFromState(child.ProcessState)
+	container.ExitCode = &exitCode
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return -1, fmt.Errorf("error waiting for child process: %w", err)
 		}
-		doneChan := make(chan string, 1)
-		if _, err := conn.StartTransientUnitContext(ctx, unitName, "replace", properties, doneChan); err != nil {
-			return fmt.Errorf("failed to start transient unit for container: %w", err)
+	}
+	// the OOM killer kills with SIGKILL, which the kill count tells apart from any other
+	if exitCode == 128+int(syscall.SIGKILL) && container.CgroupPath != "" {
+		if count, err := oomKillCount(container.CgroupPath); err == nil && count > oomKills {
+			container.OOMKilled = true
+			log.Error("container was killed for exceeding its memory limit", "container", container.ID)
 		}
+	}
+	EmitEvent(ctx, container, EventExited)
+
+	return exitCode, nil
+}
+
+// forwardSignals sends the signals received on `signals` to `process` until `done` is closed.
+// SIGINT and SIGTERM ask the container to stop, so they are sent as `stopSignal`, and the process
+// is killed if it has not exited `stopTimeout` later.
+func forwardSignals(ctx context.Context, process *os.Process, signals <-chan os.Signal, stopSignal syscall.Signal, stopTimeout time.Duration, done <-chan struct{}) {
+	log := Logger(ctx)
+	var kill <-chan time.Time
+	for {
 		select {
-		case <-doneChan:
-		case <-ctx.Done():
-			return fmt.Errorf("timeout waiting for start transient unit: %w", ctx.Err())
+		case <-done:
+			return
+		case <-kill:
+			log.Info("container did not stop in time, killing it")
+			process.Signal(syscall.SIGKILL)
+			kill = nil
+		case sig := <-signals:
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				if kill == nil {
+					log.Info("stopping container", "signal", unix.SignalName(stopSignal), "timeout", stopTimeout)
+					kill = time.After(stopTimeout)
+				}
+				sig = stopSignal
+			}
+			log.Debug("forwarding signal to container", "signal", sig)
+			process.Signal(sig)
+		}
+	}
+}
+
+// forwardedSignals returns every signal which can be caught, including the real-time signals,
+// except those about box itself. The pty forwards changes to the window size. Signals 32 and 33
+// are reserved by the C library and can't be sent to the container.
+func forwardedSignals() []os.Signal {
+	var signals []os.Signal
+	for sig := syscall.Signal(1); sig <= sigRTMAX; sig++ {
+		switch {
+		case sig == syscall.SIGKILL, sig == syscall.SIGSTOP, sig == syscall.SIGCHLD, sig == syscall.SIGPIPE, sig == syscall.SIGURG, sig == syscall.SIGWINCH:
+			continue
+		case sig > unix.SIGSYS && sig < sigRTMIN:
+			continue
 		}
+		signals = append(signals, sig)
+	}
+	return signals
+}
 
-		// 4. signal child to continue
-		w.Close()
+// prepareOverlay creates the writable layer for container `containerId` and returns the overlay
+// lower dirs (highest layer first), upper dir and work dir. The lower dirs are the unpacked layers
+// of the image the bundle was created from. Unless `keep` is set, any writable layer left over
+// from a previous run is discarded first.
+func prepareOverlay(ctx context.Context, containerId string, config *specs.Spec, keep bool) (string, string, string, error) {
+	image, err := bundleImage(config)
+	if err != nil {
+		return "", "", "", err
+	}
+	store, err := OpenStore(stateRoot)
+	if err != nil {
+		return "", "", "", err
+	}
+	layerPaths, err := store.UnpackLayers(ctx, image)
+	if err != nil {
+		return "", "", "", err
+	}
+	slices.Reverse(layerPaths)
 
-		// 5. wait for exit
-		if err := child.Wait(); err != nil {
-			var exitErr *exec.ExitError
-			if errors.As(err, &exitErr) && exitErr.ExitCode() == 130 {
-				// Ignore Ctrl+D
-				return nil
-			}
-			return fmt.Errorf("error waiting for child process: %w", err)
+	upper := filepath.Join(containerPath(containerId), "upper")
+	work := filepath.Join(containerPath(containerId), "work")
+	if !keep {
+		if err := os.RemoveAll(upper); err != nil {
+			return "", "", "", err
 		}
+		if err := os.RemoveAll(work); err != nil {
+			return "", "", "", err
+		}
+	}
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", "", err
+		}
+	}
 
-		return nil
-	},
+	return strings.Join(layerPaths, ":"), upper, work, nil
 }
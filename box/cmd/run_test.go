@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestForwardedSignals(t *testing.T) {
+	signals := forwardedSignals()
+
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGSYS, sigRTMIN, sigRTMIN + 1, sigRTMAX} {
+		if !slices.Contains(signals, os.Signal(sig)) {
+			t.Errorf("%v (%d) is not forwarded", unix.SignalName(sig), int(sig))
+		}
+	}
+	for _, sig := range []syscall.Signal{syscall.SIGKILL, syscall.SIGSTOP, syscall.SIGCHLD, syscall.SIGPIPE, syscall.SIGURG, syscall.SIGWINCH, 32, 33, sigRTMAX + 1} {
+		if slices.Contains(signals, os.Signal(sig)) {
+			t.Errorf("signal %d is forwarded", int(sig))
+		}
+	}
+	if want := int(sigRTMAX) - 2 - 6; len(signals) != want {
+		t.Errorf("got %d signals, want %d", len(signals), want)
+	}
+}
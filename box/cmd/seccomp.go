@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"unsafe"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// offsets into struct seccomp_data, the input of a seccomp filter. Arguments are 64 bit and
+// little endian on every architecture with a syscall table.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// seccompMaxInstructions is BPF_MAXINSNS, the longest filter the kernel accepts.
+const seccompMaxInstructions = 4096
+
+var seccompArchMap = map[specs.Arch]uint32{
+	specs.ArchX86:         unix.AUDIT_ARCH_I386,
+	specs.ArchX86_64:      unix.AUDIT_ARCH_X86_64,
+	specs.ArchARM:         unix.AUDIT_ARCH_ARM,
+	specs.ArchAARCH64:     unix.AUDIT_ARCH_AARCH64,
+	specs.ArchMIPS:        unix.AUDIT_ARCH_MIPS,
+	specs.ArchMIPS64:      unix.AUDIT_ARCH_MIPS64,
+	specs.ArchMIPS64N32:   unix.AUDIT_ARCH_MIPS64N32,
+	specs.ArchMIPSEL:      unix.AUDIT_ARCH_MIPSEL,
+	specs.ArchMIPSEL64:    unix.AUDIT_ARCH_MIPSEL64,
+	specs.ArchMIPSEL64N32: unix.AUDIT_ARCH_MIPSEL64N32,
+	specs.ArchPPC:         unix.AUDIT_ARCH_PPC,
+	specs.ArchPPC64:       unix.AUDIT_ARCH_PPC64,
+	specs.ArchPPC64LE:     unix.AUDIT_ARCH_PPC64LE,
+	specs.ArchS390:        unix.AUDIT_ARCH_S390,
+	specs.ArchS390X:       unix.AUDIT_ARCH_S390X,
+	specs.ArchRISCV64:     unix.AUDIT_ARCH_RISCV64,
+}
+
+var seccompFlagMap = map[specs.LinuxSeccompFlag]uintptr{
+	specs.LinuxSeccompFlagLog:              unix.SECCOMP_FILTER_FLAG_LOG,
+	specs.LinuxSeccompFlagSpecAllow:        unix.SECCOMP_FILTER_FLAG_SPEC_ALLOW,
+	specs.LinuxSeccompFlagWaitKillableRecv: unix.SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV,
+}
+
+// InstallSeccomp compiles the seccomp config from an OCI runtime config and applies it to every
+// thread of the current process. Unless the process has CAP_SYS_ADMIN this must happen after
+// no_new_privs is set.
+func InstallSeccomp(seccomp *specs.LinuxSeccomp) error {
+	if seccomp == nil {
+		return nil
+	}
+	filter, err := CompileSeccomp(seccomp)
+	if err != nil {
+		return err
+	}
+	// the Go runtime has several threads, any of which may execve
+	flags := uintptr(unix.SECCOMP_FILTER_FLAG_TSYNC)
+	for _, flag := range seccomp.Flags {
+		flags |= seccompFlagMap[flag]
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, flags, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
+
+// CompileSeccomp compiles the seccomp config from an OCI runtime config into a classic BPF
+// program. Syscalls from the native architecture are checked against the rules in order, and the
+// first matching rule decides the action. Syscalls from the other architectures in the config
+// fail with ENOSYS as there are no syscall tables for them, and syscalls from architectures which
+// are not in the config kill the process. Syscall names which do not exist on the native
+// architecture are ignored, so one profile can cover several architectures.
+// See: https://github.com/opencontainers/runtime-spec/blob/main/config-linux.md#seccomp
+func CompileSeccomp(seccomp *specs.LinuxSeccomp) ([]unix.SockFilter, error) {
+	if seccompNativeArch == "" {
+		return nil, errors.New("seccomp is not supported on this architecture")
+	}
+	for _, flag := range seccomp.Flags {
+		if _, ok := seccompFlagMap[flag]; !ok {
+			return nil, fmt.Errorf("unsupported seccomp flag %s", flag)
+		}
+	}
+	defaultAction, err := seccompAction(seccomp.DefaultAction, seccomp.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seccomp default action: %w", err)
+	}
+	enosys := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS))
+	killProcess := uint32(unix.SECCOMP_RET_KILL_PROCESS)
+
+	// 1. architecture
+	architectures := seccomp.Architectures
+	if len(architectures) == 0 {
+		architectures = []specs.Arch{seccompNativeArch}
+	}
+	if !slices.Contains(architectures, seccompNativeArch) {
+		return nil, fmt.Errorf("seccomp architectures %v do not include the native architecture %s", architectures, seccompNativeArch)
+	}
+	filter := []unix.SockFilter{bpfLoad(seccompDataArch)}
+	for _, arch := range architectures {
+		if arch == seccompNativeArch || arch == specs.ArchX32 {
+			continue
+		}
+		auditArch, ok := seccompArchMap[arch]
+		if !ok {
+			return nil, fmt.Errorf("unsupported seccomp architecture %s", arch)
+		}
+		filter = append(filter,
+			bpfJump(unix.BPF_JEQ, auditArch, 0, 1),
+			bpfRet(enosys),
+		)
+	}
+	filter = append(filter,
+		bpfJump(unix.BPF_JEQ, seccompNativeAuditArch, 1, 0),
+		bpfRet(killProcess),
+		bpfLoad(seccompDataNr),
+	)
+	if seccompX32SyscallBit != 0 {
+		x32Action := killProcess
+		if slices.Contains(architectures, specs.ArchX32) {
+			x32Action = enosys
+		}
+		filter = append(filter,
+			bpfJump(unix.BPF_JGE, seccompX32SyscallBit, 0, 1),
+			bpfRet(x32Action),
+		)
+	}
+
+	// 2. syscall rules
+	for _, syscall := range seccomp.Syscalls {
+		action, err := seccompAction(syscall.Action, syscall.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seccomp action for %v: %w", syscall.Names, err)
+		}
+		// conditions on different arguments must all match, but like runc several conditions on
+		// the same argument are separate rules of which any can match
+		var rules [][]specs.LinuxSeccompArg
+		if hasRepeatedArg(syscall.Args) {
+			for _, arg := range syscall.Args {
+				rules = append(rules, []specs.LinuxSeccompArg{arg})
+			}
+		} else {
+			rules = append(rules, syscall.Args)
+		}
+		var block []unix.SockFilter
+		for _, args := range rules {
+			rule, err := compileSeccompRule(args, action)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seccomp rule for %v: %w", syscall.Names, err)
+			}
+			block = append(block, rule...)
+		}
+
+		for _, name := range syscall.Names {
+			nr, ok := seccompSyscalls[name]
+			if !ok {
+				continue
+			}
+			if len(syscall.Args) == 0 {
+				filter = append(filter,
+					bpfJump(unix.BPF_JEQ, nr, 0, 1),
+					bpfRet(action),
+				)
+				continue
+			}
+			// the conditions overwrite the syscall number so it is loaded again after them
+			filter = append(filter,
+				bpfJump(unix.BPF_JEQ, nr, 1, 0),
+				unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA, K: uint32(len(block) + 1)},
+			)
+			filter = append(filter, block...)
+			filter = append(filter, bpfLoad(seccompDataNr))
+		}
+	}
+
+	// 3. everything else
+	filter = append(filter, bpfRet(defaultAction))
+	if len(filter) > seccompMaxInstructions {
+		return nil, fmt.Errorf("seccomp filter is too long with %d instructions", len(filter))
+	}
+	return filter, nil
+}
+
+// compileSeccompRule returns the instructions which check the argument conditions `args` and
+// return `action` if they all match. A failing condition jumps past the end of the rule.
+func compileSeccompRule(args []specs.LinuxSeccompArg, action uint32) ([]unix.SockFilter, error) {
+	var rule []unix.SockFilter
+	// instructions whose true or false branch jumps past the end of the rule
+	type failJump struct {
+		index int
+		jt    bool
+	}
+	var fails []failJump
+	fail := func(jt bool) {
+		fails = append(fails, failJump{len(rule) - 1, jt})
+	}
+
+	for _, arg := range args {
+		if arg.Index >= 6 {
+			return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+		low := uint32(seccompDataArgs + 8*arg.Index)
+		high := low + 4
+		valueHigh, valueLow := uint32(arg.Value>>32), uint32(arg.Value)
+
+		switch arg.Op {
+		case specs.OpEqualTo:
+			rule = append(rule, bpfLoad(high), bpfJump(unix.BPF_JEQ, valueHigh, 0, 0))
+			fail(false)
+			rule = append(rule, bpfLoad(low), bpfJump(unix.BPF_JEQ, valueLow, 0, 0))
+			fail(false)
+		case specs.OpNotEqual:
+			// different high half matches without checking the low half
+			rule = append(rule, bpfLoad(high), bpfJump(unix.BPF_JEQ, valueHigh, 0, 2))
+			rule = append(rule, bpfLoad(low), bpfJump(unix.BPF_JEQ, valueLow, 0, 0))
+			fail(true)
+		case specs.OpMaskedEqual:
+			// Value is the mask and ValueTwo what the masked argument must equal
+			twoHigh, twoLow := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+			rule = append(rule, bpfLoad(high), bpfAnd(valueHigh), bpfJump(unix.BPF_JEQ, twoHigh, 0, 0))
+			fail(false)
+			rule = append(rule, bpfLoad(low), bpfAnd(valueLow), bpfJump(unix.BPF_JEQ, twoLow, 0, 0))
+			fail(false)
+		case specs.OpGreaterThan, specs.OpGreaterEqual:
+			// greater high half matches, equal high half compares the low half
+			rule = append(rule, bpfLoad(high), bpfJump(unix.BPF_JGT, valueHigh, 3, 0))
+			rule = append(rule, bpfJump(unix.BPF_JEQ, valueHigh, 0, 0))
+			fail(false)
+			op := uint16(unix.BPF_JGT)
+			if arg.Op == specs.OpGreaterEqual {
+				op = unix.BPF_JGE
+			}
+			rule = append(rule, bpfLoad(low), bpfJump(op, valueLow, 0, 0))
+			fail(false)
+		case specs.OpLessThan, specs.OpLessEqual:
+			// smaller high half matches, equal high half compares the low half
+			rule = append(rule, bpfLoad(high), bpfJump(unix.BPF_JGT, valueHigh, 0, 0))
+			fail(true)
+			rule = append(rule, bpfJump(unix.BPF_JEQ, valueHigh, 0, 2))
+			op := uint16(unix.BPF_JGE)
+			if arg.Op == specs.OpLessEqual {
+				op = unix.BPF_JGT
+			}
+			rule = append(rule, bpfLoad(low), bpfJump(op, valueLow, 0, 0))
+			fail(true)
+		default:
+			return nil, fmt.Errorf("unsupported operator %s", arg.Op)
+		}
+	}
+	rule = append(rule, bpfRet(action))
+
+	for _, f := range fails {
+		offset := len(rule) - f.index - 1
+		if offset > 255 {
+			return nil, errors.New("too many argument conditions")
+		}
+		if f.jt {
+			rule[f.index].Jt = uint8(offset)
+		} else {
+			rule[f.index].Jf = uint8(offset)
+		}
+	}
+	return rule, nil
+}
+
+// seccompAction returns the filter return value for an OCI seccomp action. ERRNO and TRACE return
+// `errnoRet`, or EPERM if it is not set.
+func seccompAction(action specs.LinuxSeccompAction, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+	switch action {
+	case specs.ActKill, specs.ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case specs.ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case specs.ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case specs.ActErrno:
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case specs.ActTrace:
+		return unix.SECCOMP_RET_TRACE | (errno & unix.SECCOMP_RET_DATA), nil
+	case specs.ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	case specs.ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	default:
+		return 0, fmt.Errorf("unsupported action %s", action)
+	}
+}
+
+func hasRepeatedArg(args []specs.LinuxSeccompArg) bool {
+	seen := map[uint]bool{}
+	for _, arg := range args {
+		if seen[arg.Index] {
+			return true
+		}
+		seen[arg.Index] = true
+	}
+	return false
+}
+
+func bpfLoad(offset uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offset}
+}
+
+func bpfAnd(mask uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_ALU | unix.BPF_AND | unix.BPF_K, K: mask}
+}
+
+func bpfJump(op uint16, value uint32, jt uint8, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_JMP | op | unix.BPF_K, K: value, Jt: jt, Jf: jf}
+}
+
+func bpfRet(value uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: value}
+}
@@ -0,0 +1,16 @@
+//go:build !amd64 && !arm64
+
+package cmd
+
+import "github.com/opencontainers/runtime-spec/specs-go"
+
+// seccomp is only supported on architectures with a syscall table
+const (
+	seccompNativeArch      specs.Arch = ""
+	seccompNativeAuditArch            = 0
+	seccompX32SyscallBit              = 0
+)
+
+var seccompDefaultArchitectures []specs.Arch
+
+var seccompSyscalls = map[string]uint32{}
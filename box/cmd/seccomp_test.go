@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// seccompCall is a syscall made by the container, from the native architecture unless `arch` is
+// set.
+type seccompCall struct {
+	name string
+	arch uint32
+	args [6]uint64
+	want uint32
+}
+
+// runSeccomp runs the classic BPF program `filter` on the seccomp_data of `call` like the kernel
+// would, and returns the action.
+func runSeccomp(t *testing.T, filter []unix.SockFilter, call seccompCall) uint32 {
+	t.Helper()
+
+	nr, ok := seccompSyscalls[call.name]
+	if !ok {
+		t.Fatalf("unknown syscall %s", call.name)
+	}
+	arch := call.arch
+	if arch == 0 {
+		arch = seccompNativeAuditArch
+	}
+	data := make([]byte, seccompDataArgs+8*6)
+	binary.LittleEndian.PutUint32(data[seccompDataNr:], nr)
+	binary.LittleEndian.PutUint32(data[seccompDataArch:], arch)
+	for i, arg := range call.args {
+		binary.LittleEndian.PutUint64(data[seccompDataArgs+8*i:], arg)
+	}
+
+	var a uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			if int(ins.K)+4 > len(data) {
+				t.Fatalf("load out of bounds at %d: %d", pc, ins.K)
+			}
+			a = binary.LittleEndian.Uint32(data[ins.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			a &= ins.K
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(ins.K)
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			var match bool
+			switch ins.Code & 0xf0 {
+			case unix.BPF_JEQ:
+				match = a == ins.K
+			case unix.BPF_JGT:
+				match = a > ins.K
+			case unix.BPF_JGE:
+				match = a >= ins.K
+			}
+			if match {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction at %d: %#x", pc, ins.Code)
+		}
+	}
+	t.Fatal("filter ended without returning")
+	return 0
+}
+
+// requireSeccomp skips tests on architectures without a syscall table.
+func requireSeccomp(t *testing.T) {
+	t.Helper()
+	if seccompNativeArch == "" {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+}
+
+func TestCompileSeccomp(t *testing.T) {
+	requireSeccomp(t)
+
+	allow := uint32(unix.SECCOMP_RET_ALLOW)
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	enoent := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOENT))
+	enosys := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS))
+	killProcess := uint32(unix.SECCOMP_RET_KILL_PROCESS)
+
+	// getpid fails with EPERM when its first argument matches the condition
+	condition := func(arg specs.LinuxSeccompArg) *specs.LinuxSeccomp {
+		return &specs.LinuxSeccomp{
+			DefaultAction: specs.ActAllow,
+			Syscalls:      []specs.LinuxSyscall{{Names: []string{"getpid"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{arg}}},
+		}
+	}
+	// the value of the conditions, and arguments around it whose high and low words differ
+	const (
+		value       = 0x1_0000_0005
+		highGreater = 0x2_0000_0000
+		highLess    = 0x0_ffff_ffff
+		lowGreater  = 0x1_0000_0006
+		lowLess     = 0x1_0000_0004
+	)
+	getpid := func(arg uint64, want uint32) seccompCall {
+		return seccompCall{name: "getpid", args: [6]uint64{arg}, want: want}
+	}
+
+	tests := []struct {
+		name    string
+		seccomp *specs.LinuxSeccomp
+		calls   []seccompCall
+	}{
+		{
+			name: "default action",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActErrno,
+				Syscalls:      []specs.LinuxSyscall{{Names: []string{"getpid"}, Action: specs.ActAllow}},
+			},
+			calls: []seccompCall{{name: "getpid", want: allow}, {name: "read", want: eperm}},
+		},
+		{
+			name: "errno",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Syscalls:      []specs.LinuxSyscall{{Names: []string{"read", "write"}, Action: specs.ActErrno, ErrnoRet: ptr(uint(unix.ENOENT))}},
+			},
+			calls: []seccompCall{{name: "read", want: enoent}, {name: "write", want: enoent}, {name: "getpid", want: allow}},
+		},
+		{
+			name: "first matching rule wins",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Syscalls: []specs.LinuxSyscall{
+					{Names: []string{"getpid"}, Action: specs.ActKillProcess},
+					{Names: []string{"getpid", "read"}, Action: specs.ActErrno},
+				},
+			},
+			calls: []seccompCall{{name: "getpid", want: killProcess}, {name: "read", want: eperm}},
+		},
+		{
+			name: "unknown syscalls are ignored",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Syscalls:      []specs.LinuxSyscall{{Names: []string{"no_such_syscall", "getpid"}, Action: specs.ActErrno}},
+			},
+			calls: []seccompCall{{name: "getpid", want: eperm}},
+		},
+		{
+			name: "other architectures",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Architectures: []specs.Arch{seccompNativeArch, specs.ArchS390X},
+			},
+			calls: []seccompCall{
+				{name: "getpid", want: allow},
+				{name: "getpid", arch: unix.AUDIT_ARCH_S390X, want: enosys},
+				{name: "getpid", arch: unix.AUDIT_ARCH_PPC64LE, want: killProcess},
+			},
+		},
+		{
+			name:    "equal",
+			seccomp: condition(specs.LinuxSeccompArg{Value: value, Op: specs.OpEqualTo}),
+			calls:   []seccompCall{getpid(value, eperm), getpid(highGreater|5, allow), getpid(lowGreater, allow)},
+		},
+		{
+			name:    "not equal",
+			seccomp: condition(specs.LinuxSeccompArg{Value: value, Op: specs.OpNotEqual}),
+			calls:   []seccompCall{getpid(value, allow), getpid(highGreater|5, eperm), getpid(lowGreater, eperm)},
+		},
+		{
+			name:    "greater than",
+			seccomp: condition(specs.LinuxSeccompArg{Value: value, Op: specs.OpGreaterThan}),
+			calls: []seccompCall{
+				getpid(value, allow), getpid(highGreater, eperm), getpid(lowGreater, eperm),
+				getpid(highLess, allow), getpid(lowLess, allow),
+			},
+		},
+		{
+			name:    "greater or equal",
+			seccomp: condition(specs.LinuxSeccompArg{Value: value, Op: specs.OpGreaterEqual}),
+			calls: []seccompCall{
+				getpid(value, eperm), getpid(highGreater, eperm), getpid(lowGreater, eperm),
+				getpid(highLess, allow), getpid(lowLess, allow),
+			},
+		},
+		{
+			name:    "less than",
+			seccomp: condition(specs.LinuxSeccompArg{Value: value, Op: specs.OpLessThan}),
+			calls: []seccompCall{
+				getpid(value, allow), getpid(highGreater, allow), getpid(lowGreater, allow),
+				getpid(highLess, eperm), getpid(lowLess, eperm),
+			},
+		},
+		{
+			name:    "less or equal",
+			seccomp: condition(specs.LinuxSeccompArg{Value: value, Op: specs.OpLessEqual}),
+			calls: []seccompCall{
+				getpid(value, eperm), getpid(highGreater, allow), getpid(lowGreater, allow),
+				getpid(highLess, eperm), getpid(lowLess, eperm),
+			},
+		},
+		{
+			name:    "masked equal",
+			seccomp: condition(specs.LinuxSeccompArg{Value: 0xff_0000_00ff, ValueTwo: value, Op: specs.OpMaskedEqual}),
+			calls:   []seccompCall{getpid(value, eperm), getpid(0x1_1234_5605, eperm), getpid(highGreater|5, allow), getpid(lowGreater, allow)},
+		},
+		{
+			name: "conditions on different arguments all match",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Syscalls: []specs.LinuxSyscall{{Names: []string{"getpid"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{
+					{Index: 0, Value: 1, Op: specs.OpEqualTo},
+					{Index: 5, Value: 2, Op: specs.OpEqualTo},
+				}}},
+			},
+			calls: []seccompCall{
+				{name: "getpid", args: [6]uint64{1, 0, 0, 0, 0, 2}, want: eperm},
+				{name: "getpid", args: [6]uint64{1, 0, 0, 0, 0, 3}, want: allow},
+				{name: "getpid", args: [6]uint64{0, 0, 0, 0, 0, 2}, want: allow},
+			},
+		},
+		{
+			name: "conditions on the same argument any match",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Syscalls: []specs.LinuxSyscall{{Names: []string{"getpid"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{
+					{Index: 0, Value: 1, Op: specs.OpEqualTo},
+					{Index: 0, Value: 2, Op: specs.OpEqualTo},
+				}}},
+			},
+			calls: []seccompCall{getpid(1, eperm), getpid(2, eperm), getpid(3, allow)},
+		},
+		{
+			name: "syscall number is reloaded after conditions",
+			seccomp: &specs.LinuxSeccomp{
+				DefaultAction: specs.ActAllow,
+				Syscalls: []specs.LinuxSyscall{
+					{Names: []string{"getpid"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Index: 0, Value: 1, Op: specs.OpEqualTo}}},
+					{Names: []string{"read"}, Action: specs.ActKillProcess},
+				},
+			},
+			calls: []seccompCall{getpid(0, allow), {name: "read", want: killProcess}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := CompileSeccomp(test.seccomp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, call := range test.calls {
+				if got := runSeccomp(t, filter, call); got != call.want {
+					t.Errorf("%s%v (arch %#x): got %#x, want %#x", call.name, call.args, call.arch, got, call.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSeccompErrors(t *testing.T) {
+	requireSeccomp(t)
+
+	// a condition on the same argument is a separate rule, so this is longer than the kernel allows
+	var tooLong []specs.LinuxSeccompArg
+	for i := range seccompMaxInstructions {
+		tooLong = append(tooLong, specs.LinuxSeccompArg{Index: 0, Value: uint64(i), Op: specs.OpEqualTo})
+	}
+
+	tests := []struct {
+		name    string
+		seccomp specs.LinuxSeccomp
+		wantErr string
+	}{
+		{
+			name:    "unsupported default action",
+			seccomp: specs.LinuxSeccomp{DefaultAction: "SCMP_ACT_FOO"},
+			wantErr: "invalid seccomp default action",
+		},
+		{
+			name:    "unsupported flag",
+			seccomp: specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Flags: []specs.LinuxSeccompFlag{"SECCOMP_FILTER_FLAG_FOO"}},
+			wantErr: "unsupported seccomp flag",
+		},
+		{
+			name:    "missing native architecture",
+			seccomp: specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Architectures: []specs.Arch{specs.ArchS390X}},
+			wantErr: "do not include the native architecture",
+		},
+		{
+			name:    "unsupported architecture",
+			seccomp: specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Architectures: []specs.Arch{seccompNativeArch, "SCMP_ARCH_FOO"}},
+			wantErr: "unsupported seccomp architecture",
+		},
+		{
+			name: "unsupported operator",
+			seccomp: specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Syscalls: []specs.LinuxSyscall{
+				{Names: []string{"getpid"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Op: "SCMP_CMP_FOO"}}},
+			}},
+			wantErr: "unsupported operator",
+		},
+		{
+			name: "invalid argument index",
+			seccomp: specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Syscalls: []specs.LinuxSyscall{
+				{Names: []string{"getpid"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Index: 6, Op: specs.OpEqualTo}}},
+			}},
+			wantErr: "invalid argument index",
+		},
+		{
+			name: "too many instructions",
+			seccomp: specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Syscalls: []specs.LinuxSyscall{
+				{Names: []string{"getpid"}, Action: specs.ActErrno, Args: tooLong},
+			}},
+			wantErr: "seccomp filter is too long",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileSeccomp(&test.seccomp)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultSeccompProfile(t *testing.T) {
+	requireSeccomp(t)
+
+	allow := uint32(unix.SECCOMP_RET_ALLOW)
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	enosys := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS))
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		calls        []seccompCall
+	}{
+		{
+			name: "no capabilities",
+			calls: []seccompCall{
+				{name: "read", want: allow},
+				{name: "reboot", want: eperm},
+				{name: "mount", want: eperm},
+				{name: "socket", args: [6]uint64{unix.AF_INET}, want: allow},
+				{name: "socket", args: [6]uint64{unix.AF_VSOCK}, want: eperm},
+				{name: "personality", args: [6]uint64{0xffffffff}, want: allow},
+				{name: "personality", args: [6]uint64{0x0040000}, want: eperm},
+				{name: "clone", args: [6]uint64{unix.CLONE_THREAD | unix.CLONE_VM}, want: allow},
+				{name: "clone", args: [6]uint64{unix.CLONE_NEWNS}, want: eperm},
+				{name: "clone3", want: enosys},
+				{name: "read", arch: unix.AUDIT_ARCH_S390X, want: unix.SECCOMP_RET_KILL_PROCESS},
+			},
+		},
+		{
+			name:         "capabilities",
+			capabilities: []string{"CAP_SYS_ADMIN", "CAP_SYS_BOOT"},
+			calls: []seccompCall{
+				{name: "reboot", want: allow},
+				{name: "mount", want: allow},
+				{name: "clone", args: [6]uint64{unix.CLONE_NEWNS}, want: allow},
+				{name: "clone3", want: allow},
+				{name: "init_module", want: eperm},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := CompileSeccomp(DefaultSeccompProfile(test.capabilities))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, call := range test.calls {
+				if got := runSeccomp(t, filter, call); got != call.want {
+					t.Errorf("%s%v (arch %#x): got %#x, want %#x", call.name, call.args, call.arch, got, call.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+)
+
+var startCmd = &cobra.Command{
+	Use:   "start <container-id>",
+	Short: "start a stopped container in the background",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+
+		// checked under the lock, so that only one of two concurrent starts wins
+		if err := container.Update(func(stored *Container) error {
+			if err := restartable(stored); err != nil {
+				return err
+			}
+			stored.Status = specs.StateCreating
+			stored.Pid, stored.PidStartTime = 0, 0
+			stored.MonitorPid, stored.MonitorStartTime = 0, 0
+			stored.ExitCode = nil
+			stored.OOMKilled = false
+			stored.Detached = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		return startMonitor(container)
+	},
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var stateFormat string
+
+func init() {
+	stateCmd.Flags().StringVar(&stateFormat, "format", "json", "Output format (json or table)")
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state <container-id>",
+	Short: "show the state of a container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+
+		switch stateFormat {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(container)
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintf(w, "ID\t%s\n", container.ID)
+			fmt.Fprintf(w, "STATUS\t%s\n", container.Status)
+			fmt.Fprintf(w, "PID\t%d\n", container.Pid)
+			fmt.Fprintf(w, "BUNDLE\t%s\n", container.Bundle)
+			fmt.Fprintf(w, "CREATED\t%s\n", container.Created.Format(time.DateTime))
+			fmt.Fprintf(w, "CGROUP UNIT\t%s\n", container.CgroupUnit)
+			fmt.Fprintf(w, "CGROUP PATH\t%s\n", container.CgroupPath)
+			if container.ExitCode != nil {
+				fmt.Fprintf(w, "EXIT CODE\t%d\n", *container.ExitCode)
+				fmt.Fprintf(w, "OOM KILLED\t%t\n", container.OOMKilled)
+			}
+			if container.Network != nil {
+				fmt.Fprintf(w, "IP\t%s\n", container.Network.CIDR())
+				fmt.Fprintf(w, "GATEWAY\t%s\n", container.Network.Gateway)
+				fmt.Fprintf(w, "HOST VETH\t%s\n", container.Network.HostVeth)
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown output format %s", stateFormat)
+		}
+	},
+}
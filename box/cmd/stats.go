@@ -0,0 +1,361 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+)
+
+const statsInterval = time.Second
+
+var (
+	statsFormat   string
+	statsNoStream bool
+)
+
+func init() {
+	statsCmd.Flags().StringVar(&statsFormat, "format", "table", "Output format (table, or json for a JSON line per container)")
+	statsCmd.Flags().BoolVar(&statsNoStream, "no-stream", false, "Print the usage once instead of refreshing it every second")
+}
+
+// ContainerStats is the resource usage of a container, read from its cgroup and network.
+type ContainerStats struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// CPUPercent is the share of a single CPU used since the previous sample
+	CPUPercent float64      `json:"cpuPercent"`
+	CPU        CPUStats     `json:"cpu"`
+	Memory     MemoryStats  `json:"memory"`
+	Pids       PidsStats    `json:"pids"`
+	IO         IOStats      `json:"io"`
+	Network    NetworkStats `json:"network"`
+}
+
+// CPUStats is from cpu.stat.
+type CPUStats struct {
+	UsageUsec     uint64 `json:"usageUsec"`
+	UserUsec      uint64 `json:"userUsec"`
+	SystemUsec    uint64 `json:"systemUsec"`
+	NrThrottled   uint64 `json:"nrThrottled"`
+	ThrottledUsec uint64 `json:"throttledUsec"`
+}
+
+// MemoryStats is from memory.current, memory.max and memory.stat. A limit of 0 means no limit.
+type MemoryStats struct {
+	Usage uint64            `json:"usage"`
+	Limit uint64            `json:"limit,omitempty"`
+	Stat  map[string]uint64 `json:"stat,omitempty"`
+}
+
+// PidsStats is from pids.current and pids.max. A limit of 0 means no limit.
+type PidsStats struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit,omitempty"`
+}
+
+// IOStats is io.stat summed over every device.
+type IOStats struct {
+	ReadBytes  uint64 `json:"readBytes"`
+	WriteBytes uint64 `json:"writeBytes"`
+	ReadIOs    uint64 `json:"readIOs"`
+	WriteIOs   uint64 `json:"writeIOs"`
+}
+
+// NetworkStats are the counters of the container's network interfaces, as seen from inside the
+// container.
+type NetworkStats struct {
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	TxPackets uint64 `json:"txPackets"`
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats [flags] [container-id...]",
+	Short: "show the resource usage of running containers (default: all)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if statsFormat != "table" && statsFormat != "json" {
+			return fmt.Errorf("unknown output format %s", statsFormat)
+		}
+		for _, containerId := range args {
+			if _, err := LoadContainer(containerId); err != nil {
+				return err
+			}
+		}
+
+		previous := map[string]*ContainerStats{}
+		for {
+			containers, err := statsContainers(args)
+			if err != nil {
+				return err
+			}
+			var stats []*ContainerStats
+			for _, container := range containers {
+				s, err := ReadContainerStats(container)
+				if err != nil {
+					// the container may have exited since it was listed
+					Logger(cmd.Context()).Debug("failed to read container stats", "container", container.ID, "err", err)
+					continue
+				}
+				if prev, ok := previous[container.ID]; ok {
+					s.CPUPercent = cpuPercent(prev, s)
+				}
+				stats = append(stats, s)
+			}
+
+			// the first sample of each container has no CPU usage to compare with
+			if len(previous) == 0 && len(stats) > 0 {
+				for _, s := range stats {
+					previous[s.ID] = s
+				}
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			clear(previous)
+			for _, s := range stats {
+				previous[s.ID] = s
+			}
+
+			if err := printStats(stats, !statsNoStream); err != nil {
+				return err
+			}
+			if statsNoStream {
+				return nil
+			}
+			select {
+			case <-cmd.Context().Done():
+				return nil
+			case <-time.After(statsInterval):
+			}
+		}
+	},
+}
+
+// statsContainers returns the running containers called `containerIds`, or every running
+// container if there are none.
+func statsContainers(containerIds []string) ([]*Container, error) {
+	var containers []*Container
+	if len(containerIds) == 0 {
+		all, err := ListContainers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list containers: %w", err)
+		}
+		containers = all
+	} else {
+		for _, containerId := range containerIds {
+			container, err := LoadContainer(containerId)
+			if err != nil {
+				return nil, err
+			}
+			containers = append(containers, container)
+		}
+	}
+	var running []*Container
+	for _, container := range containers {
+		if (container.Status == specs.StateRunning || container.Status == StatePaused) && container.Pid != 0 {
+			running = append(running, container)
+		}
+	}
+	return running, nil
+}
+
+func printStats(stats []*ContainerStats, refresh bool) error {
+	if statsFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, s := range stats {
+			if err := encoder.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if refresh {
+		// move to the top left and clear the terminal
+		fmt.Print("\033[H\033[2J")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tCPU %\tMEM USAGE / LIMIT\tMEM %\tPIDS\tNET I/O\tBLOCK I/O")
+	for _, s := range stats {
+		memLimit, memPercent := "-", "-"
+		if s.Memory.Limit > 0 {
+			memLimit = formatBytes(s.Memory.Limit)
+			memPercent = fmt.Sprintf("%.2f%%", float64(s.Memory.Usage)/float64(s.Memory.Limit)*100)
+		}
+		fmt.Fprintf(w, "%s\t%.2f%%\t%s / %s\t%s\t%d\t%s / %s\t%s / %s\n",
+			s.ID, s.CPUPercent, formatBytes(s.Memory.Usage), memLimit, memPercent, s.Pids.Current,
+			formatBytes(s.Network.RxBytes), formatBytes(s.Network.TxBytes),
+			formatBytes(s.IO.ReadBytes), formatBytes(s.IO.WriteBytes))
+	}
+	return w.Flush()
+}
+
+// ReadContainerStats reads the current resource usage of the running `container`. A container
+// without a cgroup only has network stats.
+func ReadContainerStats(container *Container) (*ContainerStats, error) {
+	stats := &ContainerStats{ID: container.ID, Time: time.Now()}
+	if path := container.CgroupPath; path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to find container cgroup: %w", err)
+		}
+		// the files of a controller which isn't enabled are missing and left at zero
+		cpu, _ := readCgroupKeyValues(path, "cpu.stat")
+		stats.CPU = CPUStats{
+			UsageUsec:     cpu["usage_usec"],
+			UserUsec:      cpu["user_usec"],
+			SystemUsec:    cpu["system_usec"],
+			NrThrottled:   cpu["nr_throttled"],
+			ThrottledUsec: cpu["throttled_usec"],
+		}
+		stats.Memory.Usage, _ = readCgroupValue(path, "memory.current")
+		stats.Memory.Limit, _ = readCgroupValue(path, "memory.max")
+		stats.Memory.Stat, _ = readCgroupKeyValues(path, "memory.stat")
+		stats.Pids.Current, _ = readCgroupValue(path, "pids.current")
+		stats.Pids.Limit, _ = readCgroupValue(path, "pids.max")
+		stats.IO, _ = readIOStats(path)
+	}
+
+	network, err := readNetworkStats(container)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network stats: %w", err)
+	}
+	stats.Network = network
+	return stats, nil
+}
+
+// readCgroupValue reads a cgroup file holding a single number, where "max" is read as 0.
+func readCgroupValue(path string, file string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readCgroupKeyValues reads a cgroup file of "<key> <value>" lines, like cpu.stat.
+func readCgroupKeyValues(path string, file string) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(path, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readIOStats sums the "<major>:<minor> rbytes=<n> wbytes=<n> ..." lines of io.stat.
+func readIOStats(path string) (IOStats, error) {
+	var stats IOStats
+	data, err := os.ReadFile(filepath.Join(path, "io.stat"))
+	if err != nil {
+		return stats, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		for _, field := range fields[min(1, len(fields)):] {
+			key, value, _ := strings.Cut(field, "=")
+			n, _ := strconv.ParseUint(value, 10, 64)
+			switch key {
+			case "rbytes":
+				stats.ReadBytes += n
+			case "wbytes":
+				stats.WriteBytes += n
+			case "rios":
+				stats.ReadIOs += n
+			case "wios":
+				stats.WriteIOs += n
+			}
+		}
+	}
+	return stats, nil
+}
+
+// readNetworkStats reads the counters of the host end of the container's veth, which are
+// swapped to be from the container's side. Without a bridge network, e.g. when rootless, the
+// interfaces in the container's network namespace are read instead.
+func readNetworkStats(container *Container) (NetworkStats, error) {
+	if container.Network != nil {
+		link, err := netlink.LinkByName(container.Network.HostVeth)
+		if err != nil {
+			return NetworkStats{}, fmt.Errorf("failed to find %s: %w", container.Network.HostVeth, err)
+		}
+		s := link.Attrs().Statistics
+		if s == nil {
+			return NetworkStats{}, fmt.Errorf("%s has no statistics", container.Network.HostVeth)
+		}
+		return NetworkStats{RxBytes: s.TxBytes, TxBytes: s.RxBytes, RxPackets: s.TxPackets, TxPackets: s.RxPackets}, nil
+	}
+
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/dev", container.Pid))
+	if err != nil {
+		return NetworkStats{}, err
+	}
+	var stats NetworkStats
+	// after two header lines each interface is "<name>: <rx bytes> <rx packets> ... <tx bytes>
+	// <tx packets> ...", with 8 receive counters
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, line := range lines[min(2, len(lines)):] {
+		name, counters, ok := strings.Cut(line, ":")
+		fields := strings.Fields(counters)
+		if !ok || strings.TrimSpace(name) == "lo" || len(fields) < 10 {
+			continue
+		}
+		values := make([]uint64, len(fields))
+		for i, field := range fields {
+			values[i], _ = strconv.ParseUint(field, 10, 64)
+		}
+		stats.RxBytes += values[0]
+		stats.RxPackets += values[1]
+		stats.TxBytes += values[8]
+		stats.TxPackets += values[9]
+	}
+	return stats, nil
+}
+
+// cpuPercent returns the share of a single CPU used between two samples.
+func cpuPercent(previous *ContainerStats, current *ContainerStats) float64 {
+	elapsed := current.Time.Sub(previous.Time).Microseconds()
+	if elapsed <= 0 || current.CPU.UsageUsec < previous.CPU.UsageUsec {
+		return 0
+	}
+	return float64(current.CPU.UsageUsec-previous.CPU.UsageUsec) / float64(elapsed) * 100
+}
+
+// formatBytes formats `bytes` with a binary unit, e.g. 1.5MiB.
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value, exp := float64(bytes)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, "KMGTP"[exp])
+}
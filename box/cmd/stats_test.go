@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCgroupFile writes `data` to `file` in a fake cgroup directory and returns its path.
+func writeCgroupFile(t *testing.T, file string, data string) string {
+	t.Helper()
+	path := t.TempDir()
+	if err := os.WriteFile(filepath.Join(path, file), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadCgroupKeyValues(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]uint64
+	}{
+		{
+			name: "cpu.stat",
+			data: "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\nnr_periods 0\nnr_throttled 2\nthrottled_usec 300\n",
+			want: map[string]uint64{"usage_usec": 1500, "user_usec": 1000, "system_usec": 500, "nr_periods": 0, "nr_throttled": 2, "throttled_usec": 300},
+		},
+		{name: "no trailing newline", data: "anon 4096\nfile 8192", want: map[string]uint64{"anon": 4096, "file": 8192}},
+		{name: "empty", data: "", want: map[string]uint64{}},
+		{
+			name: "unparsable lines",
+			data: "novalue\nnegative -1\nmax max\nfloat 1.5\nlarge 18446744073709551616\nok 7\n",
+			want: map[string]uint64{"ok": 7},
+		},
+		{name: "later lines win", data: "key 1\nkey 2\n", want: map[string]uint64{"key": 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readCgroupKeyValues(writeCgroupFile(t, "cpu.stat", test.data), "cpu.stat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := readCgroupKeyValues(t.TempDir(), "cpu.stat"); err == nil {
+		t.Error("expected an error reading a missing file")
+	}
+}
+
+func TestReadIOStats(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want IOStats
+	}{
+		{
+			name: "one device",
+			data: "8:0 rbytes=1024 wbytes=2048 rios=3 wios=4 dbytes=0 dios=0\n",
+			want: IOStats{ReadBytes: 1024, WriteBytes: 2048, ReadIOs: 3, WriteIOs: 4},
+		},
+		{
+			name: "devices are summed",
+			data: "8:0 rbytes=1024 wbytes=2048 rios=3 wios=4 dbytes=0 dios=0\n8:16 rbytes=1 wbytes=2 rios=1 wios=1 dbytes=9 dios=9\n",
+			want: IOStats{ReadBytes: 1025, WriteBytes: 2050, ReadIOs: 4, WriteIOs: 5},
+		},
+		{name: "empty", data: "", want: IOStats{}},
+		{name: "blank lines", data: "\n\n", want: IOStats{}},
+		{name: "device without stats", data: "8:0\n259:0 rbytes=10\n", want: IOStats{ReadBytes: 10}},
+		{name: "unparsable fields", data: "8:0 rbytes=abc wbytes wios=-1 rios=2 unknown=5\n", want: IOStats{ReadIOs: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readIOStats(writeCgroupFile(t, "io.stat", test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := readIOStats(t.TempDir()); err == nil {
+		t.Error("expected an error reading a missing io.stat")
+	}
+}
+
+func TestReadCgroupValue(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    uint64
+		wantErr bool
+	}{
+		{data: "4096\n", want: 4096},
+		{data: "0", want: 0},
+		{data: "max\n", want: 0},
+		{data: "", wantErr: true},
+		{data: "-1\n", wantErr: true},
+		{data: "1 2\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.data, func(t *testing.T) {
+			got, err := readCgroupValue(writeCgroupFile(t, "memory.max", test.data), "memory.max")
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCPUPercent(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sample := func(elapsed time.Duration, usageUsec uint64) *ContainerStats {
+		return &ContainerStats{Time: start.Add(elapsed), CPU: CPUStats{UsageUsec: usageUsec}}
+	}
+
+	tests := []struct {
+		name     string
+		previous *ContainerStats
+		current  *ContainerStats
+		want     float64
+	}{
+		{name: "idle", previous: sample(0, 1000), current: sample(time.Second, 1000), want: 0},
+		{name: "half a cpu", previous: sample(0, 1000), current: sample(time.Second, 501000), want: 50},
+		{name: "one cpu", previous: sample(0, 0), current: sample(2*time.Second, 2000000), want: 100},
+		{name: "several cpus", previous: sample(0, 0), current: sample(500*time.Millisecond, 2000000), want: 400},
+		{name: "no time elapsed", previous: sample(time.Second, 0), current: sample(time.Second, 1000), want: 0},
+		{name: "time went backwards", previous: sample(time.Second, 0), current: sample(0, 1000), want: 0},
+		{name: "usage went backwards", previous: sample(0, 2000), current: sample(time.Second, 1000), want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cpuPercent(test.previous, test.current); got != test.want {
+				t.Errorf("got %f, want %f", got, test.want)
+			}
+		})
+	}
+}
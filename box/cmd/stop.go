@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+const teardownTimeout = 30 * time.Second
+
+var stopTimeout int
+
+func init() {
+	stopCmd.Flags().IntVarP(&stopTimeout, "time", "t", 10, "Seconds to wait for the container to stop before killing it, instead of its --stop-timeout")
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop [flags] <container-id>",
+	Short: "stop a running container, killing it if it does not stop in time",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		log := Logger(ctx)
+
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		if container.Status == specs.StateStopped {
+			log.Info("container is already stopped", "container", container.ID)
+			return container.WaitForTeardown(teardownTimeout)
+		}
+
+		// a paused container can't handle the signal until it is resumed
+		if container.Status == StatePaused {
+			if err := pauseContainer(ctx, container, false); err != nil {
+				return err
+			}
+		}
+
+		// the container's --stop-timeout unless -t is given
+		timeout := stopTimeout
+		if !cmd.Flags().Changed("time") && container.Options.StopTimeout > 0 {
+			timeout = container.Options.StopTimeout
+		}
+		signal := syscall.SIGTERM
+		if config, err := container.Config(); err == nil {
+			signal = stopSignal(config)
+		}
+
+		log.Info("stopping container", "container", container.ID, "signal", unix.SignalName(signal))
+		if err := container.Signal(signal); err != nil {
+			return err
+		}
+		if !container.WaitForExit(time.Duration(timeout) * time.Second) {
+			log.Info("container did not stop in time, killing it", "container", container.ID)
+			if err := container.Signal(syscall.SIGKILL); err != nil {
+				return err
+			}
+			container.WaitForExit(teardownTimeout)
+		}
+		return container.WaitForTeardown(teardownTimeout)
+	},
+}
@@ -0,0 +1,397 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	imagesFolder  = "images"
+	layersFolder  = "layers"
+	storeLockFile = "store.lock"
+)
+
+// Store is a content-addressable image store on disk. Blobs (layers, configs and manifests) are
+// kept in an OCI image layout keyed by digest, with tags recorded as `ref.name` annotations in
+// its index.json. Each layer is also unpacked once, keyed by its diff ID, so that images sharing
+// base layers share them on disk.
+//
+//	<root>/images/          OCI image layout (oci-layout, index.json, blobs/sha256/...)
+//	<root>/layers/sha256/   unpacked layers
+type Store struct {
+	root   string
+	layout layout.Path
+}
+
+// OpenStore opens the image store under `root`, creating it if it does not exist yet.
+func OpenStore(root string) (*Store, error) {
+	unlock, err := lockStore(root)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	imagesPath := filepath.Join(root, imagesFolder)
+	l, err := layout.FromPath(imagesPath)
+	if err != nil {
+		if l, err = layout.Write(imagesPath, empty.Index); err != nil {
+			return nil, fmt.Errorf("failed to create image store at %s: %w", imagesPath, err)
+		}
+	}
+	return &Store{root: root, layout: l}, nil
+}
+
+// Pull fetches the image referenced by `ref`, writes any blobs the store does not already have
+// and points the tag at the new manifest. Layers that are already in the store are not downloaded.
+func (s *Store) Pull(ref string) (v1.Image, error) {
+	tag, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	remote, err := crane.Pull(ref, crane.WithPlatform(&v1.Platform{
+		Architecture: "amd64",
+		OS:           "linux",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := remote.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("image has no media type: %w", err)
+	}
+	if !mediaType.IsImage() {
+		return nil, errors.New("the provided URI does not reference an image")
+	}
+
+	// another pull could be writing the same blobs or the index at the same time
+	unlock, err := lockStore(s.root)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// layers
+	layers, err := remote.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image layers: %w", err)
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if s.hasBlob(digest) {
+			continue
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, fmt.Errorf("failed to download layer %s: %w", digest, err)
+		}
+		if err := s.layout.WriteBlob(digest, rc); err != nil {
+			return nil, fmt.Errorf("failed to write layer %s: %w", digest, err)
+		}
+	}
+
+	// config
+	configName, err := remote.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	rawConfig, err := remote.RawConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image config: %w", err)
+	}
+	if err := s.writeBlob(configName, rawConfig); err != nil {
+		return nil, err
+	}
+
+	// manifest
+	digest, err := remote.Digest()
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := remote.RawManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image manifest: %w", err)
+	}
+	if err := s.writeBlob(digest, rawManifest); err != nil {
+		return nil, err
+	}
+
+	// tag
+	if err := s.layout.RemoveDescriptors(match.Annotation(ocispec.AnnotationRefName, tag.Name())); err != nil {
+		return nil, err
+	}
+	if err := s.layout.AppendDescriptor(v1.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(rawManifest)),
+		Digest:    digest,
+		Annotations: map[string]string{
+			ocispec.AnnotationRefName: tag.Name(),
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to tag image: %w", err)
+	}
+
+	return s.layout.Image(digest)
+}
+
+// Image returns an image from the store by digest (`sha256:...`) or by tag.
+func (s *Store) Image(ref string) (v1.Image, error) {
+	if digest, err := v1.NewHash(ref); err == nil {
+		return s.layout.Image(digest)
+	}
+	tag, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	index, err := s.layout.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[ocispec.AnnotationRefName] == tag.Name() {
+			return s.layout.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("image %s not found in store", ref)
+}
+
+// CreateRootFS assembles a flattened copy of `image` at `rootfsPath` from the unpacked layers in
+// the store, unpacking any layers that are missing first.
+func (s *Store) CreateRootFS(ctx context.Context, image v1.Image, rootfsPath string) error {
+	layerPaths, err := s.UnpackLayers(ctx, image)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(rootfsPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
+		return err
+	}
+	for _, layerPath := range layerPaths {
+		if err := applyLayer(ctx, layerPath, rootfsPath); err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", layerPath, err)
+		}
+	}
+	return nil
+}
+
+// UnpackLayers returns the paths of the unpacked layers of `image`, from lowest to highest,
+// unpacking any which are not already in the store.
+func (s *Store) UnpackLayers(ctx context.Context, image v1.Image) ([]string, error) {
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image layers: %w", err)
+	}
+
+	var layerPaths []string
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		layerPath := filepath.Join(s.root, layersFolder, diffID.Algorithm, diffID.Hex)
+		layerPaths = append(layerPaths, layerPath)
+		if _, err := os.Stat(layerPath); err == nil {
+			continue
+		}
+
+		// unpack into a temporary directory first so an interrupted unpack is never used
+		if err := os.MkdirAll(filepath.Dir(layerPath), 0755); err != nil {
+			return nil, err
+		}
+		tmp, err := os.MkdirTemp(filepath.Dir(layerPath), diffID.Hex+"-")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(tmp, 0755); err != nil {
+			return nil, err
+		}
+		if err := extractLayer(ctx, layer, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return nil, fmt.Errorf("failed to unpack layer %s: %w", diffID, err)
+		}
+		if err := os.Rename(tmp, layerPath); err != nil {
+			os.RemoveAll(tmp)
+			// another unpack of the same layer finished first
+			if _, statErr := os.Stat(layerPath); statErr != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return layerPaths, nil
+}
+
+// lockStore takes an exclusive lock on the store under `root` and returns the function which
+// releases it.
+func lockStore(root string) (func(), error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(root, storeLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock image store: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
+
+func (s *Store) hasBlob(digest v1.Hash) bool {
+	rc, err := s.layout.Blob(digest)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
+func (s *Store) writeBlob(digest v1.Hash, data []byte) error {
+	if s.hasBlob(digest) {
+		return nil
+	}
+	return s.layout.WriteBlob(digest, io.NopCloser(bytes.NewReader(data)))
+}
+
+// applyLayer copies an unpacked layer from the store on top of `rootfs`, applying the overlayfs
+// style whiteouts and opaque directories written by extractLayer.
+func applyLayer(ctx context.Context, layerPath string, rootfs string) error {
+	// hard links within the layer, keyed by inode
+	links := map[uint64]string{}
+
+	return filepath.WalkDir(layerPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layerPath, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(rootfs, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+
+		// whiteout
+		if info.Mode()&fs.ModeCharDevice != 0 && stat.Rdev == 0 {
+			return os.RemoveAll(target)
+		}
+
+		// directory
+		if info.IsDir() {
+			if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if isOpaque(path) {
+				if err := clearDirectory(target); err != nil {
+					return err
+				}
+			}
+			if err := lchown(ctx, target, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode())
+		}
+
+		// everything else replaces what is in the lower layers
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if first, ok := links[stat.Ino]; ok {
+			return os.Link(first, target)
+		}
+		switch {
+		case info.Mode().IsRegular():
+			if err := copyFile(path, target); err != nil {
+				return err
+			}
+		case info.Mode()&fs.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(linkTarget, target); err != nil {
+				return err
+			}
+		default:
+			if err := syscall.Mknod(target, stat.Mode, int(stat.Rdev)); err != nil {
+				return err
+			}
+		}
+		if stat.Nlink > 1 {
+			links[stat.Ino] = target
+		}
+		if err := lchown(ctx, target, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		// chown clears setuid and setgid bits so the mode is applied last
+		return os.Chmod(target, info.Mode())
+	})
+}
+
+func isOpaque(path string) bool {
+	for _, xattr := range []string{opaqueXattr, userOpaqueXattr} {
+		buf := make([]byte, 1)
+		n, err := unix.Lgetxattr(path, xattr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
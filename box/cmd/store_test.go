@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+func TestApplyLayer(t *testing.T) {
+	requireRoot(t)
+
+	// every test starts from the same lower layer
+	lower := []tarEntry{
+		dir("etc"),
+		file("etc/hostname", "box"),
+		file("etc/motd", "hello"),
+		dir("var"),
+		dir("var/log"),
+		file("var/log/messages", "old"),
+		file("var/run", "file"),
+		symlink("lib", "usr/lib"),
+		dir("usr"),
+		dir("usr/lib"),
+		file("usr/lib/libc.so", "libc"),
+	}
+	lowerTree := map[string]string{
+		"etc":              "dir",
+		"etc/hostname":     "file box",
+		"etc/motd":         "file hello",
+		"var":              "dir",
+		"var/log":          "dir",
+		"var/log/messages": "file old",
+		"var/run":          "file file",
+		"lib":              "symlink usr/lib",
+		"usr":              "dir",
+		"usr/lib":          "dir",
+		"usr/lib/libc.so":  "file libc",
+	}
+
+	tests := []struct {
+		name   string
+		layers [][]tarEntry
+		// changes to the lower tree, an empty value is a path which has been removed
+		want map[string]string
+	}{
+		{
+			name:   "no changes",
+			layers: [][]tarEntry{{}},
+		},
+		{
+			name:   "new and changed files",
+			layers: [][]tarEntry{{file("etc/hostname", "container"), file("etc/hosts", "localhost")}},
+			want:   map[string]string{"etc/hostname": "file container", "etc/hosts": "file localhost"},
+		},
+		{
+			name:   "whiteout of a file",
+			layers: [][]tarEntry{{file("etc/.wh.motd", "")}},
+			want:   map[string]string{"etc/motd": ""},
+		},
+		{
+			name:   "whiteout of a directory",
+			layers: [][]tarEntry{{file(".wh.usr", "")}},
+			want:   map[string]string{"usr": "", "usr/lib": "", "usr/lib/libc.so": ""},
+		},
+		{
+			name:   "whiteout of a symlink leaves its target",
+			layers: [][]tarEntry{{file(".wh.lib", "")}},
+			want:   map[string]string{"lib": ""},
+		},
+		{
+			name:   "whiteout of a missing path",
+			layers: [][]tarEntry{{file("etc/.wh.shadow", "")}},
+		},
+		{
+			name:   "whiteout of a path from two layers down",
+			layers: [][]tarEntry{{file("etc/issue", "welcome")}, {file("etc/.wh.hostname", ""), file("etc/.wh.issue", "")}},
+			want:   map[string]string{"etc/hostname": ""},
+		},
+		{
+			name:   "whiteout and recreate",
+			layers: [][]tarEntry{{file(".wh.var", "")}, {dir("var"), file("var/tmp", "new")}},
+			want:   map[string]string{"var/log": "", "var/log/messages": "", "var/run": "", "var/tmp": "file new"},
+		},
+		{
+			name:   "opaque directory",
+			layers: [][]tarEntry{{dir("var"), file("var/.wh..wh..opq", ""), file("var/lib", "new")}},
+			want:   map[string]string{"var/log": "", "var/log/messages": "", "var/run": "", "var/lib": "file new"},
+		},
+		{
+			name:   "opaque directory only hides lower layers",
+			layers: [][]tarEntry{{file("var/log/.wh..wh..opq", ""), file("var/log/boot", "new")}, {file("var/log/kern", "newer")}},
+			want:   map[string]string{"var/log/messages": "", "var/log/boot": "file new", "var/log/kern": "file newer"},
+		},
+		{
+			name:   "file replaced by a directory",
+			layers: [][]tarEntry{{dir("var/run"), file("var/run/pid", "1")}},
+			want:   map[string]string{"var/run": "dir", "var/run/pid": "file 1"},
+		},
+		{
+			name:   "directory replaced by a file",
+			layers: [][]tarEntry{{file("var/log", "file")}},
+			want:   map[string]string{"var/log": "file file", "var/log/messages": ""},
+		},
+		{
+			name:   "symlink replaced by a directory",
+			layers: [][]tarEntry{{dir("lib"), file("lib/ld.so", "ld")}},
+			want:   map[string]string{"lib": "dir", "lib/ld.so": "file ld"},
+		},
+		{
+			name:   "directory replaced by a symlink",
+			layers: [][]tarEntry{{symlink("usr/lib", "../lib64")}},
+			want:   map[string]string{"usr/lib": "symlink ../lib64", "usr/lib/libc.so": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			rootfs := filepath.Join(tmp, "rootfs")
+
+			for i, entries := range append([][]tarEntry{lower}, test.layers...) {
+				layerPath := filepath.Join(tmp, "layer"+strconv.Itoa(i))
+				if err := os.Mkdir(layerPath, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := extractLayer(t.Context(), testLayer(t, entries...), layerPath); err != nil {
+					t.Fatal(err)
+				}
+				if err := applyLayer(t.Context(), layerPath, rootfs); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := maps.Clone(lowerTree)
+			for path, value := range test.want {
+				if value == "" {
+					delete(want, path)
+				} else {
+					want[path] = value
+				}
+			}
+			checkTree(t, rootfs, want)
+		})
+	}
+}
+
+func TestUnpackLayersConcurrently(t *testing.T) {
+	requireRoot(t)
+
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough files that the unpacks overlap
+	entries := []tarEntry{dir("etc"), file("etc/hostname", "box")}
+	want := map[string]string{"etc": "dir", "etc/hostname": "file box"}
+	for i := range 200 {
+		name := "etc/file" + strconv.Itoa(i)
+		entries = append(entries, file(name, name))
+		want[name] = "file " + name
+	}
+	image, err := mutate.AppendLayers(empty.Image, testLayer(t, entries...), testLayer(t, file("etc/motd", "hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every unpack of the same layers succeeds, whichever finishes first
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	paths := make([][]string, len(errs))
+	for i := range errs {
+		wg.Go(func() {
+			paths[i], errs[i] = store.UnpackLayers(t.Context(), image)
+		})
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("unpack %d: %v", i, err)
+		}
+	}
+	checkTree(t, paths[0][0], want)
+	checkTree(t, paths[0][1], map[string]string{"etc": "dir", "etc/motd": "file hello"})
+	unpacked, err := os.ReadDir(filepath.Dir(paths[0][0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpacked) != 2 {
+		t.Errorf("got %d entries in the layer store, want the 2 layers", len(unpacked))
+	}
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var updateOptions ResourceOptions
+
+// updateFlags are the resource flags of `box update`, kept apart to tell which were given.
+var updateFlags = pflag.NewFlagSet("update", pflag.ContinueOnError)
+
+func init() {
+	addResourceFlags(updateFlags, &updateOptions)
+	updateCmd.Flags().AddFlagSet(updateFlags)
+}
+
+var updateCmd = &cobra.Command{
+	Use:   "update [flags] <container-id>",
+	Short: "change the resource limits of a running container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		log := Logger(ctx)
+
+		changed := false
+		updateFlags.VisitAll(func(flag *pflag.Flag) {
+			changed = changed || flag.Changed
+		})
+		if !changed {
+			return errors.New("no resource limits given to update")
+		}
+
+		container, err := LoadContainer(args[0])
+		if err != nil {
+			return err
+		}
+		if container.Status != specs.StateRunning && container.Status != specs.StateCreated && container.Status != StatePaused {
+			return fmt.Errorf("container %s is %s", container.ID, container.Status)
+		}
+
+		// 1. apply the new limits on top of those the container is running with
+		config, err := container.Config()
+		if err != nil {
+			return err
+		}
+		if config.Linux.Resources == nil {
+			config.Linux.Resources = &specs.LinuxResources{}
+		}
+		resources := config.Linux.Resources
+		if err := updateOptions.ApplyTo(resources); err != nil {
+			return err
+		}
+		manager := cgroupfsCgroupManager
+		if container.CgroupUnit != "" {
+			manager = systemdCgroupManager
+		}
+		if err := validateResources(resources, manager); err != nil {
+			return err
+		}
+
+		// 2. change the limits of the container cgroup
+		cgroupManager, err := LoadCgroupManager(container)
+		if err != nil {
+			return err
+		}
+		if err := cgroupManager.Set(ctx, resources); err != nil {
+			return fmt.Errorf("failed to update container %s: %w", container.ID, err)
+		}
+
+		// 3. keep the limits in the container state, for the next run of the container too
+		if _, err := writeConfig(container, config); err != nil {
+			return err
+		}
+		if err := container.Update(func(stored *Container) error {
+			if err := stored.Options.ResourceOptions.Merge(updateFlags); err != nil {
+				return fmt.Errorf("failed to update container options: %w", err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		log.Info("updated container resource limits", "container", container.ID)
+		return nil
+	},
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+// passwdEntry is a line of /etc/passwd.
+type passwdEntry struct {
+	Name string
+	UID  uint32
+	GID  uint32
+	Home string
+}
+
+// groupEntry is a line of /etc/group.
+type groupEntry struct {
+	Name    string
+	GID     uint32
+	Members []string
+}
+
+// ResolveUser resolves an image config `User` (`user`, `uid`, `user:group` or `uid:gid`) against
+// the /etc/passwd and /etc/group of `rootfs`, the same way runc does. Numeric IDs do not need to
+// exist in the rootfs. Supplementary groups are only looked up when no group is given. Also
+// returns the home directory of the user, or "/" if it is unknown.
+func ResolveUser(rootfs string, user string) (specs.User, string, error) {
+	userArg, groupArg, _ := strings.Cut(user, ":")
+
+	passwd, err := readPasswd(filepath.Join(rootfs, passwdFile))
+	if err != nil {
+		return specs.User{}, "", fmt.Errorf("failed to read %s: %w", passwdFile, err)
+	}
+	groups, err := readGroup(filepath.Join(rootfs, groupFile))
+	if err != nil {
+		return specs.User{}, "", fmt.Errorf("failed to read %s: %w", groupFile, err)
+	}
+
+	// user, root by default
+	resolved := specs.User{}
+	home := "/"
+	var matched *passwdEntry
+	if userArg == "" {
+		userArg = "0"
+	}
+	for i := range passwd {
+		if passwd[i].Name == userArg || strconv.FormatUint(uint64(passwd[i].UID), 10) == userArg {
+			matched = &passwd[i]
+			break
+		}
+	}
+	if matched != nil {
+		resolved.UID = matched.UID
+		resolved.GID = matched.GID
+		home = matched.Home
+	} else {
+		uid, err := strconv.ParseUint(userArg, 10, 32)
+		if err != nil {
+			return specs.User{}, "", fmt.Errorf("unable to find user %s in %s", userArg, passwdFile)
+		}
+		resolved.UID = uint32(uid)
+	}
+
+	// group
+	if groupArg != "" {
+		found := false
+		for _, group := range groups {
+			if group.Name == groupArg || strconv.FormatUint(uint64(group.GID), 10) == groupArg {
+				resolved.GID = group.GID
+				found = true
+				break
+			}
+		}
+		if !found {
+			gid, err := strconv.ParseUint(groupArg, 10, 32)
+			if err != nil {
+				return specs.User{}, "", fmt.Errorf("unable to find group %s in %s", groupArg, groupFile)
+			}
+			resolved.GID = uint32(gid)
+		}
+		return resolved, home, nil
+	}
+
+	// supplementary groups
+	if matched != nil {
+		for _, group := range groups {
+			if group.GID == resolved.GID {
+				continue
+			}
+			for _, member := range group.Members {
+				if member == matched.Name {
+					resolved.AdditionalGids = append(resolved.AdditionalGids, group.GID)
+					break
+				}
+			}
+		}
+	}
+	return resolved, home, nil
+}
+
+func readPasswd(path string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := readColonFile(path, func(fields []string) {
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 6 {
+			return
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{Name: fields[0], UID: uint32(uid), GID: uint32(gid), Home: fields[5]})
+	})
+	return entries, err
+}
+
+func readGroup(path string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := readColonFile(path, func(fields []string) {
+		// name:password:gid:members
+		if len(fields) < 4 {
+			return
+		}
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{Name: fields[0], GID: uint32(gid), Members: members})
+	})
+	return entries, err
+}
+
+// readColonFile calls `fn` with the fields of each line of a colon separated file like
+// /etc/passwd, skipping comments and blank lines. A missing file has no lines.
+func readColonFile(path string, fn func(fields []string)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
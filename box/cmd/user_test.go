@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestResolveUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := `# comment
+root:x:0:0:root:/root:/bin/sh
+
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+app:x:1000:1000:app:/home/app:/bin/sh
+1001:x:1002:1002::/home/numeric:/bin/sh
+broken:x:notanumber:1000::/home/broken:/bin/sh
+short:x:1003
+`
+	group := `root:x:0:
+daemon:x:1:app
+app:x:1000:
+wheel:x:10:app,other
+docker:x:999:other
+2000:x:2001:
+`
+	if err := os.WriteFile(filepath.Join(rootfs, passwdFile), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, groupFile), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		want     specs.User
+		wantHome string
+		wantErr  bool
+	}{
+		{user: "", want: specs.User{UID: 0, GID: 0}, wantHome: "/root"},
+		{user: "root", want: specs.User{UID: 0, GID: 0}, wantHome: "/root"},
+		{user: "app", want: specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{1, 10}}, wantHome: "/home/app"},
+		{user: "1000", want: specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{1, 10}}, wantHome: "/home/app"},
+		{user: "daemon", want: specs.User{UID: 1, GID: 1}, wantHome: "/usr/sbin"},
+
+		// user:group, without supplementary groups
+		{user: "app:wheel", want: specs.User{UID: 1000, GID: 10}, wantHome: "/home/app"},
+		{user: "app:10", want: specs.User{UID: 1000, GID: 10}, wantHome: "/home/app"},
+		{user: "1000:docker", want: specs.User{UID: 1000, GID: 999}, wantHome: "/home/app"},
+		{user: "app:5000", want: specs.User{UID: 1000, GID: 5000}, wantHome: "/home/app"},
+		{user: ":wheel", want: specs.User{UID: 0, GID: 10}, wantHome: "/root"},
+
+		// numeric IDs which aren't in the rootfs
+		{user: "5000", want: specs.User{UID: 5000, GID: 0}, wantHome: "/"},
+		{user: "5000:5000", want: specs.User{UID: 5000, GID: 5000}, wantHome: "/"},
+		{user: "5000:app", want: specs.User{UID: 5000, GID: 1000}, wantHome: "/"},
+
+		// names are matched before IDs
+		{user: "1001", want: specs.User{UID: 1002, GID: 1002}, wantHome: "/home/numeric"},
+		{user: "app:2000", want: specs.User{UID: 1000, GID: 2001}, wantHome: "/home/app"},
+
+		// unparsable lines are skipped
+		{user: "broken", wantErr: true},
+		{user: "short", wantErr: true},
+
+		{user: "missing", wantErr: true},
+		{user: "app:missing", wantErr: true},
+		{user: "-1", wantErr: true},
+		{user: "4294967296", wantErr: true},
+		{user: "app:4294967296", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			got, home, err := ResolveUser(rootfs, test.user)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) || home != test.wantHome {
+				t.Errorf("got %+v with home %s, want %+v with home %s", got, home, test.want, test.wantHome)
+			}
+		})
+	}
+}
+
+func TestResolveUserWithoutFiles(t *testing.T) {
+	rootfs := t.TempDir()
+
+	tests := []struct {
+		user    string
+		want    specs.User
+		wantErr bool
+	}{
+		{user: "", want: specs.User{}},
+		{user: "1000", want: specs.User{UID: 1000}},
+		{user: "1000:1000", want: specs.User{UID: 1000, GID: 1000}},
+		{user: "root", wantErr: true},
+		{user: "1000:app", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			got, home, err := ResolveUser(rootfs, test.user)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) || home != "/" {
+				t.Errorf("got %+v with home %s, want %+v with home /", got, home, test.want)
+			}
+		})
+	}
+}
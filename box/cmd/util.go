@@ -1,17 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
@@ -19,17 +22,9 @@ import (
 // config and rootfs path from there if they exist.
 func GetConfigAndRootFromRuntimePath(runtimePath string) (*specs.Spec, string, error) {
 	// read config
-	config := &specs.Spec{}
-	configPath := filepath.Join(runtimePath, configFile)
-
-	file, err := os.Open(configPath)
+	config, err := ReadConfig(filepath.Join(runtimePath, configFile))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to open runtime config file: %w", err)
-	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(config); err != nil {
-		return nil, "", fmt.Errorf("failed to decode runtime config file: %w", err)
+		return nil, "", err
 	}
 
 	// path to rootfs
@@ -41,52 +36,209 @@ func GetConfigAndRootFromRuntimePath(runtimePath string) (*specs.Spec, string, e
 	return config, rootfsPath, nil
 }
 
+// ReadConfig reads the OCI runtime config at `configPath`.
+func ReadConfig(configPath string) (*specs.Spec, error) {
+	config := &specs.Spec{}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open runtime config file: %w", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to decode runtime config file: %w", err)
+	}
+	return config, nil
+}
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// mountFlag is what a mount option does to the mount flags, either setting or clearing `flag`.
+type mountFlag struct {
+	clear bool
+	flag  uintptr
+}
+
 // The mount options in an OCI runtime config include both flags and data and we must manually
-// determine which is which. List taken from mount(2).
-var mountFlagMap = map[string]uintptr{
-	// main flags:
-	"remount": syscall.MS_REMOUNT,
-	"bind":    syscall.MS_BIND,
-	// propagation flags:
-	"shared":     syscall.MS_SHARED,
-	"private":    syscall.MS_PRIVATE,
-	"slave":      syscall.MS_SLAVE,
-	"unbindable": syscall.MS_UNBINDABLE,
-	// additional flags:
-	"dirsync":  syscall.MS_DIRSYNC,
-	"lazytime": 0x2000000,
-	// TODO: MS_MANDLOCK?
-	"noatime":    syscall.MS_NOATIME,
-	"nodev":      syscall.MS_NODEV,
-	"nodiratime": syscall.MS_NODIRATIME,
-	"noexec":     syscall.MS_NOEXEC,
-	"nosuid":     syscall.MS_NOSUID,
-	"ro":         syscall.MS_RDONLY,
-	// TODO: MS_REC?
-	"relatime":    syscall.MS_RELATIME,
-	"silent":      syscall.MS_SILENT,
-	"strictatime": syscall.MS_STRICTATIME,
-	// TODO: MS_SYNCHRONOUS?
-	"nosymfollow": 0x100,
-}
-
-// ParseMountFlagsAndDataFromOptions expects a list of mount options from an OCI runtime config. It
-// converts these options into the corresponding `flags` and `data` parameters for the mount syscall.
-// See: https://github.com/opencontainers/runtime-spec/blob/main/config.md#linux-mount-options
-func ParseMountFlagsAndDataFromOptions(options []string) (uintptr, string, error) {
-	var flags uintptr
-	var dataBuilder strings.Builder
+// determine which is which. List taken from mount(8), later options override earlier ones.
+var mountFlagMap = map[string]mountFlag{
+	"async":         {true, syscall.MS_SYNCHRONOUS},
+	"atime":         {true, syscall.MS_NOATIME},
+	"bind":          {false, syscall.MS_BIND},
+	"defaults":      {false, 0},
+	"dev":           {true, syscall.MS_NODEV},
+	"diratime":      {true, syscall.MS_NODIRATIME},
+	"dirsync":       {false, syscall.MS_DIRSYNC},
+	"exec":          {true, syscall.MS_NOEXEC},
+	"iversion":      {false, unix.MS_I_VERSION},
+	"lazytime":      {false, unix.MS_LAZYTIME},
+	"loud":          {true, syscall.MS_SILENT},
+	"mand":          {false, syscall.MS_MANDLOCK},
+	"noatime":       {false, syscall.MS_NOATIME},
+	"nodev":         {false, syscall.MS_NODEV},
+	"nodiratime":    {false, syscall.MS_NODIRATIME},
+	"noexec":        {false, syscall.MS_NOEXEC},
+	"noiversion":    {true, unix.MS_I_VERSION},
+	"nolazytime":    {true, unix.MS_LAZYTIME},
+	"nomand":        {true, syscall.MS_MANDLOCK},
+	"norelatime":    {true, syscall.MS_RELATIME},
+	"nostrictatime": {true, syscall.MS_STRICTATIME},
+	"nosuid":        {false, syscall.MS_NOSUID},
+	"nosymfollow":   {false, unix.MS_NOSYMFOLLOW},
+	"rbind":         {false, syscall.MS_BIND | syscall.MS_REC},
+	"relatime":      {false, syscall.MS_RELATIME},
+	"remount":       {false, syscall.MS_REMOUNT},
+	"ro":            {false, syscall.MS_RDONLY},
+	"rw":            {true, syscall.MS_RDONLY},
+	"silent":        {false, syscall.MS_SILENT},
+	"strictatime":   {false, syscall.MS_STRICTATIME},
+	"suid":          {true, syscall.MS_NOSUID},
+	"symfollow":     {true, unix.MS_NOSYMFOLLOW},
+	"sync":          {false, syscall.MS_SYNCHRONOUS},
+}
+
+// mountPropagationMap holds the propagation options, which the kernel only accepts on their own
+// in a separate mount call.
+var mountPropagationMap = map[string]uintptr{
+	"private":     syscall.MS_PRIVATE,
+	"rprivate":    syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":      syscall.MS_SHARED,
+	"rshared":     syscall.MS_SHARED | syscall.MS_REC,
+	"slave":       syscall.MS_SLAVE,
+	"rslave":      syscall.MS_SLAVE | syscall.MS_REC,
+	"unbindable":  syscall.MS_UNBINDABLE,
+	"runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// mountAttrMap holds the recursive options, which are applied to every mount below the mount
+// point with mount_setattr(2) rather than just the mount point.
+var mountAttrMap = map[string]struct {
+	clear bool
+	attr  uint64
+}{
+	"rro":            {false, unix.MOUNT_ATTR_RDONLY},
+	"rrw":            {true, unix.MOUNT_ATTR_RDONLY},
+	"rnosuid":        {false, unix.MOUNT_ATTR_NOSUID},
+	"rsuid":          {true, unix.MOUNT_ATTR_NOSUID},
+	"rnodev":         {false, unix.MOUNT_ATTR_NODEV},
+	"rdev":           {true, unix.MOUNT_ATTR_NODEV},
+	"rnoexec":        {false, unix.MOUNT_ATTR_NOEXEC},
+	"rexec":          {true, unix.MOUNT_ATTR_NOEXEC},
+	"rnodiratime":    {false, unix.MOUNT_ATTR_NODIRATIME},
+	"rdiratime":      {true, unix.MOUNT_ATTR_NODIRATIME},
+	"rrelatime":      {false, unix.MOUNT_ATTR_RELATIME},
+	"rnorelatime":    {true, unix.MOUNT_ATTR_RELATIME},
+	"rnoatime":       {false, unix.MOUNT_ATTR_NOATIME},
+	"ratime":         {true, unix.MOUNT_ATTR_NOATIME},
+	"rstrictatime":   {false, unix.MOUNT_ATTR_STRICTATIME},
+	"rnostrictatime": {true, unix.MOUNT_ATTR_STRICTATIME},
+	"rnosymfollow":   {false, unix.MOUNT_ATTR_NOSYMFOLLOW},
+	"rsymfollow":     {true, unix.MOUNT_ATTR_NOSYMFOLLOW},
+}
 
+// atimeMountFlags are the flags which choose how access times are updated.
+const atimeMountFlags = syscall.MS_NOATIME | syscall.MS_RELATIME | syscall.MS_STRICTATIME
+
+// MountOptions are the mount options from an OCI runtime config, split up into the separate calls
+// needed to apply them.
+type MountOptions struct {
+	// Flags and Data are passed to mount(2)
+	Flags uintptr
+	Data  string
+	// ClearFlags are the flags which were explicitly turned off, such as with rw or suid
+	ClearFlags uintptr
+	// Propagation is applied after the mount with a mount(2) call for each change
+	Propagation []uintptr
+	// Attr is applied to the whole mount tree with mount_setattr(2), nil if there are no
+	// recursive options
+	Attr *unix.MountAttr
+}
+
+// ParseMountOptions expects a list of mount options from an OCI runtime config. It converts these
+// options into the corresponding `flags` and `data` parameters for the mount syscall, along with
+// the propagation changes and recursive attributes which must be applied separately. Options
+// which aren't flags are passed on as data.
+// See: https://github.com/opencontainers/runtime-spec/blob/main/config.md#linux-mount-options
+func ParseMountOptions(options []string) (*MountOptions, error) {
+	result := &MountOptions{}
+	var data []string
 	for _, o := range options {
-		if flag, ok := mountFlagMap[o]; ok {
-			flags |= flag
+		if f, ok := mountFlagMap[o]; ok {
+			if f.clear {
+				result.Flags &^= f.flag
+				result.ClearFlags |= f.flag
+			} else {
+				result.Flags |= f.flag
+				result.ClearFlags &^= f.flag
+			}
+		} else if flag, ok := mountPropagationMap[o]; ok {
+			result.Propagation = append(result.Propagation, flag)
+		} else if a, ok := mountAttrMap[o]; ok {
+			if result.Attr == nil {
+				result.Attr = &unix.MountAttr{}
+			}
+			// the access time attributes are a field rather than separate bits
+			isAtime := a.attr == unix.MOUNT_ATTR_RELATIME || a.attr&unix.MOUNT_ATTR__ATIME != 0
+			switch {
+			case a.clear && isAtime:
+				result.Attr.Attr_clr |= unix.MOUNT_ATTR__ATIME
+				result.Attr.Attr_set &^= unix.MOUNT_ATTR__ATIME
+			case a.clear:
+				result.Attr.Attr_clr |= a.attr
+				result.Attr.Attr_set &^= a.attr
+			case isAtime:
+				result.Attr.Attr_clr |= unix.MOUNT_ATTR__ATIME
+				result.Attr.Attr_set = result.Attr.Attr_set&^unix.MOUNT_ATTR__ATIME | a.attr
+			default:
+				result.Attr.Attr_set |= a.attr
+				result.Attr.Attr_clr &^= a.attr
+			}
+		} else if o == "idmap" || o == "ridmap" {
+			return nil, fmt.Errorf("unsupported mount option %s", o)
 		} else {
-			dataBuilder.WriteString(o + ",")
-
+			data = append(data, o)
 		}
 	}
+	result.Data = strings.Join(data, ",")
+	return result, nil
+}
 
-	return flags, dataBuilder.String(), nil
+// MountWithOptions mounts `source` at `destination` with the mount options from an OCI runtime
+// config. Bind mounts ignore every flag but MS_REC until they are remounted, so they are bind
+// mounted first and then remounted with the rest.
+func MountWithOptions(source string, destination string, fstype string, options []string) error {
+	opts, err := ParseMountOptions(options)
+	if err != nil {
+		return err
+	}
+	flags := opts.Flags
+	if flags&syscall.MS_BIND != 0 {
+		if err := syscall.Mount(source, destination, "", flags&(syscall.MS_BIND|syscall.MS_REC), ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %w", destination, err)
+		}
+		flags &^= syscall.MS_BIND | syscall.MS_REC | syscall.MS_REMOUNT
+		if flags != 0 || opts.ClearFlags != 0 {
+			if err := RemountBind(destination, flags, opts.ClearFlags); err != nil {
+				return err
+			}
+		}
+	} else if fstype != "" || flags != 0 || len(opts.Propagation) == 0 {
+		// a mount with only propagation options changes an existing mount instead
+		if err := syscall.Mount(source, destination, fstype, flags, opts.Data); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", destination, err)
+		}
+	}
+	for _, propagation := range opts.Propagation {
+		if err := syscall.Mount("", destination, "", propagation, ""); err != nil {
+			return fmt.Errorf("failed to change mount propagation of %s: %w", destination, err)
+		}
+	}
+	if opts.Attr != nil {
+		if err := unix.MountSetattr(-1, destination, unix.AT_RECURSIVE, opts.Attr); err != nil {
+			return fmt.Errorf("failed to set recursive mount options of %s: %w", destination, err)
+		}
+	}
+	return nil
 }
 
 var namespaceFlagMap = map[specs.LinuxNamespaceType]uintptr{
@@ -112,25 +264,125 @@ func CloneFlagsFromNamespaces(namespaces []specs.LinuxNamespace) uintptr {
 	return flags
 }
 
-type SpecialDevice int
+// HasNamespace returns whether `namespaces` includes a namespace of type `nsType`.
+func HasNamespace(namespaces []specs.LinuxNamespace, nsType specs.LinuxNamespaceType) bool {
+	return slices.ContainsFunc(namespaces, func(ns specs.LinuxNamespace) bool {
+		return ns.Type == nsType
+	})
+}
 
-const (
-	Null    SpecialDevice = (1 << 8) | 3
-	Zero    SpecialDevice = (1 << 8) | 5
-	Full    SpecialDevice = (1 << 8) | 7
-	Random  SpecialDevice = (1 << 8) | 8
-	URandom SpecialDevice = (1 << 8) | 9
-	TTY     SpecialDevice = (5 << 8) | 0
-	Ptmx    SpecialDevice = (5 << 8) | 2
-)
+// namespaceFileMap maps namespace types to their file in /proc/<pid>/ns.
+var namespaceFileMap = map[specs.LinuxNamespaceType]string{
+	specs.PIDNamespace:     "pid",
+	specs.NetworkNamespace: "net",
+	specs.MountNamespace:   "mnt",
+	specs.IPCNamespace:     "ipc",
+	specs.UTSNamespace:     "uts",
+	specs.UserNamespace:    "user",
+	specs.CgroupNamespace:  "cgroup",
+	specs.TimeNamespace:    "time",
+}
 
-func CreateSpecialDevice(path string, dev SpecialDevice) error {
-	if err := syscall.Mknod(path, syscall.S_IFCHR|0666, int(dev)); err != nil {
-		return fmt.Errorf("failed to create special device at %s: %w", path, err)
+// CgroupPathFromPid returns the path in the cgroup v2 hierarchy of the cgroup which process `pid`
+// belongs to.
+func CgroupPathFromPid(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for line := range strings.Lines(string(data)) {
+		if path, ok := strings.CutPrefix(strings.TrimSpace(line), "0::"); ok {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+	return "", fmt.Errorf("process %d is not in a cgroup v2 hierarchy", pid)
+}
+
+// statfsMountFlags maps the flags of a mount reported by statfs(2) to their mount flags.
+var statfsMountFlags = map[int64]uintptr{
+	unix.ST_RDONLY:     syscall.MS_RDONLY,
+	unix.ST_NOSUID:     syscall.MS_NOSUID,
+	unix.ST_NODEV:      syscall.MS_NODEV,
+	unix.ST_NOEXEC:     syscall.MS_NOEXEC,
+	unix.ST_NOATIME:    syscall.MS_NOATIME,
+	unix.ST_NODIRATIME: syscall.MS_NODIRATIME,
+	unix.ST_RELATIME:   syscall.MS_RELATIME,
+}
+
+// RemountReadonly makes the bind mount at `path` readonly.
+func RemountReadonly(path string) error {
+	return RemountBind(path, syscall.MS_RDONLY, 0)
+}
+
+// RemountBind changes the flags of the bind mount at `path` to `flags`. The flags the mount
+// already has are kept unless they are in `clearFlags`, as a user namespace can't clear those of
+// a mount it inherited.
+func RemountBind(path string, flags uintptr, clearFlags uintptr) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return fmt.Errorf("failed to statfs %s: %w", path, err)
+	}
+	existing := uintptr(0)
+	for st, ms := range statfsMountFlags {
+		if int64(stat.Flags)&st != 0 {
+			existing |= ms
+		}
+	}
+	// only one way of updating access times can be chosen
+	if flags&atimeMountFlags != 0 {
+		existing &^= atimeMountFlags
+	}
+	flags |= syscall.MS_BIND | syscall.MS_REMOUNT | existing&^clearFlags
+	if err := syscall.Mount(path, path, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to remount bind mount %s: %w", path, err)
 	}
 	return nil
 }
 
+// maxSymlinks is the number of symlinks SecureJoin follows before giving up, the same as Linux.
+const maxSymlinks = 40
+
+// SecureJoin joins `path` onto `root` like filepath.Join, but resolves symlinks along the way as
+// if `root` were the root directory, so that the result never escapes it. Components which don't
+// exist are joined as they are.
+func SecureJoin(root string, path string) (string, error) {
+	resolved := "/"
+	remaining := path
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if errors.Is(err, os.ErrNotExist) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = target + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
 // MaskPaths hides the given set of paths by bind mounting either `dirMask` or `fileMask`
 // on top of them, depending on whether the path is a directory or file respectively.
 func MaskPaths(paths []string, dirMask string, fileMask string) error {
@@ -151,72 +403,249 @@ func MaskPaths(paths []string, dirMask string, fileMask string) error {
 	return nil
 }
 
-var capMap = map[string]cap.Value{
-	"CAP_CHOWN":            cap.CHOWN,
-	"CAP_DAC_OVERRIDE":     cap.DAC_OVERRIDE,
-	"CAP_FSETID":           cap.FSETID,
-	"CAP_FOWNER":           cap.FOWNER,
-	"CAP_MKNOD":            cap.MKNOD,
-	"CAP_NET_RAW":          cap.NET_RAW,
-	"CAP_SETGID":           cap.SETGID,
-	"CAP_SETUID":           cap.SETUID,
-	"CAP_SETFCAP":          cap.SETFCAP,
-	"CAP_SETPCAP":          cap.SETPCAP,
-	"CAP_NET_BIND_SERVICE": cap.NET_BIND_SERVICE,
-	"CAP_SYS_CHROOT":       cap.SYS_CHROOT,
-	"CAP_KILL":             cap.KILL,
-	"CAP_AUDIT_WRITE":      cap.AUDIT_WRITE,
-}
-
 // ParseCapabilities takes a list of capability strings from an OCI runtime config and returns
-// the corresponding libcap `cap.Value` enum values.
-func ParseCapabilities(capabilities []string) ([]cap.Value, error) {
-	results := []cap.Value{}
+// the corresponding libcap `cap.Value` enum values. Like runc, capabilities which are unknown or
+// not supported by the running kernel are skipped rather than failing, and returned as `skipped`
+// for the caller to warn about.
+func ParseCapabilities(capabilities []string) (values []cap.Value, skipped []string) {
+	values = []cap.Value{}
 	for _, capability := range capabilities {
-		if val, ok := capMap[capability]; ok {
-			results = append(results, val)
-		} else {
-			return []cap.Value{}, fmt.Errorf("found unsupported capability %s", capability)
+		val, err := cap.FromName(strings.ToLower(capability))
+		if err != nil || val >= cap.MaxBits() {
+			skipped = append(skipped, capability)
+			continue
 		}
+		values = append(values, val)
 	}
-	return results, nil
+	return values, skipped
 }
 
-const ipForwardFile = "/proc/sys/net/ipv4/ip_forward"
+// AllCapabilities returns the name of every capability supported by the running kernel.
+func AllCapabilities() []string {
+	var names []string
+	for c := cap.Value(0); c < cap.MaxBits() && c < cap.NamedCount; c++ {
+		names = append(names, strings.ToUpper(c.String()))
+	}
+	return names
+}
 
-// SetupNAT enables IP forwarding and creates an iptables rule to masquerade the container IP as coming from the host
-func SetupNAT(ip string, portMapping string) (int, error) {
-	// Try enable IP forwarding if it's not already
-	data, err := os.ReadFile(ipForwardFile)
-	if err != nil {
-		return 0, err
+// DropPrivileges switches the current process to `user` and reduces its capabilities to those
+// in `capabilities`.
+// https://sites.google.com/site/fullycapable/Home?authuser=0
+// the capabilities APIs are strange:
+//   - ambient and bounding controlled through prctl
+//   - bounding can only be dropped, and dropping it needs CAP_SETPCAP
+//   - effective, permitted, inheritable controlled through capset
+//   - ambient can only contain capabilities which are permitted and inheritable
+//
+// so the order is bounding, user, capset then ambient. The user is switched with the libcap
+// helpers which keep the permitted set, otherwise leaving uid 0 clears it.
+func DropPrivileges(ctx context.Context, user specs.User, capabilities *specs.LinuxCapabilities) error {
+	if capabilities == nil {
+		capabilities = &specs.LinuxCapabilities{}
+	}
+	var skipped []string
+	parse := func(names []string) []cap.Value {
+		values, unknown := ParseCapabilities(names)
+		skipped = append(skipped, unknown...)
+		return values
+	}
+	boundingValues := parse(capabilities.Bounding)
+	effectiveValues := parse(capabilities.Effective)
+	permittedValues := parse(capabilities.Permitted)
+	inheritableValues := parse(capabilities.Inheritable)
+	ambientValues := parse(capabilities.Ambient)
+	if len(skipped) > 0 {
+		slices.Sort(skipped)
+		Logger(ctx).Warn("ignoring capabilities which are unknown or not supported by the kernel", "capabilities", slices.Compact(skipped))
+	}
+
+	// bounding
+	for c := cap.Value(0); c < cap.NamedCount; c++ {
+		v, err := cap.GetBound(c)
+		if err != nil {
+			return fmt.Errorf("failed to get bounding capabiliy %s: %w", c.String(), err)
+		}
+		if v && !slices.Contains(boundingValues, c) {
+			if err := cap.DropBound(c); err != nil {
+				return fmt.Errorf("failed to drop bounding capability %s: %w", c.String(), err)
+			}
+		}
+	}
+
+	// user and groups
+	additionalGids := make([]int, len(user.AdditionalGids))
+	for i, gid := range user.AdditionalGids {
+		additionalGids[i] = int(gid)
+	}
+	if setgroupsDenied() {
+		// only the single gid of a rootless user is mapped, so there are no groups to set
+		if len(additionalGids) > 0 {
+			Logger(ctx).Warn("ignoring additional groups as setgroups is denied in the user namespace", "gids", user.AdditionalGids)
+		}
+		if err := syscall.Setgid(int(user.GID)); err != nil {
+			return fmt.Errorf("failed to set gid %d: %w", user.GID, err)
+		}
+	} else if err := cap.SetGroups(int(user.GID), additionalGids...); err != nil {
+		return fmt.Errorf("failed to set gid %d and groups %v: %w", user.GID, user.AdditionalGids, err)
+	}
+	if err := cap.SetUID(int(user.UID)); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", user.UID, err)
+	}
+
+	// effective, permitted, inheritable
+	set := cap.NewSet()
+	for _, capability := range effectiveValues {
+		set.SetFlag(cap.Effective, true, capability)
+	}
+	for _, capability := range permittedValues {
+		set.SetFlag(cap.Permitted, true, capability)
+	}
+	for _, capability := range inheritableValues {
+		set.SetFlag(cap.Inheritable, true, capability)
+	}
+	if err := set.SetProc(); err != nil {
+		return fmt.Errorf("failed to set effective/permitted/inheritable capabilities of the process: %w", err)
+	}
+
+	// ambient
+	if err := cap.ResetAmbient(); err != nil {
+		return fmt.Errorf("failed to reset ambient capabilities: %w", err)
+	}
+	if len(ambientValues) > 0 {
+		if err := cap.SetAmbient(true, ambientValues...); err != nil {
+			return fmt.Errorf("failed to set ambient capabilities: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ApplySecurity drops the privileges of the current process to those of `process` and installs
+// the `seccomp` filter. Without no_new_privs installing a filter needs CAP_SYS_ADMIN, so it is
+// installed before privileges are dropped and then also applies to the syscalls used to drop them.
+func ApplySecurity(ctx context.Context, process *specs.Process, seccomp *specs.LinuxSeccomp) error {
+	if !process.NoNewPrivileges {
+		if err := InstallSeccomp(seccomp); err != nil {
+			return err
+		}
+	}
+	if err := DropPrivileges(ctx, process.User, process.Capabilities); err != nil {
+		return err
+	}
+	if process.NoNewPrivileges {
+		if err := SetNoNewPrivileges(); err != nil {
+			return err
+		}
+		if err := InstallSeccomp(seccomp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNoNewPrivileges stops the current process and its children from gaining privileges through
+// execve, e.g. from setuid binaries or file capabilities. It is a per thread attribute, so it is
+// set on every thread as we can't know which one will execve.
+func SetNoNewPrivileges() error {
+	if _, err := cap.Prctlw(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	return nil
+}
+
+var rlimitMap = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// SetRlimits applies the rlimits from an OCI runtime config to the current process. Raising a hard
+// limit needs CAP_SYS_RESOURCE, so this must happen before privileges are dropped.
+func SetRlimits(rlimits []specs.POSIXRlimit) error {
+	for _, rlimit := range rlimits {
+		resource, ok := rlimitMap[rlimit.Type]
+		if !ok {
+			return fmt.Errorf("found unsupported rlimit %s", rlimit.Type)
+		}
+		// syscall.Setrlimit also stops Go restoring its own RLIMIT_NOFILE on exec
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}); err != nil {
+			return fmt.Errorf("failed to set rlimit %s: %w", rlimit.Type, err)
+		}
 	}
-	ipForwardEnabled, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return nil
+}
+
+// ParseUlimit parses a `--ulimit` flag of the form <name>=<soft>[:<hard>], where the name is an
+// rlimit with or without the `RLIMIT_` prefix in any case (`nofile`, `RLIMIT_NOFILE`) and the
+// limits are numbers or `unlimited`. The hard limit defaults to the soft limit.
+func ParseUlimit(ulimit string) (specs.POSIXRlimit, error) {
+	name, limits, ok := strings.Cut(ulimit, "=")
+	if !ok {
+		return specs.POSIXRlimit{}, fmt.Errorf("invalid ulimit %s, expected <name>=<soft>[:<hard>]", ulimit)
+	}
+	rlimitType := strings.ToUpper(name)
+	if !strings.HasPrefix(rlimitType, "RLIMIT_") {
+		rlimitType = "RLIMIT_" + rlimitType
+	}
+	if _, ok := rlimitMap[rlimitType]; !ok {
+		return specs.POSIXRlimit{}, fmt.Errorf("unknown ulimit %s", name)
+	}
+	softValue, hardValue, hasHard := strings.Cut(limits, ":")
+	soft, err := parseRlimitValue(softValue)
 	if err != nil {
-		return 0, err
+		return specs.POSIXRlimit{}, fmt.Errorf("invalid soft limit for ulimit %s: %w", name, err)
 	}
-	if ipForwardEnabled != 1 {
-		if err := os.WriteFile(ipForwardFile, []byte("1"), 0644); err != nil {
-			return ipForwardEnabled, err
+	hard := soft
+	if hasHard {
+		if hard, err = parseRlimitValue(hardValue); err != nil {
+			return specs.POSIXRlimit{}, fmt.Errorf("invalid hard limit for ulimit %s: %w", name, err)
 		}
 	}
+	if soft > hard {
+		return specs.POSIXRlimit{}, fmt.Errorf("soft limit %d for ulimit %s is greater than the hard limit %d", soft, name, hard)
+	}
+	return specs.POSIXRlimit{Type: rlimitType, Soft: soft, Hard: hard}, nil
+}
 
+func parseRlimitValue(value string) (uint64, error) {
+	if value == "unlimited" || value == "-1" {
+		return unix.RLIM_INFINITY, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// SetupNAT creates iptables rules to masquerade the container IP as coming from the host and to
+// forward the port in `portMapping` to the container
+func SetupNAT(ip string, portMapping string) error {
 	// outbound
 	if err := outboundNATRule(ip, false); err != nil {
-		return ipForwardEnabled, err
+		return err
 	}
 
 	// inbound
 	if err := inboundNATRule(ip, portMapping, false); err != nil {
-		return ipForwardEnabled, err
+		return err
 	}
 
-	return ipForwardEnabled, nil
+	return nil
 }
 
-// CleanupNAT cleans up the ip forwading setting and iptables rule added by SetupNAT
-func CleanupNAT(ip string, portMapping string, ipForwardEnabled int) {
-	os.WriteFile(ipForwardFile, []byte(strconv.Itoa(ipForwardEnabled)), 0644)
+// CleanupNAT cleans up the iptables rules added by SetupNAT
+func CleanupNAT(ip string, portMapping string) {
 	// we don't handle the error since if the rule was never written it will fail
 	outboundNATRule(ip, true)
 	inboundNATRule(ip, portMapping, true)
@@ -259,6 +688,17 @@ func inboundNATRule(ip string, portMapping string, del bool) error {
 	return nil
 }
 
+// ResolveExecutable finds `executable` using the PATH in `env` if there is one, otherwise it is
+// returned as is.
+func ResolveExecutable(executable string, env []string) (string, error) {
+	for _, envVar := range env {
+		if path, ok := strings.CutPrefix(envVar, "PATH="); ok {
+			return FindExecutable(executable, path)
+		}
+	}
+	return executable, nil
+}
+
 // FindExecutable takes an executable name and a PATH environment variable and tries
 // to find the given executable in the paths. It returns the full path to the executable
 // or an error.
@@ -293,3 +733,64 @@ func FindExecutable(executable string, path string) (string, error) {
 
 	return "", fmt.Errorf("failed to find executable: %s", executable)
 }
+
+// ExitCodeFromState returns the exit code of a finished process the way a shell would report it,
+// 128+n if it was killed by signal n.
+func ExitCodeFromState(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		return ExitCodeFromWaitStatus(status)
+	}
+	return state.ExitCode()
+}
+
+// ExitCodeFromWaitStatus is ExitCodeFromState for a process reaped with wait4(2).
+func ExitCodeFromWaitStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// The real-time signals as numbered by glibc, which keeps the first two for itself.
+const (
+	sigRTMIN = 34
+	sigRTMAX = 64
+)
+
+// ParseSignal converts a signal name (`TERM`, `SIGTERM`, `SIGRTMIN+3`) or number (`15`) into a
+// signal.
+func ParseSignal(signal string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(signal); err == nil {
+		if n <= 0 || n > sigRTMAX {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+
+	// real-time signals, counted from SIGRTMIN or SIGRTMAX, e.g. SIGRTMIN+3 or SIGRTMAX-1
+	for base, prefix := range map[int]string{sigRTMIN: "SIGRTMIN", sigRTMAX: "SIGRTMAX"} {
+		offset, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		n := 0
+		if offset != "" {
+			var err error
+			if n, err = strconv.Atoi(offset); err != nil || (offset[0] != '+' && offset[0] != '-') {
+				return 0, fmt.Errorf("unknown signal %s", signal)
+			}
+		}
+		if base+n < sigRTMIN || base+n > sigRTMAX {
+			return 0, fmt.Errorf("invalid signal %s, real-time signals are from SIGRTMIN to SIGRTMAX", signal)
+		}
+		return syscall.Signal(base + n), nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", signal)
+}
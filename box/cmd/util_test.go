@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		options []string
+		want    MountOptions
+		wantErr bool
+	}{
+		// flags
+		{options: []string{"async"}, want: MountOptions{ClearFlags: syscall.MS_SYNCHRONOUS}},
+		{options: []string{"atime"}, want: MountOptions{ClearFlags: syscall.MS_NOATIME}},
+		{options: []string{"bind"}, want: MountOptions{Flags: syscall.MS_BIND}},
+		{options: []string{"defaults"}, want: MountOptions{}},
+		{options: []string{"dev"}, want: MountOptions{ClearFlags: syscall.MS_NODEV}},
+		{options: []string{"diratime"}, want: MountOptions{ClearFlags: syscall.MS_NODIRATIME}},
+		{options: []string{"dirsync"}, want: MountOptions{Flags: syscall.MS_DIRSYNC}},
+		{options: []string{"exec"}, want: MountOptions{ClearFlags: syscall.MS_NOEXEC}},
+		{options: []string{"iversion"}, want: MountOptions{Flags: unix.MS_I_VERSION}},
+		{options: []string{"lazytime"}, want: MountOptions{Flags: unix.MS_LAZYTIME}},
+		{options: []string{"loud"}, want: MountOptions{ClearFlags: syscall.MS_SILENT}},
+		{options: []string{"mand"}, want: MountOptions{Flags: syscall.MS_MANDLOCK}},
+		{options: []string{"noatime"}, want: MountOptions{Flags: syscall.MS_NOATIME}},
+		{options: []string{"nodev"}, want: MountOptions{Flags: syscall.MS_NODEV}},
+		{options: []string{"nodiratime"}, want: MountOptions{Flags: syscall.MS_NODIRATIME}},
+		{options: []string{"noexec"}, want: MountOptions{Flags: syscall.MS_NOEXEC}},
+		{options: []string{"noiversion"}, want: MountOptions{ClearFlags: unix.MS_I_VERSION}},
+		{options: []string{"nolazytime"}, want: MountOptions{ClearFlags: unix.MS_LAZYTIME}},
+		{options: []string{"nomand"}, want: MountOptions{ClearFlags: syscall.MS_MANDLOCK}},
+		{options: []string{"norelatime"}, want: MountOptions{ClearFlags: syscall.MS_RELATIME}},
+		{options: []string{"nostrictatime"}, want: MountOptions{ClearFlags: syscall.MS_STRICTATIME}},
+		{options: []string{"nosuid"}, want: MountOptions{Flags: syscall.MS_NOSUID}},
+		{options: []string{"nosymfollow"}, want: MountOptions{Flags: unix.MS_NOSYMFOLLOW}},
+		{options: []string{"rbind"}, want: MountOptions{Flags: syscall.MS_BIND | syscall.MS_REC}},
+		{options: []string{"relatime"}, want: MountOptions{Flags: syscall.MS_RELATIME}},
+		{options: []string{"remount"}, want: MountOptions{Flags: syscall.MS_REMOUNT}},
+		{options: []string{"ro"}, want: MountOptions{Flags: syscall.MS_RDONLY}},
+		{options: []string{"rw"}, want: MountOptions{ClearFlags: syscall.MS_RDONLY}},
+		{options: []string{"silent"}, want: MountOptions{Flags: syscall.MS_SILENT}},
+		{options: []string{"strictatime"}, want: MountOptions{Flags: syscall.MS_STRICTATIME}},
+		{options: []string{"suid"}, want: MountOptions{ClearFlags: syscall.MS_NOSUID}},
+		{options: []string{"symfollow"}, want: MountOptions{ClearFlags: unix.MS_NOSYMFOLLOW}},
+		{options: []string{"sync"}, want: MountOptions{Flags: syscall.MS_SYNCHRONOUS}},
+
+		// propagation
+		{options: []string{"private"}, want: MountOptions{Propagation: []uintptr{syscall.MS_PRIVATE}}},
+		{options: []string{"rprivate"}, want: MountOptions{Propagation: []uintptr{syscall.MS_PRIVATE | syscall.MS_REC}}},
+		{options: []string{"shared"}, want: MountOptions{Propagation: []uintptr{syscall.MS_SHARED}}},
+		{options: []string{"rshared"}, want: MountOptions{Propagation: []uintptr{syscall.MS_SHARED | syscall.MS_REC}}},
+		{options: []string{"slave"}, want: MountOptions{Propagation: []uintptr{syscall.MS_SLAVE}}},
+		{options: []string{"rslave"}, want: MountOptions{Propagation: []uintptr{syscall.MS_SLAVE | syscall.MS_REC}}},
+		{options: []string{"unbindable"}, want: MountOptions{Propagation: []uintptr{syscall.MS_UNBINDABLE}}},
+		{options: []string{"runbindable"}, want: MountOptions{Propagation: []uintptr{syscall.MS_UNBINDABLE | syscall.MS_REC}}},
+
+		// recursive attributes
+		{options: []string{"rro"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}}},
+		{options: []string{"rrw"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}}},
+		{options: []string{"rnosuid"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NOSUID}}},
+		{options: []string{"rsuid"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_NOSUID}}},
+		{options: []string{"rnodev"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NODEV}}},
+		{options: []string{"rdev"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_NODEV}}},
+		{options: []string{"rnoexec"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NOEXEC}}},
+		{options: []string{"rexec"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_NOEXEC}}},
+		{options: []string{"rnodiratime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NODIRATIME}}},
+		{options: []string{"rdiratime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_NODIRATIME}}},
+		{options: []string{"rrelatime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RELATIME, Attr_clr: unix.MOUNT_ATTR__ATIME}}},
+		{options: []string{"rnorelatime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR__ATIME}}},
+		{options: []string{"rnoatime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NOATIME, Attr_clr: unix.MOUNT_ATTR__ATIME}}},
+		{options: []string{"ratime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR__ATIME}}},
+		{options: []string{"rstrictatime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_STRICTATIME, Attr_clr: unix.MOUNT_ATTR__ATIME}}},
+		{options: []string{"rnostrictatime"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR__ATIME}}},
+		{options: []string{"rnosymfollow"}, want: MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NOSYMFOLLOW}}},
+		{options: []string{"rsymfollow"}, want: MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_NOSYMFOLLOW}}},
+
+		// combinations
+		// bind mounted, remounted read-only and then made a recursive slave
+		{
+			options: []string{"rbind", "ro", "rslave"},
+			want:    MountOptions{Flags: syscall.MS_BIND | syscall.MS_REC | syscall.MS_RDONLY, Propagation: []uintptr{syscall.MS_SLAVE | syscall.MS_REC}},
+		},
+		{
+			options: []string{"bind", "nosuid", "nodev", "rro", "private"},
+			want: MountOptions{
+				Flags:       syscall.MS_BIND | syscall.MS_NOSUID | syscall.MS_NODEV,
+				Propagation: []uintptr{syscall.MS_PRIVATE},
+				Attr:        &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY},
+			},
+		},
+		{
+			options: []string{"private", "rshared"},
+			want:    MountOptions{Propagation: []uintptr{syscall.MS_PRIVATE, syscall.MS_SHARED | syscall.MS_REC}},
+		},
+		{
+			options: []string{"ro", "rw"},
+			want:    MountOptions{ClearFlags: syscall.MS_RDONLY},
+		},
+		{
+			options: []string{"rw", "ro"},
+			want:    MountOptions{Flags: syscall.MS_RDONLY},
+		},
+		{
+			options: []string{"rro", "rrw"},
+			want:    MountOptions{Attr: &unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}},
+		},
+		{
+			options: []string{"rnoexec", "rnosuid", "rdev"},
+			want:    MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_NOEXEC | unix.MOUNT_ATTR_NOSUID, Attr_clr: unix.MOUNT_ATTR_NODEV}},
+		},
+		{
+			options: []string{"rnoatime", "rstrictatime"},
+			want:    MountOptions{Attr: &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_STRICTATIME, Attr_clr: unix.MOUNT_ATTR__ATIME}},
+		},
+
+		// data
+		{
+			options: []string{"nosuid", "size=65536k", "mode=755", "noexec"},
+			want:    MountOptions{Flags: syscall.MS_NOSUID | syscall.MS_NOEXEC, Data: "size=65536k,mode=755"},
+		},
+		{
+			options: []string{"rbind", "ro", "rslave", "uid=1000", "ridmap"},
+			wantErr: true,
+		},
+		{options: []string{"idmap"}, wantErr: true},
+		{options: []string{"ridmap"}, wantErr: true},
+		{options: []string{}, want: MountOptions{}},
+	}
+
+	tested := map[string]bool{}
+	for _, test := range tests {
+		if len(test.options) == 1 {
+			tested[test.options[0]] = true
+		}
+		t.Run(strings.Join(test.options, ","), func(t *testing.T) {
+			got, err := ParseMountOptions(test.options)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v, want %+v", *got, test.want)
+				if got.Attr != nil && test.want.Attr != nil {
+					t.Errorf("got attr %+v, want %+v", *got.Attr, *test.want.Attr)
+				}
+			}
+		})
+	}
+
+	// every option has a test of its own
+	var options []string
+	options = slices.AppendSeq(options, maps.Keys(mountFlagMap))
+	options = slices.AppendSeq(options, maps.Keys(mountPropagationMap))
+	options = slices.AppendSeq(options, maps.Keys(mountAttrMap))
+	for _, option := range options {
+		if !tested[option] {
+			t.Errorf("mount option %s is not tested", option)
+		}
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		capabilities []string
+		values       []cap.Value
+		skipped      []string
+	}{
+		{capabilities: nil, values: []cap.Value{}},
+		{capabilities: []string{"CAP_CHOWN", "CAP_KILL"}, values: []cap.Value{cap.CHOWN, cap.KILL}},
+		{capabilities: []string{"cap_net_raw"}, values: []cap.Value{cap.NET_RAW}},
+		{capabilities: []string{"CAP_CHOWN", "CAP_UNKNOWN", "NET_ADMIN"}, values: []cap.Value{cap.CHOWN}, skipped: []string{"CAP_UNKNOWN", "NET_ADMIN"}},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.capabilities, ","), func(t *testing.T) {
+			values, skipped := ParseCapabilities(test.capabilities)
+			if !reflect.DeepEqual(values, test.values) || !reflect.DeepEqual(skipped, test.skipped) {
+				t.Errorf("got %v and skipped %v, want %v and skipped %v", values, skipped, test.values, test.skipped)
+			}
+		})
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		signal  string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{signal: "15", want: syscall.SIGTERM},
+		{signal: "64", want: 64},
+		{signal: "TERM", want: syscall.SIGTERM},
+		{signal: "SIGTERM", want: syscall.SIGTERM},
+		{signal: "sigkill", want: syscall.SIGKILL},
+		{signal: "SIGRTMIN", want: 34},
+		{signal: "SIGRTMIN+3", want: 37},
+		{signal: "RTMIN+3", want: 37},
+		{signal: "SIGRTMAX", want: 64},
+		{signal: "SIGRTMAX-2", want: 62},
+		{signal: "rtmax-30", want: 34},
+		{signal: "0", wantErr: true},
+		{signal: "65", wantErr: true},
+		{signal: "SIGFOO", wantErr: true},
+		{signal: "SIGRTMIN-1", wantErr: true},
+		{signal: "SIGRTMAX+1", wantErr: true},
+		{signal: "SIGRTMIN+31", wantErr: true},
+		{signal: "SIGRTMIN3", wantErr: true},
+		{signal: "SIGRTMIN+", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.signal, func(t *testing.T) {
+			got, err := ParseSignal(test.signal)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseUlimit(t *testing.T) {
+	tests := []struct {
+		ulimit  string
+		want    specs.POSIXRlimit
+		wantErr bool
+	}{
+		{ulimit: "nofile=1024", want: specs.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024}},
+		{ulimit: "nofile=1024:4096", want: specs.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 4096}},
+		{ulimit: "NOFILE=1024:4096", want: specs.POSIXRlimit{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 4096}},
+		{ulimit: "RLIMIT_NPROC=100", want: specs.POSIXRlimit{Type: "RLIMIT_NPROC", Soft: 100, Hard: 100}},
+		{ulimit: "rlimit_core=0:unlimited", want: specs.POSIXRlimit{Type: "RLIMIT_CORE", Soft: 0, Hard: unix.RLIM_INFINITY}},
+		{ulimit: "core=unlimited", want: specs.POSIXRlimit{Type: "RLIMIT_CORE", Soft: unix.RLIM_INFINITY, Hard: unix.RLIM_INFINITY}},
+		{ulimit: "stack=-1:-1", want: specs.POSIXRlimit{Type: "RLIMIT_STACK", Soft: unix.RLIM_INFINITY, Hard: unix.RLIM_INFINITY}},
+		{ulimit: "memlock=0:0", want: specs.POSIXRlimit{Type: "RLIMIT_MEMLOCK", Soft: 0, Hard: 0}},
+		{ulimit: "nofile", wantErr: true},
+		{ulimit: "nofile=", wantErr: true},
+		{ulimit: "nofile=1024:", wantErr: true},
+		{ulimit: "nofile=:1024", wantErr: true},
+		{ulimit: "nofile=abc", wantErr: true},
+		{ulimit: "nofile=-2", wantErr: true},
+		{ulimit: "nofile=1024:512", wantErr: true},
+		{ulimit: "nofile=unlimited:1024", wantErr: true},
+		{ulimit: "nofile=1:2:3", wantErr: true},
+		{ulimit: "files=1024", wantErr: true},
+		{ulimit: "RLIMIT_=1024", wantErr: true},
+		{ulimit: "=1024", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ulimit, func(t *testing.T) {
+			got, err := ParseUlimit(test.ulimit)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetRlimits(t *testing.T) {
+	var original syscall.Rlimit
+	if err := syscall.Getrlimit(unix.RLIMIT_CORE, &original); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := syscall.Setrlimit(unix.RLIMIT_CORE, &original); err != nil {
+			t.Error(err)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		rlimits []specs.POSIXRlimit
+		want    syscall.Rlimit
+		wantErr bool
+	}{
+		{name: "none", want: original},
+		{
+			name:    "lowered soft limit",
+			rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_CORE", Soft: 0, Hard: original.Max}},
+			want:    syscall.Rlimit{Cur: 0, Max: original.Max},
+		},
+		{name: "unknown rlimit", rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_FILES", Soft: 1, Hard: 1}}, wantErr: true},
+		{name: "without the prefix", rlimits: []specs.POSIXRlimit{{Type: "CORE", Soft: 0, Hard: 0}}, wantErr: true},
+		{name: "soft above hard", rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_CORE", Soft: 2, Hard: 1}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := syscall.Setrlimit(unix.RLIMIT_CORE, &original); err != nil {
+				t.Fatal(err)
+			}
+			err := SetRlimits(test.rlimits)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got syscall.Rlimit
+			if err := syscall.Getrlimit(unix.RLIMIT_CORE, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc", "usr/lib", "var"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"abs":         "/etc",
+		"rel":         "../../usr/lib",
+		"escape":      "../../../../../../etc",
+		"etc/escape":  "/../../etc/passwd",
+		"var/run":     "../run",
+		"loop":        "loop",
+		"chain":       "abs",
+		"usr/lib/up":  "..",
+		"var/escapes": "/usr/lib/up/../../../..",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "", want: "/"},
+		{path: "/", want: "/"},
+		{path: "etc/passwd", want: "/etc/passwd"},
+		{path: "/etc/../usr/lib", want: "/usr/lib"},
+		{path: "../../etc", want: "/etc"},
+		{path: "missing/dir", want: "/missing/dir"},
+
+		// symlinks are resolved inside the root
+		{path: "abs/passwd", want: "/etc/passwd"},
+		{path: "rel", want: "/usr/lib"},
+		{path: "chain/passwd", want: "/etc/passwd"},
+		{path: "usr/lib/up/lib", want: "/usr/lib"},
+		{path: "var/run/box", want: "/run/box"},
+
+		// symlinks which escape the root are clamped to it
+		{path: "escape/passwd", want: "/etc/passwd"},
+		{path: "etc/escape", want: "/etc/passwd"},
+		{path: "var/escapes/etc", want: "/etc"},
+
+		{path: "loop", wantErr: true},
+		{path: "loop/file", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := SecureJoin(root, test.path)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, test.want); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
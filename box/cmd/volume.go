@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	volumesFolder    = "volumes"
+	volumeDataFolder = "_data"
+	volumeFile       = "volume.json"
+)
+
+// Volume is a directory managed by box which can be mounted into containers. Its contents live at
+// <root>/volumes/<name>/_data with the volume metadata alongside in volume.json.
+type Volume struct {
+	Name       string    `json:"name"`
+	Mountpoint string    `json:"mountpoint"`
+	Created    time.Time `json:"created"`
+	// Container is set for the anonymous volumes of a container, which are removed along with it
+	Container string `json:"container,omitempty"`
+}
+
+// CreateVolume creates volume `name`, returning the existing volume if there already is one and
+// whether it was created. Anonymous volumes are owned by `containerId`.
+func CreateVolume(name string, containerId string) (*Volume, bool, error) {
+	if !containerIdPattern.MatchString(name) {
+		return nil, false, fmt.Errorf("invalid volume name %s, must match %s", name, containerIdPattern)
+	}
+	if volume, err := LoadVolume(name); err == nil {
+		return volume, false, nil
+	}
+	volume := &Volume{
+		Name:       name,
+		Mountpoint: filepath.Join(volumePath(name), volumeDataFolder),
+		Created:    time.Now(),
+		Container:  containerId,
+	}
+	if err := os.MkdirAll(volume.Mountpoint, 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	data, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.WriteFile(filepath.Join(volumePath(name), volumeFile), data, 0644); err != nil {
+		return nil, false, fmt.Errorf("failed to write volume metadata: %w", err)
+	}
+	return volume, true, nil
+}
+
+// LoadVolume reads the metadata of volume `name` from disk.
+func LoadVolume(name string) (*Volume, error) {
+	data, err := os.ReadFile(filepath.Join(volumePath(name), volumeFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("volume %s does not exist", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	volume := &Volume{}
+	if err := json.Unmarshal(data, volume); err != nil {
+		return nil, fmt.Errorf("failed to decode volume %s: %w", name, err)
+	}
+	return volume, nil
+}
+
+// ListVolumes reads every volume on disk, ordered by name.
+func ListVolumes() ([]*Volume, error) {
+	entries, err := os.ReadDir(filepath.Join(stateRoot, volumesFolder))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var volumes []*Volume
+	for _, entry := range entries {
+		volume, err := LoadVolume(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes, nil
+}
+
+// Remove deletes the volume and its contents, unless a container still uses it.
+func (v *Volume) Remove() error {
+	containers, err := ListContainers()
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if container.ID == v.Container {
+			continue
+		}
+		config, err := container.Config()
+		if err != nil {
+			continue
+		}
+		for _, m := range config.Mounts {
+			if m.Source == v.Mountpoint {
+				return fmt.Errorf("volume %s is in use by container %s", v.Name, container.ID)
+			}
+		}
+	}
+	return os.RemoveAll(volumePath(v.Name))
+}
+
+// RemoveAnonymousVolumes deletes the anonymous volumes of container `containerId`.
+func RemoveAnonymousVolumes(containerId string) error {
+	volumes, err := ListVolumes()
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		if volume.Container == containerId {
+			if err := os.RemoveAll(volumePath(volume.Name)); err != nil {
+				return fmt.Errorf("failed to remove volume %s: %w", volume.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func volumePath(name string) string {
+	return filepath.Join(stateRoot, volumesFolder, name)
+}
+
+var volumeLsFormat string
+
+func init() {
+	volumeLsCmd.Flags().StringVar(&volumeLsFormat, "format", "table", "Output format (table or json)")
+
+	volumeCmd.AddCommand(volumeCreateCmd)
+	volumeCmd.AddCommand(volumeLsCmd)
+	volumeCmd.AddCommand(volumeRmCmd)
+	volumeCmd.AddCommand(volumeInspectCmd)
+}
+
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "manage named volumes",
+}
+
+var volumeCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "create a named volume",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		volume, created, err := CreateVolume(args[0], "")
+		if err != nil {
+			return err
+		}
+		if !created {
+			return fmt.Errorf("volume %s already exists", volume.Name)
+		}
+		fmt.Println(volume.Name)
+		return nil
+	},
+}
+
+var volumeLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list volumes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		volumes, err := ListVolumes()
+		if err != nil {
+			return fmt.Errorf("failed to list volumes: %w", err)
+		}
+
+		switch volumeLsFormat {
+		case "json":
+			if volumes == nil {
+				volumes = []*Volume{}
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(volumes)
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "VOLUME NAME\tCONTAINER\tCREATED\tMOUNTPOINT")
+			for _, v := range volumes {
+				container := "-"
+				if v.Container != "" {
+					container = v.Container
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.Name, container, v.Created.Format(time.DateTime), v.Mountpoint)
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown output format %s", volumeLsFormat)
+		}
+	},
+}
+
+var volumeRmCmd = &cobra.Command{
+	Use:   "rm <name>...",
+	Short: "remove volumes which are not used by a container",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var errs []error
+		for _, name := range args {
+			volume, err := LoadVolume(name)
+			if err == nil {
+				err = volume.Remove()
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	},
+}
+
+var volumeInspectCmd = &cobra.Command{
+	Use:   "inspect <name>",
+	Short: "show the details of a volume",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		volume, err := LoadVolume(args[0])
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(volume)
+	},
+}